@@ -1,7 +1,14 @@
 package agent
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/appcanary/agent/conf"
 )
@@ -9,80 +16,312 @@ import (
 var CanaryVersion string
 
 type Agent struct {
+	sync.Mutex
 	conf        *conf.Conf
 	client      Client
+	newClient   func(*Server) Client
 	server      *Server
 	files       Watchers
+	paths       Watchers
+	matched     map[string]Watcher
+	shipping    map[string]*sync.Mutex // see lockShipping
+	polling     bool
+	spool       *spool
+	ctx         context.Context
+	cancel      context.CancelFunc
 	DoneChannel chan os.Signal
+
+	// see apipolicy.go
+	apiPausedUntil time.Time
+	apiPauseCause  error
+	reregistering  bool
 }
 
 func NewAgent(version string, conf *conf.Conf, clients ...Client) *Agent {
-	agent := &Agent{conf: conf, files: Watchers{}}
+	agent := &Agent{conf: conf, files: Watchers{}, matched: map[string]Watcher{}, shipping: map[string]*sync.Mutex{}}
+
+	// cancelling it gives up on whatever requests are in flight
+	agent.ctx, agent.cancel = context.WithCancel(context.Background())
 
 	// Find out what we need about machine
 	// Fills out server conf if some values are missing
 	agent.server = NewServer(conf, conf.ServerConf)
 
 	if len(clients) > 0 {
-		agent.client = clients[0]
+		agent.client = agent.withPolicy(clients[0], agent.server)
+		agent.newClient = func(server *Server) Client { return agent.withPolicy(clients[0], server) }
 	} else {
-		agent.client = NewClient(conf.ApiKey, agent.server)
+		settings := agentClientSettings(agent.ctx, conf)
+		agent.client = agent.withPolicy(NewClient(conf.ApiKey, agent.server, settings), agent.server)
+		agent.newClient = func(server *Server) Client {
+			return agent.withPolicy(NewClient(conf.ApiKey, server, settings), server)
+		}
 	}
 
+	agent.spool = agentSpool(conf)
+
 	CanaryVersion = version
 	return agent
 }
 
 // instantiate structs, fs hook
 func (agent *Agent) StartPolling() {
-	for _, watcher := range agent.files {
+	agent.Lock()
+	agent.polling = true
+	agent.Unlock()
+
+	for _, watcher := range agent.watchers() {
+		watcher.Start()
+	}
+
+	for _, watcher := range agent.pathWatchers() {
 		watcher.Start()
 	}
 }
 
 func (agent *Agent) BuildAndSyncWatchers() {
 	for _, w := range agent.conf.Watchers {
+		if w.Discover != "" {
+			// discovered files are of all sorts, let each one work out its own kind
+			settings := w
+			settings.Kind = ""
+			agent.addPathsWatcher(NewDiscoveryWatcher(w.Discover, agent.pathsChangeHandler(settings), w))
+			continue
+		}
+
+		if w.Path != "" && IsGlob(w.Path) {
+			agent.addPathsWatcher(NewGlobWatcher(w.Path, agent.pathsChangeHandler(w), w))
+			continue
+		}
+
 		var watcher Watcher
 
-		if w.Process != "" {
-			watcher = NewProcessWatcher(w.Process, agent.OnChange)
+		if w.Image != "" {
+			watcher = NewImageWatcher(w.Image, agent.OnChange, w)
+		} else if w.Containers != "" {
+			watcher = NewContainerWatcher(w.Containers, agent.OnChange, w)
+		} else if w.Kernel {
+			watcher = NewKernelWatcher(agent.OnChange, w)
+		} else if w.Process != "" {
+			watcher = NewProcessWatcher(w.Process, agent.OnChange, w)
 		} else if w.Command != "" {
-			watcher = NewCommandOutputWatcher(w.Command, agent.OnChange)
+			watcher = NewCommandOutputWatcher(w.Command, agent.OnChange, w)
 		} else if w.Path != "" {
-			watcher = NewFileWatcher(w.Path, agent.OnChange)
+			watcher = NewFileWatcher(w.Path, agent.OnChange, w)
 		}
-		agent.files = append(agent.files, watcher)
+		agent.addWatcher(watcher)
 	}
 }
 
+// a snapshot of the current watchers, since paths watchers may add or remove
+// some at any time
+func (agent *Agent) watchers() Watchers {
+	agent.Lock()
+	defer agent.Unlock()
+	return append(Watchers{}, agent.files...)
+}
+
+func (agent *Agent) pathWatchers() Watchers {
+	agent.Lock()
+	defer agent.Unlock()
+	return append(Watchers{}, agent.paths...)
+}
+
+func (agent *Agent) addPathsWatcher(watcher Watcher) {
+	agent.Lock()
+	agent.paths = append(agent.paths, watcher)
+	polling := agent.polling
+	agent.Unlock()
+
+	if polling {
+		watcher.Start()
+	}
+}
+
+func (agent *Agent) addWatcher(watcher Watcher) {
+	agent.Lock()
+	agent.files = append(agent.files, watcher)
+	polling := agent.polling
+	agent.Unlock()
+
+	if polling {
+		watcher.Start()
+	}
+}
+
+// Files that matched a pattern get a watcher of their own, set up according to
+// the pattern's settings; files that no longer match get dropped. A path
+// matched by several patterns (or also configured literally) is only watched
+// once.
+func (agent *Agent) pathsChangeHandler(settings conf.WatcherConf) PathsChangeHandler {
+	return func(added []string, removed []string) {
+		agent.onPathsChange(settings, added, removed)
+	}
+}
+
+func (agent *Agent) onPathsChange(settings conf.WatcherConf, added []string, removed []string) {
+	log := conf.FetchLog()
+
+	for _, path := range removed {
+		if agent.stillMatched(path) {
+			continue
+		}
+
+		agent.Lock()
+		watcher, ok := agent.matched[path]
+		if ok {
+			delete(agent.matched, path)
+			agent.files = withoutWatcher(agent.files, watcher)
+		}
+		agent.Unlock()
+
+		if ok {
+			log.Infof("No longer watching %s", path)
+			watcher.Stop()
+		}
+	}
+
+	for _, path := range added {
+		if agent.watchingPath(path) {
+			continue
+		}
+
+		log.Infof("Now watching %s", path)
+		watcher := NewFileWatcher(path, agent.OnChange, settings)
+
+		agent.Lock()
+		agent.matched[path] = watcher
+		agent.Unlock()
+		agent.addWatcher(watcher)
+	}
+}
+
+func (agent *Agent) stillMatched(path string) bool {
+	for _, watcher := range agent.pathWatchers() {
+		for _, match := range watcher.(*pathsWatcher).Matches() {
+			if match == path {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (agent *Agent) watchingPath(path string) bool {
+	for _, watcher := range agent.watchers() {
+		if tw, ok := watcher.(TextWatcher); ok && tw.Path() == path {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutWatcher(watchers Watchers, watcher Watcher) Watchers {
+	remaining := make(Watchers, 0, len(watchers))
+	for _, w := range watchers {
+		if w != watcher {
+			remaining = append(remaining, w)
+		}
+	}
+	return remaining
+}
+
 func (agent *Agent) OnChange(w Watcher) {
+	agent.handleChange(w, false)
+}
+
+// Forcing a change ships the watcher's contents even if we already shipped the
+// exact same thing before.
+func (agent *Agent) handleChange(w Watcher, force bool) {
 	log := conf.FetchLog()
 
 	switch wt := w.(type) {
 	default:
 		log.Errorf("Don't know what to do with %T", wt)
 	case TextWatcher:
-		agent.handleTextChange(wt)
+		agent.handleTextChange(wt, force)
 	case ProcessWatcher:
-		agent.handleProcessChange(wt)
+		agent.handleProcessChange(wt, force)
+	case ImageWatcher:
+		err := agent.shipImage(wt.Path(), wt.Ref(), force)
+		if err != nil {
+			log.Infof("Image error: %s", err)
+		}
+	case ContainerWatcher:
+		for _, c := range wt.Containers() {
+			err := agent.shipContainer(c, force)
+			if err != nil {
+				log.Infof("Container error: %s", err)
+			}
+		}
+	case KernelWatcher:
+		// heartbeats carry the kernel's state, and syncs needn't send
+		// another one
+		if !force {
+			if err := agent.Heartbeat(); err != nil {
+				log.Infof("Heartbeat error: %s", err)
+			}
+		}
 	}
 }
 
-func (agent *Agent) handleProcessChange(pw ProcessWatcher) {
+// Process watchers ship what happened to the processes since last time, and
+// every so often (or when forced) the whole map.
+func (agent *Agent) handleProcessChange(pw ProcessWatcher, force bool) {
 	log := conf.FetchLog()
 
 	match := pw.Match()
-	if match == "*" {
-		log.Infof("Shipping process map")
-	} else {
-		log.Infof("Shipping process map for %s", match)
+	defer agent.lockShipping(spoolProcessState, match)()
+	events, snapshot := pw.TakeEvents(force)
+
+	var err error
+	if snapshot {
+		if match == "*" {
+			log.Infof("Shipping process map")
+		} else {
+			log.Infof("Shipping process map for %s", match)
+		}
+		err = agent.client.SendProcessState(match, pw.StateJson())
+	} else if events != nil {
+		log.Debugf("Shipping process events for %s", match)
+		err = agent.client.SendProcessEvents(match, events)
+	}
+
+	if err != nil {
+		log.Infof("Process map error: %s", err)
+		pw.Resync()
+
+		if snapshot {
+			agent.spoolFailure(&spoolEntry{Type: spoolProcessState, Key: match, Body: pw.StateJson()})
+		}
+		return
 	}
-	agent.client.SendProcessState(match, pw.StateJson())
+
+	if snapshot {
+		agent.spool.drop(spoolProcessState, match)
+	}
+}
+
+// lockShipping has whatever ships the same thing (a file, a process watcher's
+// map) take turns, so a replay from the spool can't overwrite something newer
+// that got through while it was under way, nor the other way round. It returns
+// the unlock.
+func (agent *Agent) lockShipping(entryType string, key string) func() {
+	agent.Lock()
+	lock, ok := agent.shipping[entryType+"\x00"+key]
+	if !ok {
+		lock = &sync.Mutex{}
+		agent.shipping[entryType+"\x00"+key] = lock
+	}
+	agent.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
 }
 
-func (agent *Agent) handleTextChange(tw TextWatcher) {
+func (agent *Agent) handleTextChange(tw TextWatcher, force bool) {
 	log := conf.FetchLog()
-	log.Infof("File change: %s", tw.Path())
+	defer agent.lockShipping(spoolFile, tw.Path())()
 
 	// should probably be in the actual hook code
 	contents, err := tw.Contents()
@@ -93,26 +332,286 @@ func (agent *Agent) handleTextChange(tw TextWatcher) {
 		return
 	}
 
-	err = agent.client.SendFile(tw.Path(), tw.Kind(), contents)
+	// watchers always see a change when they boot up, but if we shipped this
+	// before we were restarted there's no need to do it again
+	sum := checksum(contents)
+	if !force && agent.conf.ShippedChecksum(tw.Path()) == sum {
+		log.Debugf("Already shipped: %s", tw.Path())
+		return
+	}
+
+	log.Infof("File change: %s", tw.Path())
+
+	// package databases can be huge, so we try to get away with sending only
+	// what changed. Forced syncs always send everything, to reconcile.
+	packages, parsed := parsePackages(tw.Kind(), contents)
+	if parsed && !force {
+		err = agent.shipDiff(tw, packages, sum)
+		if err == nil {
+			return
+		}
+
+		var apiErr *ApiError
+		if err != errNoBaseline && err != ErrFullUploadRequired && !errors.As(err, &apiErr) {
+			// we couldn't reach the API at all. The diff won't apply to
+			// whatever's shipped by the time we get through, so what
+			// waits in the spool is all of it
+			log.Infof("Sendfile error: %s", err)
+			agent.spoolFile(tw, contents, sum)
+			return
+		}
+
+		// whatever the API had against the diff, it may yet take the file
+		log.Debugf("Shipping all of %s: %s", tw.Path(), err)
+	}
+
+	sent, err := agent.sendFile(tw)
 	if err != nil {
-		// TODO: some kind of queuing mechanism to keep trying beyond the
-		// exponential backoff in the client. What if the connection fails for
-		// whatever reason?
+		// the client's given up retrying, so it's up to the spool now
 		log.Infof("Sendfile error: %s", err)
+		agent.spoolFile(tw, contents, sum)
+		return
+	}
+
+	if sent != sum {
+		// it changed while it went out, so what the API has now isn't what
+		// we parsed; once the watcher notices, that gets shipped whole. What's
+		// in the spool is older still.
+		log.Debugf("%s changed while it was being shipped", tw.Path())
+		agent.spool.drop(spoolFile, tw.Path())
+		return
+	}
+	agent.shipped(tw.Path(), sum, packages, parsed)
+}
+
+// sendFile streams what the watcher's got to the API, rather than what we
+// read of it, and returns the checksum of what went out.
+func (agent *Agent) sendFile(tw TextWatcher) (string, error) {
+	file, err := tw.Open()
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	contents := newChecksumReader(file)
+	if err := agent.client.SendFile(tw.Path(), tw.Kind(), contents); err != nil {
+		return "", err
+	}
+	return contents.sum(), nil
+}
+
+func (agent *Agent) spoolFile(tw TextWatcher, contents []byte, sum string) {
+	agent.spoolFailure(&spoolEntry{
+		Type:     spoolFile,
+		Key:      tw.Path(),
+		Kind:     tw.Kind(),
+		Checksum: sum,
+		Body:     contents,
+	})
+}
+
+func (agent *Agent) spoolFailure(entry *spoolEntry) {
+	log := conf.FetchLog()
+
+	if err := agent.spool.put(entry); err != nil {
+		log.Infof("Couldn't spool %s: %s", entry.Key, err)
 	}
 }
 
+// ReplaySpool delivers whatever we failed to send before, in the order it
+// failed in, until the API fails us again.
+func (agent *Agent) ReplaySpool() error {
+	return agent.spool.replay(agent.deliverSpooled)
+}
+
+func (agent *Agent) deliverSpooled(entry *spoolEntry) error {
+	log := conf.FetchLog()
+	log.Debugf("Replaying %s %s from %s", entry.Type, entry.Key, entry.Queued)
+
+	// the watcher may have got something newer through since we read the
+	// spool, and that's not to be overwritten with this; nor is it to get
+	// through while this is on its way
+	if entry.Type != spoolHeartbeat {
+		defer agent.lockShipping(entry.Type, entry.Key)()
+		if !agent.spool.queued(entry) {
+			log.Debugf("Something newer than %s got shipped, skipping it", entry.Key)
+			return nil
+		}
+	}
+
+	switch entry.Type {
+	case spoolFile:
+		if agent.conf.ShippedAt(entry.Key).After(entry.Queued) {
+			log.Debugf("Something newer than %s got shipped, skipping it", entry.Key)
+			return nil
+		}
+		if err := agent.client.SendFile(entry.Key, entry.Kind, bytes.NewReader(entry.Body)); err != nil {
+			return err
+		}
+		packages, parsed := parsePackages(entry.Kind, entry.Body)
+		agent.shipped(entry.Key, entry.Checksum, packages, parsed)
+
+	case spoolProcessState:
+		return agent.client.SendProcessState(entry.Key, entry.Body)
+
+	case spoolHeartbeat:
+		// what a heartbeat says is only news while it's fresh
+		return agent.client.Heartbeat(agent.server.uuid(), agent.watchers())
+
+	default:
+		log.Infof("Discarding spooled %s of unknown type %s", entry.Key, entry.Type)
+	}
+	return nil
+}
+
+// shipDiff sends what changed since the snapshot we last shipped. That's only
+// possible (errNoBaseline otherwise) if we still have the snapshot and it's
+// what the server last acknowledged.
+func (agent *Agent) shipDiff(tw TextWatcher, packages packageSet, sum string) error {
+	log := conf.FetchLog()
+
+	base := agent.conf.ShippedChecksum(tw.Path())
+	snapshot, err := loadSnapshot(tw.Path())
+	if err != nil || base == "" || snapshot.Checksum != base {
+		return errNoBaseline
+	}
+
+	diff := diffPackages(snapshot.Packages, packages)
+	diff.Base = base
+	diff.Checksum = sum
+
+	log.Debugf("Shipping diff of %s: %d added, %d removed, %d changed",
+		tw.Path(), len(diff.Added), len(diff.Removed), len(diff.Changed))
+
+	err = agent.client.SendFileDiff(tw.Path(), tw.Kind(), diff)
+	if err != nil {
+		return err
+	}
+
+	agent.shipped(tw.Path(), sum, packages, true)
+	return nil
+}
+
+// Remember what we shipped, and if it was a package database keep its packages
+// around as the baseline for the next diff.
+func (agent *Agent) shipped(path string, sum string, packages packageSet, parsed bool) {
+	log := conf.FetchLog()
+
+	agent.conf.RecordShipped(path, sum)
+	agent.spool.drop(spoolFile, path)
+
+	if parsed {
+		err := saveSnapshot(&packageSnapshot{Path: path, Checksum: sum, Packages: packages})
+		if err != nil {
+			log.Infof("Can't save package snapshot for %s: %s", path, err)
+		}
+	}
+}
+
+// ShipImage inventories the container image at path and ships what it finds
+// as the image's own server, registering it first if need be. The image is
+// reported under ref, or if that's empty under the reference it was saved
+// with.
+func (agent *Agent) ShipImage(path string, ref string) error {
+	return agent.shipImage(path, ref, true)
+}
+
+func (agent *Agent) shipImage(path string, ref string, force bool) error {
+	inventory, err := inspectImage(path)
+	if err != nil {
+		return err
+	}
+
+	if ref == "" {
+		ref = inventory.Ref
+	}
+	if ref == "" {
+		ref = filepath.Base(path)
+	}
+
+	if len(inventory.Files) == 0 {
+		return fmt.Errorf("found no package databases or lockfiles in %s", ref)
+	}
+
+	server := NewImageServer(agent.conf, ref, inventory.Distro, inventory.Release)
+	return agent.shipInventory("image:"+ref, server, inventory, force)
+}
+
+func (agent *Agent) shipContainer(c containerInventory, force bool) error {
+	log := conf.FetchLog()
+
+	if len(c.Inventory.Files) == 0 {
+		log.Debugf("Found nothing to ship in container %s", c.Container.shortID())
+		return nil
+	}
+
+	server := NewContainerServer(agent.conf, c.Container, c.Inventory.Distro, c.Inventory.Release)
+	return agent.shipInventory(c.Container.identity(), server, c.Inventory, force)
+}
+
+// shipInventory ships what we found in an image or container as server,
+// registering it first if it's new. Identity is what we remember it by.
+func (agent *Agent) shipInventory(identity string, server *Server, inventory *imageInventory, force bool) error {
+	log := conf.FetchLog()
+
+	// images get rebuilt and containers restarted all the time without
+	// anything in them changing
+	sum := inventory.checksum()
+	if !force && agent.conf.ShippedChecksum(identity) == sum {
+		log.Debugf("Already shipped: %s", identity)
+		return nil
+	}
+
+	client := agent.newClient(server)
+
+	if server.IsNew() {
+		log.Infof("Registering %s", identity)
+		uuid, err := client.CreateServer(server)
+		if err != nil {
+			return err
+		}
+		server.setUUID(uuid)
+		agent.conf.RecordIdentity(identity, uuid)
+	}
+
+	for _, file := range inventory.Files {
+		log.Infof("Shipping %s from %s", file.Path, identity)
+		if err := client.SendFile(file.Path, file.Kind, bytes.NewReader(file.Contents)); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				// it got deleted, next time round it gets registered again
+				agent.conf.ForgetIdentity(identity)
+			}
+			return err
+		}
+	}
+
+	// keeps the server's tags (say, a container's id) up to date
+	if err := client.Heartbeat(server.uuid(), Watchers{}); err != nil {
+		log.Infof("<3 error for %s: %s", identity, err)
+	}
+
+	agent.conf.RecordShipped(identity, sum)
+	return nil
+}
+
 func (agent *Agent) SyncAllFiles() {
 	log := conf.FetchLog()
 	log.Info("Synching all files.")
 
-	for _, f := range agent.files {
-		agent.OnChange(f)
+	for _, f := range agent.watchers() {
+		agent.handleChange(f, true)
 	}
 }
 
 func (agent *Agent) Heartbeat() error {
-	return agent.client.Heartbeat(agent.server.UUID, agent.files)
+	err := agent.client.Heartbeat(agent.server.uuid(), agent.watchers())
+	if err != nil {
+		agent.spoolFailure(&spoolEntry{Type: spoolHeartbeat, Key: agent.server.uuid()})
+		return err
+	}
+
+	agent.spool.drop(spoolHeartbeat, agent.server.uuid())
+	return nil
 }
 
 func (agent *Agent) FirstRun() bool {
@@ -126,9 +625,8 @@ func (agent *Agent) RegisterServer() error {
 	if err != nil {
 		return err
 	}
-	agent.server.UUID = uuid
-	agent.conf.ServerConf.UUID = uuid
-	agent.conf.Save()
+	agent.server.setUUID(uuid)
+	agent.conf.RegisteredAs(uuid)
 	return nil
 }
 
@@ -163,7 +661,17 @@ func (agent *Agent) PerformUpgrade() {
 
 // This has to be called before exiting
 func (agent *Agent) CloseWatches() {
-	for _, file := range agent.files {
+	agent.Lock()
+	agent.polling = false
+	agent.Unlock()
+
+	agent.cancel()
+
+	for _, paths := range agent.pathWatchers() {
+		paths.Stop()
+	}
+
+	for _, file := range agent.watchers() {
 		file.Stop()
 	}
 }
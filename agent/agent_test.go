@@ -1,8 +1,11 @@
 package agent
 
 import (
+	"errors"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -21,6 +24,10 @@ func TestAgent(t *testing.T) {
 
 	config.Watchers[0].Path = conf.DEV_CONF_PATH + "/dpkg/available"
 
+	// keep what gets shipped out of the test data
+	varDir := tempVarDir(assert)
+	defer os.RemoveAll(varDir)
+
 	client := &MockClient{}
 	client.On("CreateServer").Return(serverUUID)
 	client.On("SendFile").Return(nil).Twice()
@@ -50,6 +57,10 @@ func TestAgent(t *testing.T) {
 	agent.BuildAndSyncWatchers()
 	agent.StartPolling()
 
+	// let the initial sync go out, or the forced sync
+	// below could beat it and make it redundant
+	<-time.After(200 * time.Millisecond)
+
 	// force a change in the process table
 	proc := startProcess(assert)
 	defer proc.Kill()
@@ -70,6 +81,113 @@ func TestAgent(t *testing.T) {
 	defer client.AssertExpectations(t)
 }
 
+func TestAgentSkipsShippedFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	conf.InitEnv("test")
+	config, err := conf.NewConfFromEnv()
+	assert.Nil(err)
+
+	varDir := tempVarDir(assert)
+	defer os.RemoveAll(varDir)
+
+	dpkgPath := conf.DEV_CONF_PATH + "/dpkg/available"
+	config.Watchers = []conf.WatcherConf{{Path: dpkgPath}}
+
+	// we shipped the file before we were restarted
+	contents, err := ioutil.ReadFile(dpkgPath)
+	assert.Nil(err)
+	config.RecordShipped(dpkgPath, checksum(contents))
+
+	client := &MockClient{}
+	client.On("SendFile").Return(nil)
+
+	agent := NewAgent("test", config, client)
+	agent.BuildAndSyncWatchers()
+	<-time.After(200 * time.Millisecond)
+	client.AssertNumberOfCalls(t, "SendFile", 0)
+
+	// unless we're told to sync everything
+	agent.SyncAllFiles()
+	client.AssertNumberOfCalls(t, "SendFile", 1)
+
+	// and what we shipped survives a restart
+	reloaded, err := conf.NewConfFromEnv()
+	assert.Nil(err)
+	assert.Equal(checksum(contents), reloaded.ShippedChecksum(dpkgPath))
+}
+
+func TestAgentShipsPackageDiffs(t *testing.T) {
+	assert := assert.New(t)
+
+	conf.InitEnv("test")
+	config, err := conf.NewConfFromEnv()
+	assert.Nil(err)
+
+	varDir := tempVarDir(assert)
+	defer os.RemoveAll(varDir)
+
+	statusPath := filepath.Join(varDir, "status")
+	ioutil.WriteFile(statusPath, []byte("Package: bash\nVersion: 4.3-7\n"), 0644)
+	config.Watchers = []conf.WatcherConf{}
+
+	client := &MockClient{}
+	client.On("SendFile").Return(nil)
+	client.On("SendFileDiff").Return(nil).Once()
+	client.On("SendFileDiff").Return(ErrFullUploadRequired).Once()
+	client.On("SendFileDiff").Return(&ApiError{Err: ErrServer, StatusCode: 500}).Once()
+	client.On("SendFileDiff").Return(errors.New("connection refused")).Once()
+
+	agent := NewAgent("test", config, client)
+	watcher := NewFileWatcher(statusPath, testCallbackNOP).(TextWatcher)
+
+	// the first time around there's nothing to diff against
+	agent.OnChange(watcher)
+	client.AssertNumberOfCalls(t, "SendFile", 1)
+	client.AssertNumberOfCalls(t, "SendFileDiff", 0)
+
+	// after that, only the changes go
+	ioutil.WriteFile(statusPath, []byte("Package: bash\nVersion: 4.3-8\n"), 0644)
+	agent.OnChange(watcher)
+	client.AssertNumberOfCalls(t, "SendFile", 1)
+	client.AssertNumberOfCalls(t, "SendFileDiff", 1)
+
+	// unless the server would rather have the whole thing
+	ioutil.WriteFile(statusPath, []byte("Package: bash\nVersion: 4.3-9\n"), 0644)
+	agent.OnChange(watcher)
+	client.AssertNumberOfCalls(t, "SendFile", 2)
+	client.AssertNumberOfCalls(t, "SendFileDiff", 2)
+
+	// or won't take the diff for any other reason
+	ioutil.WriteFile(statusPath, []byte("Package: bash\nVersion: 4.3-10\n"), 0644)
+	agent.OnChange(watcher)
+	client.AssertNumberOfCalls(t, "SendFile", 3)
+	client.AssertNumberOfCalls(t, "SendFileDiff", 3)
+
+	// but if it's unreachable, the file waits in the spool
+	ioutil.WriteFile(statusPath, []byte("Package: bash\nVersion: 4.3-11\n"), 0644)
+	agent.OnChange(watcher)
+	client.AssertNumberOfCalls(t, "SendFile", 3)
+	client.AssertNumberOfCalls(t, "SendFileDiff", 4)
+	assert.Equal(1, len(agent.spool.entries()))
+}
+
+// copies the var file somewhere we can scribble over, along
+// with everything else we keep next to it
+func tempVarDir(assert *assert.Assertions) string {
+	env := conf.FetchEnv()
+
+	dir, err := ioutil.TempDir("", "canaryvar")
+	assert.Nil(err)
+
+	data, err := ioutil.ReadFile(env.VarFile)
+	assert.Nil(err)
+
+	env.VarFile = filepath.Join(dir, "server.yml")
+	assert.Nil(ioutil.WriteFile(env.VarFile, data, 0644))
+	return dir
+}
+
 func startProcess(assert *assert.Assertions) *os.Process {
 	script := conf.DEV_CONF_PATH + "/pointless"
 
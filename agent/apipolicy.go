@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/appcanary/agent/conf"
+)
+
+// How long we leave the API alone after it turns us away, unless it says how
+// long itself
+const (
+	unauthorizedPause = 10 * time.Minute
+	deprecatedPause   = 24 * time.Hour
+	rateLimitedPause  = 1 * time.Minute
+)
+
+// NeedsAttention tells whether an API error is one only a human can fix: our
+// API key isn't accepted, or this version of the agent no longer is. One-shot
+// commands should give up on those; the daemon waits them out.
+func NeedsAttention(err error) bool {
+	return errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrDeprecated)
+}
+
+// Everything the agent sends goes through its policy for API errors: while
+// the API's turned us away we don't bother it (what doesn't get through waits
+// in the spool), and if the server we're registered as is gone we register
+// again.
+type policyClient struct {
+	Client
+	agent  *Agent
+	server *Server
+}
+
+func (agent *Agent) withPolicy(client Client, server *Server) Client {
+	return &policyClient{Client: client, agent: agent, server: server}
+}
+
+func (pc *policyClient) Heartbeat(uuid string, files Watchers) error {
+	if err := pc.agent.apiPaused(); err != nil {
+		return err
+	}
+	return pc.check(pc.Client.Heartbeat(uuid, files), true)
+}
+
+func (pc *policyClient) SendFile(path string, kind string, contents io.Reader) error {
+	if err := pc.agent.apiPaused(); err != nil {
+		return err
+	}
+	return pc.check(pc.Client.SendFile(path, kind, contents), true)
+}
+
+func (pc *policyClient) SendFileDiff(path string, kind string, diff PackageDiff) error {
+	if err := pc.agent.apiPaused(); err != nil {
+		return err
+	}
+	// a 404 here is about the diff, not the server (see CanaryClient)
+	return pc.check(pc.Client.SendFileDiff(path, kind, diff), false)
+}
+
+func (pc *policyClient) SendProcessState(match string, body []byte) error {
+	if err := pc.agent.apiPaused(); err != nil {
+		return err
+	}
+	return pc.check(pc.Client.SendProcessState(match, body), true)
+}
+
+func (pc *policyClient) SendProcessEvents(match string, body []byte) error {
+	if err := pc.agent.apiPaused(); err != nil {
+		return err
+	}
+	return pc.check(pc.Client.SendProcessEvents(match, body), true)
+}
+
+func (pc *policyClient) CreateServer(server *Server) (string, error) {
+	if err := pc.agent.apiPaused(); err != nil {
+		return "", err
+	}
+	// a 404 here isn't about any server of ours
+	uuid, err := pc.Client.CreateServer(server)
+	return uuid, pc.check(err, false)
+}
+
+func (pc *policyClient) FetchUpgradeablePackages() (map[string]string, error) {
+	if err := pc.agent.apiPaused(); err != nil {
+		return nil, err
+	}
+	packages, err := pc.Client.FetchUpgradeablePackages()
+	return packages, pc.check(err, true)
+}
+
+// check applies the policy to what a request returned, and passes it on.
+// Only our own server gets registered again; images and containers are left
+// to whoever ships them.
+func (pc *policyClient) check(err error, aboutServer bool) error {
+	log := conf.FetchLog()
+
+	var apiErr *ApiError
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+
+	switch {
+	case errors.Is(err, ErrUnauthorized):
+		log.Errorf("Please double check your settings, the API key isn't accepted: %s", err)
+		pc.agent.pauseApi(unauthorizedPause, err)
+	case errors.Is(err, ErrDeprecated):
+		log.Errorf("This version of the agent is no longer supported, please upgrade it: %s", err)
+		pc.agent.pauseApi(deprecatedPause, err)
+	case errors.Is(err, ErrRateLimited):
+		pause := apiErr.RetryAfter
+		if pause == 0 {
+			pause = rateLimitedPause
+		}
+		pc.agent.pauseApi(pause, err)
+	case errors.Is(err, ErrServer) && apiErr.RetryAfter > 0:
+		pc.agent.pauseApi(apiErr.RetryAfter, err)
+	case errors.Is(err, ErrNotFound) && aboutServer && pc.server == pc.agent.server:
+		go pc.agent.reregister()
+	}
+	return err
+}
+
+func (agent *Agent) pauseApi(pause time.Duration, cause error) {
+	log := conf.FetchLog()
+
+	agent.Lock()
+	defer agent.Unlock()
+
+	until := time.Now().Add(pause)
+	if until.After(agent.apiPausedUntil) {
+		log.Infof("Leaving the API alone for %s", pause)
+		agent.apiPausedUntil = until
+		agent.apiPauseCause = cause
+	}
+}
+
+// apiPaused returns why we're leaving the API alone, if we are
+func (agent *Agent) apiPaused() error {
+	agent.Lock()
+	defer agent.Unlock()
+
+	if time.Now().Before(agent.apiPausedUntil) {
+		return fmt.Errorf("leaving the API alone until %s: %w",
+			agent.apiPausedUntil.Format(time.RFC3339), agent.apiPauseCause)
+	}
+	return nil
+}
+
+// WaitForApi blocks until the API's willing to hear from us again
+func (agent *Agent) WaitForApi() {
+	agent.Lock()
+	wait := time.Until(agent.apiPausedUntil)
+	agent.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// The server we're registered as was deleted, so we register again and send
+// everything we watch to the new one.
+func (agent *Agent) reregister() {
+	log := conf.FetchLog()
+
+	agent.Lock()
+	if agent.reregistering {
+		agent.Unlock()
+		return
+	}
+	agent.reregistering = true
+	agent.Unlock()
+
+	defer func() {
+		agent.Lock()
+		agent.reregistering = false
+		agent.Unlock()
+	}()
+
+	log.Infof("The API doesn't know server %s anymore, registering again", agent.server.uuid())
+	if err := agent.RegisterServer(); err != nil {
+		log.Infof("Register server error: %s", err)
+		return
+	}
+	agent.SyncAllFiles()
+}
@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/appcanary/agent/conf"
+	"github.com/appcanary/testify/assert"
+)
+
+func TestApiPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	conf.InitEnv("test")
+	config, err := conf.NewConfFromEnv()
+	assert.Nil(err)
+
+	varDir := tempVarDir(assert)
+	defer os.RemoveAll(varDir)
+	config.Watchers = []conf.WatcherConf{}
+
+	client := &MockClient{}
+	client.On("Heartbeat").Return(&ApiError{Err: ErrUnauthorized, StatusCode: 401}).Once()
+	client.On("Heartbeat").Return(&ApiError{Err: ErrNotFound, StatusCode: 404}).Once()
+	client.On("Heartbeat").Return(nil)
+	client.On("CreateServer").Return("reregistered-uuid")
+
+	agent := NewAgent("test", config, client)
+
+	// a key that isn't accepted is something for a human to sort out
+	err = agent.Heartbeat()
+	assert.True(errors.Is(err, ErrUnauthorized))
+	assert.True(NeedsAttention(err))
+
+	// and until then we leave the API alone
+	err = agent.Heartbeat()
+	assert.True(errors.Is(err, ErrUnauthorized))
+	client.AssertNumberOfCalls(t, "Heartbeat", 1)
+
+	agent.Lock()
+	agent.apiPausedUntil = time.Time{}
+	agent.Unlock()
+
+	// a diff that's not found is no reason to think the server's gone
+	client.On("SendFileDiff").Return(&ApiError{Err: ErrNotFound, StatusCode: 404})
+	err = agent.client.SendFileDiff("/var/lib/dpkg/status", "ubuntu", PackageDiff{})
+	assert.True(errors.Is(err, ErrNotFound))
+	time.Sleep(50 * time.Millisecond)
+	client.AssertNumberOfCalls(t, "CreateServer", 0)
+
+	// if the server's been deleted, we register again
+	err = agent.Heartbeat()
+	assert.True(errors.Is(err, ErrNotFound))
+	assert.False(NeedsAttention(err))
+
+	for i := 0; i < 100 && config.ServerUUID() != "reregistered-uuid"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal("reregistered-uuid", config.ServerUUID())
+	assert.Nil(agent.Heartbeat())
+
+	// rate limiting lasts as long as the API says
+	client = &MockClient{}
+	client.On("SendProcessEvents").Return(&ApiError{Err: ErrRateLimited, StatusCode: 429, RetryAfter: time.Hour})
+	agent = NewAgent("test", config, client)
+
+	assert.True(errors.Is(agent.client.SendProcessEvents("*", []byte("{}")), ErrRateLimited))
+	agent.Lock()
+	until := agent.apiPausedUntil
+	agent.Unlock()
+	assert.True(until.After(time.Now().Add(59 * time.Minute)))
+}
@@ -2,13 +2,15 @@ package agent
 
 import (
 	"bytes"
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	_ "crypto/sha512"
@@ -19,25 +21,134 @@ import (
 )
 
 var (
-	ErrApi        = errors.New("api error")
-	ErrDeprecated = errors.New("api deprecated")
+	ErrApi                = errors.New("api error")
+	ErrDeprecated         = errors.New("api deprecated")
+	ErrFullUploadRequired = errors.New("api wants the whole file")
+	ErrUnauthorized       = errors.New("api key not accepted")
+	ErrNotFound           = errors.New("api doesn't know the server")
+	ErrRateLimited        = errors.New("api rate limited")
+	ErrServer             = errors.New("api server error")
 )
 
+// ApiError is what we get when the API responds with an error. Which one it is
+// (ErrUnauthorized, ErrNotFound and so on) is up to errors.Is; what to do
+// about it is up to the agent.
+type ApiError struct {
+	Err        error
+	StatusCode int
+	Uri        string
+	RetryAfter time.Duration // how long it wants us to wait, if it says
+}
+
+func (e *ApiError) Error() string {
+	return fmt.Sprintf("API Error: %d %s (%s)", e.StatusCode, e.Uri, e.Err)
+}
+
+func (e *ApiError) Unwrap() error {
+	return e.Err
+}
+
+func newApiError(res *http.Response, uri string) *ApiError {
+	apiErr := &ApiError{Err: ErrApi, StatusCode: res.StatusCode, Uri: uri}
+
+	switch {
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		apiErr.Err = ErrUnauthorized
+	case res.StatusCode == http.StatusNotFound:
+		apiErr.Err = ErrNotFound
+	case res.StatusCode == http.StatusGone || res.StatusCode == http.StatusUpgradeRequired:
+		// the API no longer speaks to agents this old
+		apiErr.Err = ErrDeprecated
+	case res.StatusCode == http.StatusTooManyRequests:
+		apiErr.Err = ErrRateLimited
+	case res.StatusCode >= 500:
+		apiErr.Err = ErrServer
+	}
+
+	if apiErr.Err == ErrRateLimited || res.StatusCode == http.StatusServiceUnavailable {
+		apiErr.RetryAfter = parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+	}
+	return apiErr
+}
+
+// Retry-After is either a number of seconds or a date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
 type Client interface {
 	Heartbeat(string, Watchers) error
-	SendFile(string, string, []byte) error
+	SendFile(string, string, io.Reader) error
+	SendFileDiff(string, string, PackageDiff) error
 	SendProcessState(string, []byte) error
+	SendProcessEvents(string, []byte) error
 	CreateServer(*Server) (string, error)
 	FetchUpgradeablePackages() (map[string]string, error)
 }
 
 type CanaryClient struct {
-	apiKey string
-	server *Server
+	sync.Mutex
+	apiKey   string
+	server   *Server
+	settings ClientSettings
+	uploads  uploadEncoding // see upload.go
 }
 
-func NewClient(apiKey string, server *Server) *CanaryClient {
+// ClientSettings are how a client reaches the API (see NewHTTPClient), how
+// hard it tries (see RetryPolicy), what cancels whatever it's got in flight,
+// and how it sends files to begin with (see upload.go).
+type ClientSettings struct {
+	HTTP         *http.Client
+	Retry        RetryPolicy
+	Context      context.Context
+	UploadFormat string
+}
+
+func NewClientSettings(ctx context.Context, config *conf.Conf) (ClientSettings, error) {
+	httpClient, err := NewHTTPClient(config)
+	if err != nil {
+		return ClientSettings{}, err
+	}
+	settings := ClientSettings{HTTP: httpClient, Retry: NewRetryPolicy(config), Context: ctx, UploadFormat: UploadJson}
+	switch config.UploadFormat {
+	case "", UploadJson:
+	case UploadRaw:
+		settings.UploadFormat = UploadRaw
+	default:
+		return ClientSettings{}, fmt.Errorf("upload_format has to be %q or %q", UploadJson, UploadRaw)
+	}
+	return settings, nil
+}
+
+// Without settings, requests go out as http.DefaultTransport would send them,
+// retried as per the defaults.
+func NewClient(apiKey string, server *Server, settings ...ClientSettings) *CanaryClient {
 	client := &CanaryClient{apiKey: apiKey, server: server}
+	if len(settings) > 0 {
+		client.settings = settings[0]
+	} else {
+		client.settings = ClientSettings{
+			HTTP:    &http.Client{Timeout: conf.DEFAULT_REQUEST_TIMEOUT},
+			Retry:   NewRetryPolicy(conf.NewConf()),
+			Context: context.Background(),
+		}
+	}
+
+	// uploads only get compressed once the API says it takes that (see
+	// negotiate), as one that doesn't may not tell us so with a 415
+	client.uploads = uploadEncoding{format: client.settings.UploadFormat}
+	if client.uploads.format == "" {
+		client.uploads.format = UploadJson
+	}
 	return client
 }
 
@@ -79,40 +190,61 @@ func (client *CanaryClient) Heartbeat(uuid string, files Watchers) error {
 	return nil
 }
 
-func (client *CanaryClient) SendFile(path string, kind string, contents []byte) error {
-	// Compute checksum of the file (not base64 encoding)
-	crc := crc32.ChecksumIEEE(contents)
-	// File needs to be sent base64 encoded
-	b64buffer := new(bytes.Buffer)
-	b64enc := base64.NewEncoder(base64.StdEncoding, b64buffer)
-	b64enc.Write(contents)
-	b64enc.Close()
-
-	file_json, err := json.Marshal(map[string]interface{}{
-		"name":     "",
-		"path":     path,
-		"kind":     kind,
-		"contents": string(b64buffer.Bytes()),
-		"crc":      crc,
+// Files get streamed from contents as they're read (and compressed, see
+// uploadFile), as package databases can be many megabytes.
+func (client *CanaryClient) SendFile(path string, kind string, contents io.Reader) error {
+	return client.uploadFile(conf.ApiServerPath(client.server.uuid()), path, kind, contents)
+}
+
+// Ships only what changed in a package database. If the server doesn't have
+// the contents the diff is based on, it responds with a 409 and we get
+// ErrFullUploadRequired, same as when it doesn't take diffs at all (a 404, a
+// 415 and the like).
+func (client *CanaryClient) SendFileDiff(path string, kind string, diff PackageDiff) error {
+	diff_json, err := json.Marshal(map[string]interface{}{
+		"path": path,
+		"kind": kind,
+		"diff": diff,
 	})
 
 	if err != nil {
 		return err
 	}
 
-	_, err = client.put(conf.ApiServerPath(client.server.UUID), file_json)
+	_, err = client.put(conf.ApiServerDiffPath(client.server.uuid()), diff_json)
 
+	// an API that won't take diffs (or this one) still takes the whole file
+	var apiErr *ApiError
+	if errors.As(err, &apiErr) && rejectsDiff(apiErr.StatusCode) {
+		return ErrFullUploadRequired
+	}
 	return err
 }
 
+// Any client error that isn't about who we are or how often we call
+func rejectsDiff(status int) bool {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests, http.StatusUpgradeRequired:
+		return false
+	}
+	return status >= 400 && status < 500
+}
+
 func (client *CanaryClient) SendProcessState(match string, body []byte) error {
 	// match is unused for now - should it get shipped?
-	_, err := client.put(conf.ApiServerProcsPath(client.server.UUID), body)
+	_, err := client.put(conf.ApiServerProcsPath(client.server.uuid()), body)
+	return err
+}
+
+func (client *CanaryClient) SendProcessEvents(match string, body []byte) error {
+	_, err := client.post(conf.ApiServerProcEventsPath(client.server.uuid()), body)
 	return err
 }
 
 func (c *CanaryClient) CreateServer(srv *Server) (string, error) {
+	serverLock.Lock()
 	body, err := json.Marshal(*srv)
+	serverLock.Unlock()
 
 	if err != nil {
 		return "", err
@@ -132,7 +264,7 @@ func (c *CanaryClient) CreateServer(srv *Server) (string, error) {
 }
 
 func (client *CanaryClient) FetchUpgradeablePackages() (map[string]string, error) {
-	respBody, err := client.get(conf.ApiServerPath(client.server.UUID))
+	respBody, err := client.get(conf.ApiServerPath(client.server.uuid()))
 
 	if err != nil {
 		return nil, err
@@ -161,33 +293,70 @@ func (client *CanaryClient) get(rPath string) ([]byte, error) {
 }
 
 func (c *CanaryClient) send(method string, uri string, body []byte) ([]byte, error) {
+	return c.sendBody(method, uri, func() (io.Reader, error) { return bytes.NewReader(body), nil }, "application/json", "")
+}
+
+// sendBody sends whatever body returns, which it gets called for anew every
+// time we try, as it'd be consumed by the attempt before. The encoding, if
+// any, goes out as Content-Encoding.
+func (c *CanaryClient) sendBody(method string, uri string, body func() (io.Reader, error), contentType string, encoding string) ([]byte, error) {
 	log := conf.FetchLog()
 
-	client := &http.Client{}
-	req, err := http.NewRequest(method, uri, bytes.NewBuffer(body))
-	if err != nil {
-		return nil, err
-	}
+	client := c.settings.HTTP
+	ctx := c.settings.Context
+	policy := c.settings.Retry
+	retry := policy.backOff()
 
-	// Ahem, http://stackoverflow.com/questions/17714494/golang-http-request-results-in-eof-errors-when-making-multiple-requests-successi
-	req.Close = true
+	var res *http.Response
 
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Authorization", "Token "+c.apiKey)
+	// if the request fails for whatever reason, keep trying to reach the
+	// server for as long as the policy says
+	err := backoff.Retry(func() error {
+		reader, err := body()
+		if err != nil {
+			return backoff.Permanent(err)
+		}
+		req, err := http.NewRequest(method, uri, reader)
+		if err != nil {
+			// nobody's going to read it, so whatever's writing it has to
+			// find out some other way
+			if pipe, ok := reader.(interface{ CloseWithError(error) error }); ok {
+				pipe.CloseWithError(err)
+			}
+			return backoff.Permanent(err)
+		}
+		req = req.WithContext(ctx)
 
-	var res *http.Response
+		// Ahem, http://stackoverflow.com/questions/17714494/golang-http-request-results-in-eof-errors-when-making-multiple-requests-successi
+		req.Close = true
+
+		req.Header.Add("Content-Type", contentType)
+		req.Header.Add("Authorization", "Token "+c.apiKey)
+		if encoding != "" {
+			req.Header.Add("Content-Encoding", encoding)
+		}
 
-	// if the request fails for whatever reason, keep
-	// trying to reach the server
-	err = backoff.Retry(func() error {
 		log.Debugf("Request: %s %s", method, uri)
 		res, err = client.Do(req)
 		if err != nil {
 			log.Errorf("Error in request %s", err)
+			if ctx.Err() != nil {
+				return backoff.Permanent(ctx.Err())
+			}
+			return err
+		}
+		c.negotiate(res)
+
+		if policy.Statuses[res.StatusCode] {
+			apiErr := newApiError(res, uri)
+			res.Body.Close()
+			log.Infof("Retrying request: %s", apiErr)
+			retry.retryAfter = apiErr.RetryAfter
+			return apiErr
 		}
 
-		return err
-	}, backoff.NewExponentialBackOff())
+		return nil
+	}, backoff.WithContext(retry, ctx))
 
 	if err != nil {
 		log.Debug("Do err: ", err.Error())
@@ -197,12 +366,7 @@ func (c *CanaryClient) send(method string, uri string, body []byte) ([]byte, err
 	defer res.Body.Close()
 
 	if res.StatusCode < 200 || res.StatusCode > 299 {
-		errorstr := fmt.Sprintf("API Error: %d %s", res.StatusCode, uri)
-		if res.StatusCode == 401 {
-			log.Fatal("Please double check your settings: " + errorstr)
-		} else {
-			return nil, errors.New(errorstr)
-		}
+		return nil, newApiError(res, uri)
 	}
 
 	respBody, err := ioutil.ReadAll(res.Body)
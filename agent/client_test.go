@@ -1,11 +1,20 @@
 package agent
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os/exec"
+	"strings"
 	"testing"
 	"time"
 
@@ -197,12 +206,219 @@ func (t *ClientTestSuite) TestSendFile() {
 	env.BaseUrl = ts.URL
 
 	contents, _ := t.files[0].(TextWatcher).Contents()
-	t.client.SendFile(testFilePath, "gemfile", contents)
+	t.client.SendFile(testFilePath, "gemfile", bytes.NewReader(contents))
 
 	ts.Close()
 	t.True(serverInvoked)
 }
 
+func (t *ClientTestSuite) TestSendFileCompressed() {
+	env := conf.FetchEnv()
+	contents, _ := t.files[0].(TextWatcher).Contents()
+
+	encodings := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := r.Header.Get("Content-Encoding")
+		encodings = append(encodings, encoding)
+
+		body := requestBody(r)
+		var file struct {
+			Path     string
+			Contents string
+			Crc      uint32
+		}
+		t.Nil(json.Unmarshal(body, &file))
+		t.Equal("/var/lib/dpkg/available", file.Path)
+		decoded, _ := base64.StdEncoding.DecodeString(file.Contents)
+		t.Equal(contents, decoded)
+		t.Equal(crc32.ChecksumIEEE(contents), file.Crc)
+
+		// this one takes compressed uploads, and says so
+		w.Header().Set("Accept-Encoding", "gzip")
+		tsrespond(w, 200, "OK")
+	}))
+	defer ts.Close()
+	env.BaseUrl = ts.URL
+
+	client := NewClient(t.apiKey, &Server{UUID: t.serverUUID})
+	t.Nil(client.SendFile("/var/lib/dpkg/available", "ubuntu", bytes.NewReader(contents)))
+	t.Nil(client.SendFile("/var/lib/dpkg/available", "ubuntu", bytes.NewReader(contents)))
+
+	// so after the first upload we started compressing
+	t.Equal([]string{"", "gzip"}, encodings)
+
+	// one that doesn't say never gets anything compressed, since it may
+	// not know what to make of it
+	encodings = []string{}
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := r.Header.Get("Content-Encoding")
+		encodings = append(encodings, encoding)
+		requestBody(r)
+
+		if encoding != "" {
+			tsrespond(w, http.StatusBadRequest, "")
+			return
+		}
+		tsrespond(w, 200, "OK")
+	})
+	client = NewClient(t.apiKey, &Server{UUID: t.serverUUID})
+	t.Nil(client.SendFile("/var/lib/dpkg/available", "ubuntu", bytes.NewReader(contents)))
+	t.Nil(client.SendFile("/var/lib/dpkg/available", "ubuntu", bytes.NewReader(contents)))
+	t.Equal([]string{"", ""}, encodings)
+}
+
+func (t *ClientTestSuite) TestSendFileNegotiated() {
+	env := conf.FetchEnv()
+	contents, _ := t.files[0].(TextWatcher).Contents()
+
+	// this one takes raw uploads, but says it only takes them uncompressed
+	requests := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := r.Header.Get("Content-Encoding")
+		requests = append(requests, strings.SplitN(r.Header.Get("Content-Type"), ";", 2)[0]+" "+encoding)
+		w.Header().Set("Accept-Encoding", "identity")
+
+		if encoding != "" {
+			tsrespond(w, http.StatusUnsupportedMediaType, "")
+			return
+		}
+
+		t.Nil(r.ParseMultipartForm(1 << 20))
+		t.Equal("/var/lib/dpkg/available", r.FormValue("path"))
+		t.Equal("ubuntu", r.FormValue("kind"))
+		t.Equal(fmt.Sprint(crc32.ChecksumIEEE(contents)), r.FormValue("crc"))
+
+		file, _, err := r.FormFile("contents")
+		t.Nil(err)
+		sent, _ := ioutil.ReadAll(file)
+		t.Equal(contents, sent)
+		tsrespond(w, 200, "OK")
+	}))
+	defer ts.Close()
+	env.BaseUrl = ts.URL
+
+	settings := testClientSettings(context.Background(), time.Second, time.Second)
+	settings.UploadFormat = UploadRaw
+	client := NewClient(t.apiKey, &Server{UUID: t.serverUUID}, settings)
+	t.Nil(client.SendFile("/var/lib/dpkg/available", "ubuntu", bytes.NewReader(contents)))
+	t.Nil(client.SendFile("/var/lib/dpkg/available", "ubuntu", bytes.NewReader(contents)))
+	t.Equal([]string{"multipart/form-data ", "multipart/form-data "}, requests)
+
+	// and this one takes JSON only, compressed or not
+	requests = []string{}
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType := r.Header.Get("Content-Type")
+		requests = append(requests, strings.SplitN(contentType, ";", 2)[0]+" "+r.Header.Get("Content-Encoding"))
+		requestBody(r)
+
+		if contentType != "application/json" {
+			tsrespond(w, http.StatusUnsupportedMediaType, "")
+			return
+		}
+		tsrespond(w, 200, "OK")
+	})
+	client = NewClient(t.apiKey, &Server{UUID: t.serverUUID}, settings)
+	t.Nil(client.SendFile("/var/lib/dpkg/available", "ubuntu", bytes.NewReader(contents)))
+	t.Equal([]string{"multipart/form-data ", "application/json "}, requests)
+
+	// what can't be read again can't be sent again
+	err := client.SendFile("/var/lib/dpkg/available", "ubuntu", ioutil.NopCloser(bytes.NewReader(contents)))
+	t.Nil(err)
+	client.Lock()
+	client.uploads.format = UploadRaw
+	client.Unlock()
+	err = client.SendFile("/var/lib/dpkg/available", "ubuntu", ioutil.NopCloser(bytes.NewReader(contents)))
+	t.Equal(errNotRewindable, err)
+}
+
+func (t *ClientTestSuite) TestStreamBodyNotSent() {
+	// a request that can't even be made doesn't leave the body's writer
+	// hanging
+	body := streamBody(func(w io.Writer) error {
+		_, err := w.Write(make([]byte, 1<<20))
+		return err
+	}, "")
+
+	client := NewClient(t.apiKey, &Server{UUID: t.serverUUID})
+	_, err := client.sendBody("NOT A METHOD", "http://localhost/", func() (io.Reader, error) {
+		return body, nil
+	}, "application/json", "")
+	t.NotNil(err)
+
+	select {
+	case <-body.done:
+	case <-time.After(5 * time.Second):
+		t.Fail("the body's writer is still waiting to be read")
+	}
+}
+
+func (t *ClientTestSuite) TestSendFileDiff() {
+	env := conf.FetchEnv()
+
+	serverInvoked := false
+	ts := testServer(t, "PUT", "OK", func(r *http.Request, rBody TestJsonRequest) {
+		serverInvoked = true
+
+		t.Equal("/api/v1/agent/servers/"+t.serverUUID+"/diff", r.URL.Path)
+		t.Equal("/var/lib/dpkg/status", rBody["path"])
+		t.Equal("ubuntu", rBody["kind"])
+
+		diff := rBody["diff"].(map[string]interface{})
+		t.Equal("abc", diff["base"])
+		added := diff["added"].([]interface{})
+		t.Equal("bash", added[0].(map[string]interface{})["name"])
+	})
+
+	env.BaseUrl = ts.URL
+	err := t.client.SendFileDiff("/var/lib/dpkg/status", "ubuntu", PackageDiff{
+		Base:  "abc",
+		Added: []packageEntry{{Name: "bash", Version: "4.3-7"}},
+	})
+	ts.Close()
+	t.Nil(err)
+	t.True(serverInvoked)
+
+	// the server lost track of our baseline
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tsrespond(w, http.StatusConflict, "")
+	}))
+	env.BaseUrl = ts.URL
+	err = t.client.SendFileDiff("/var/lib/dpkg/status", "ubuntu", PackageDiff{})
+	ts.Close()
+	t.Equal(ErrFullUploadRequired, err)
+
+	// which is something only diffs get told
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tsrespond(w, http.StatusConflict, "")
+	}))
+	env.BaseUrl = ts.URL
+	err = t.client.SendProcessState("*", []byte("{}"))
+	ts.Close()
+	var apiErr *ApiError
+	t.True(errors.As(err, &apiErr))
+	t.Equal(http.StatusConflict, apiErr.StatusCode)
+
+	// or never heard of diffs, which needn't mean it forgot about us
+	for _, status := range []int{http.StatusNotFound, http.StatusUnsupportedMediaType, http.StatusBadRequest} {
+		ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tsrespond(w, status, "")
+		}))
+		env.BaseUrl = ts.URL
+		err = t.client.SendFileDiff("/var/lib/dpkg/status", "ubuntu", PackageDiff{})
+		ts.Close()
+		t.Equal(ErrFullUploadRequired, err)
+	}
+
+	// but who we are still matters
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tsrespond(w, http.StatusUnauthorized, "")
+	}))
+	env.BaseUrl = ts.URL
+	err = t.client.SendFileDiff("/var/lib/dpkg/status", "ubuntu", PackageDiff{})
+	ts.Close()
+	t.True(errors.Is(err, ErrUnauthorized))
+}
+
 func (t *ClientTestSuite) TestCreateServer() {
 	env := conf.FetchEnv()
 
@@ -259,6 +475,41 @@ func (t *ClientTestSuite) TestFetchUpgradeablePackages() {
 	t.True(serverInvoked)
 }
 
+func (t *ClientTestSuite) TestApiErrors() {
+	env := conf.FetchEnv()
+
+	for status, expected := range map[int]error{
+		http.StatusUnauthorized:        ErrUnauthorized,
+		http.StatusForbidden:           ErrUnauthorized,
+		http.StatusNotFound:            ErrNotFound,
+		http.StatusGone:                ErrDeprecated,
+		http.StatusTooManyRequests:     ErrRateLimited,
+		http.StatusInternalServerError: ErrServer,
+		http.StatusTeapot:              ErrApi,
+	} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "120")
+			tsrespond(w, status, "")
+		}))
+		env.BaseUrl = ts.URL
+		err := t.client.Heartbeat(t.serverUUID, t.files)
+		ts.Close()
+
+		t.True(errors.Is(err, expected), err.Error())
+		apiErr, ok := err.(*ApiError)
+		t.True(ok)
+		t.Equal(status, apiErr.StatusCode)
+		if status == http.StatusTooManyRequests {
+			t.Equal(2*time.Minute, apiErr.RetryAfter)
+		}
+	}
+
+	now := time.Now()
+	t.Equal(time.Duration(0), parseRetryAfter("", now))
+	t.Equal(time.Duration(0), parseRetryAfter("soon", now))
+	t.Equal(time.Minute, parseRetryAfter(now.Add(time.Minute).UTC().Format(http.TimeFormat), now.Truncate(time.Second)))
+}
+
 func testCallbackNOP(foo Watcher) {
 	// NOP
 }
@@ -275,8 +526,7 @@ func testServer(assert *ClientTestSuite, method string, respondWithBody string,
 		assert.Equal(method, r.Method, "method")
 		assert.Equal("application/json", r.Header.Get("Content-Type"), "content type")
 
-		body, _ := ioutil.ReadAll(r.Body)
-		r.Body.Close()
+		body := requestBody(r)
 
 		var datBody TestJsonRequest
 		if err := json.Unmarshal(body, &datBody); err != nil {
@@ -290,6 +540,22 @@ func testServer(assert *ClientTestSuite, method string, respondWithBody string,
 	return ts
 }
 
+// what was sent, uncompressed if need be
+func requestBody(r *http.Request) []byte {
+	var reader io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			panic(err)
+		}
+		reader = gz
+	}
+
+	body, _ := ioutil.ReadAll(reader)
+	r.Body.Close()
+	return body
+}
+
 func testServerSansInput(assert *ClientTestSuite, method string, respondWithBody string, callback func(*http.Request, TestJsonRequest)) *httptest.Server {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		assert.Equal(method, r.Method, "method")
@@ -0,0 +1,227 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/appcanary/agent/conf"
+)
+
+// A command that command watchers run, and how to run it
+type command struct {
+	Name    string
+	Args    []string
+	Env     []string
+	Dir     string
+	User    string
+	Timeout time.Duration
+}
+
+// newCommand builds the command described by a watcher's settings. The command
+// line is split like a shell would (quotes and backslashes, but no expansion),
+// unless an explicit list of args is given, in which case it's the program to
+// run as is.
+func newCommand(line string, setting conf.WatcherConf) (*command, error) {
+	var argv []string
+	if len(setting.Args) > 0 {
+		argv = append([]string{line}, setting.Args...)
+	} else {
+		var err error
+		argv, err = splitCommandLine(line)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(argv) == 0 || argv[0] == "" {
+		return nil, errors.New("no command given")
+	}
+
+	timeout := conf.DEFAULT_COMMAND_TIMEOUT
+	if setting.Timeout > 0 {
+		timeout = time.Duration(setting.Timeout) * time.Second
+	}
+
+	keys := make([]string, 0, len(setting.Env))
+	for key := range setting.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	env := make([]string, 0, len(keys))
+	for _, key := range keys {
+		env = append(env, key+"="+setting.Env[key])
+	}
+
+	return &command{
+		Name:    argv[0],
+		Args:    argv[1:],
+		Env:     env,
+		Dir:     setting.Dir,
+		User:    setting.RunAs,
+		Timeout: timeout,
+	}, nil
+}
+
+func (c *command) String() string {
+	return strings.Join(append([]string{c.Name}, c.Args...), " ")
+}
+
+// Output runs the command and returns what it printed on stdout. Anything other
+// than a clean exit within the timeout is an error.
+func (c *command) Output() ([]byte, error) {
+	cmd := exec.Command(c.Name, c.Args...)
+	cmd.Dir = c.Dir
+
+	// the command gets its own process group so a timeout can take down
+	// whatever it spawned along with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	env := os.Environ()
+	if c.User != "" {
+		credential, userEnv, err := lookupCredential(c.User)
+		if err != nil {
+			return nil, err
+		}
+		cmd.SysProcAttr.Credential = credential
+		env = append(env, userEnv...)
+	}
+	// later entries win
+	cmd.Env = append(env, c.Env...)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			if msg := firstLine(stderr.String()); msg != "" {
+				return nil, fmt.Errorf("%s: %w: %s", c, err, msg)
+			}
+			return nil, fmt.Errorf("%s: %w", c, err)
+		}
+		return stdout.Bytes(), nil
+
+	case <-time.After(c.Timeout):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return nil, fmt.Errorf("%s: timed out after %s", c, c.Timeout)
+	}
+}
+
+// The credential for running as name, along with the environment that goes
+// with being that user.
+func lookupCredential(name string) (*syscall.Credential, []string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+
+	if groupIds, err := u.GroupIds(); err == nil {
+		for _, id := range groupIds {
+			if group, err := strconv.ParseUint(id, 10, 32); err == nil {
+				credential.Groups = append(credential.Groups, uint32(group))
+			}
+		}
+	}
+
+	env := []string{"HOME=" + u.HomeDir, "USER=" + u.Username, "LOGNAME=" + u.Username}
+	return credential, env, nil
+}
+
+func firstLine(s string) string {
+	return strings.TrimSpace(strings.SplitN(strings.TrimSpace(s), "\n", 2)[0])
+}
+
+// splitCommandLine breaks up a command line the way sh would, minus any kind of
+// expansion: words are separated by whitespace, single quotes preserve
+// everything, double quotes preserve everything but backslash escapes.
+func splitCommandLine(line string) ([]string, error) {
+	var argv []string
+	var word bytes.Buffer
+	inWord := false
+
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			if inWord {
+				argv = append(argv, word.String())
+				word.Reset()
+				inWord = false
+			}
+
+		case ch == '\\':
+			if i+1 == len(line) {
+				return nil, errors.New("command ends with a backslash")
+			}
+			i++
+			word.WriteByte(line[i])
+			inWord = true
+
+		case ch == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote in command")
+			}
+			word.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+
+		case ch == '"':
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) && strings.IndexByte("\"\\$`", line[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(line[i])
+			}
+			if i == len(line) {
+				return nil, errors.New("unterminated double quote in command")
+			}
+			inWord = true
+
+		default:
+			word.WriteByte(ch)
+			inWord = true
+		}
+	}
+
+	if inWord {
+		argv = append(argv, word.String())
+	}
+
+	return argv, nil
+}
@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"os"
+	"os/user"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/appcanary/agent/conf"
+	"github.com/appcanary/testify/assert"
+)
+
+func TestSplitCommandLine(t *testing.T) {
+	assert := assert.New(t)
+
+	argv, err := splitCommandLine(`rpm  -qa --queryformat '%{NAME} %{VERSION}\n'`)
+	assert.Nil(err)
+	assert.Equal([]string{"rpm", "-qa", "--queryformat", `%{NAME} %{VERSION}\n`}, argv)
+
+	argv, err = splitCommandLine(`echo "a \"quoted\" word" back\ slash ''`)
+	assert.Nil(err)
+	assert.Equal([]string{"echo", `a "quoted" word`, "back slash", ""}, argv)
+
+	_, err = splitCommandLine(`echo 'oops`)
+	assert.NotNil(err)
+
+	_, err = splitCommandLine(`echo "oops`)
+	assert.NotNil(err)
+}
+
+func TestNewCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	cmd, err := newCommand("dpkg-query", conf.WatcherConf{
+		Args:    []string{"-W", "-f", "${Package} ${Version}\n"},
+		Timeout: 30,
+		Env:     map[string]string{"LANG": "C", "A": "b"},
+	})
+	assert.Nil(err)
+	assert.Equal("dpkg-query", cmd.Name)
+	assert.Equal([]string{"-W", "-f", "${Package} ${Version}\n"}, cmd.Args)
+	assert.Equal(30*time.Second, cmd.Timeout)
+	assert.Equal([]string{"A=b", "LANG=C"}, cmd.Env)
+
+	cmd, err = newCommand("rpm -qa", conf.WatcherConf{})
+	assert.Nil(err)
+	assert.Equal(conf.DEFAULT_COMMAND_TIMEOUT, cmd.Timeout)
+
+	_, err = newCommand("  ", conf.WatcherConf{})
+	assert.NotNil(err)
+}
+
+func TestCommandOutput(t *testing.T) {
+	assert := assert.New(t)
+
+	cmd, _ := newCommand(`sh -c 'echo $GREETING; pwd'`, conf.WatcherConf{
+		Env: map[string]string{"GREETING": "hi"},
+		Dir: "/",
+	})
+	out, err := cmd.Output()
+	assert.Nil(err)
+	assert.Equal("hi\n/\n", string(out))
+
+	cmd, _ = newCommand(`sh -c 'echo broken >&2; exit 3'`, conf.WatcherConf{})
+	_, err = cmd.Output()
+	assert.NotNil(err)
+	assert.True(strings.Contains(err.Error(), "broken"))
+
+	// a hanging command, along with the children it spawned, gets killed
+	cmd, _ = newCommand(`sh -c 'sleep 10 | cat'`, conf.WatcherConf{})
+	cmd.Timeout = 100 * time.Millisecond
+	started := time.Now()
+	_, err = cmd.Output()
+	assert.NotNil(err)
+	assert.True(strings.Contains(err.Error(), "timed out"))
+	assert.True(time.Since(started) < 5*time.Second)
+}
+
+func TestCommandOutputAsUser(t *testing.T) {
+	assert := assert.New(t)
+
+	nobody, err := user.Lookup("nobody")
+	if os.Geteuid() != 0 || err != nil {
+		t.Skip("need to be root, and have a nobody user")
+	}
+
+	cmd, _ := newCommand("id -u", conf.WatcherConf{RunAs: "nobody"})
+	out, err := cmd.Output()
+	assert.Nil(err)
+	assert.Equal(nobody.Uid, strings.TrimSpace(string(out)))
+}
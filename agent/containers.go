@@ -0,0 +1,260 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/appcanary/agent/conf"
+)
+
+// where we look for what docker knows about its containers
+var dockerRoot = "/var/lib/docker"
+
+// docker, containerd, cri-o and podman all name the cgroups of a container
+// after its 64 character id, e.g. /docker/<id> or cri-containerd-<id>.scope
+var containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// A running container, as seen from the host
+type container struct {
+	ID    string
+	Name  string
+	Image string
+	Pid   int // of its init process
+}
+
+// How the container gets registered: by name if it has one, since those
+// survive the container being recreated
+func (c container) identity() string {
+	if c.Name != "" {
+		return "container:" + c.Name
+	}
+	return "container:" + c.ID
+}
+
+func (c container) shortID() string {
+	if len(c.ID) > 12 {
+		return c.ID[:12]
+	}
+	return c.ID
+}
+
+// The container's filesystem, through its init process. Absolute symlinks in
+// there resolve against the host's root, not the container's, so whatever's
+// read from it has to be resolved with openInRoot.
+func (c container) root() string {
+	return filepath.Join(procRoot, strconv.Itoa(c.Pid), "root")
+}
+
+// matches tells whether pattern (as in filepath.Match) matches the container's
+// name, image or id, or is a prefix of its id
+func (c container) matches(pattern string) bool {
+	if pattern == "" || pattern == "*" || strings.HasPrefix(c.ID, pattern) {
+		return true
+	}
+
+	for _, s := range []string{c.Name, c.Image, c.ID} {
+		if ok, _ := filepath.Match(pattern, s); ok && s != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// runningContainers finds the containers running on this host by the cgroups
+// their processes are in. A container's init process is the one whose parent
+// is outside of it.
+func runningContainers() ([]container, error) {
+	entries, err := ioutil.ReadDir(procRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	type proc struct {
+		pid, ppid int
+		id        string
+	}
+
+	procs := map[int]proc{}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		// processes come and go while we look, skip any that went
+		cgroup, err := readCgroup(pid)
+		if err != nil {
+			continue
+		}
+		id := containerID(cgroup)
+		if id == "" {
+			continue
+		}
+
+		ppid, err := parentPid(pid)
+		if err != nil {
+			continue
+		}
+		procs[pid] = proc{pid: pid, ppid: ppid, id: id}
+	}
+
+	inits := map[string]int{}
+	for _, p := range procs {
+		if parent, ok := procs[p.ppid]; ok && parent.id == p.id {
+			continue
+		}
+		if pid, ok := inits[p.id]; !ok || p.pid < pid {
+			inits[p.id] = p.pid
+		}
+	}
+
+	containers := make([]container, 0, len(inits))
+	for id, pid := range inits {
+		c := container{ID: id, Pid: pid}
+		c.Name, c.Image = dockerContainerInfo(id)
+		containers = append(containers, c)
+	}
+
+	sort.Sort(byContainerID(containers))
+	return containers, nil
+}
+
+// containerID picks the container id out of a process's cgroups, or returns
+// "" if it's not in a container
+func containerID(cgroup string) string {
+	for _, line := range strings.Split(cgroup, "\n") {
+		field := strings.SplitN(line, ":", 3)
+		if len(field) != 3 {
+			continue
+		}
+
+		ids := containerIDPattern.FindAllString(field[2], -1)
+		if len(ids) > 0 {
+			return ids[len(ids)-1]
+		}
+	}
+	return ""
+}
+
+// The name and image of a docker container. Other runtimes don't keep this
+// anywhere we could read it, so their containers go by id alone.
+func dockerContainerInfo(id string) (name string, image string) {
+	data, err := ioutil.ReadFile(filepath.Join(dockerRoot, "containers", id, "config.v2.json"))
+	if err != nil {
+		return "", ""
+	}
+
+	var config struct {
+		Name   string
+		Config struct {
+			Image string
+		}
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		conf.FetchLog().Debugf("Can't read docker config for %s: %s", id, err)
+		return "", ""
+	}
+
+	return strings.TrimPrefix(config.Name, "/"), config.Config.Image
+}
+
+// inspectContainer reads the package databases in the container's filesystem,
+// along with the files at paths (which may be patterns) inside it.
+func inspectContainer(c container, paths []string) (*imageInventory, error) {
+	log := conf.FetchLog()
+
+	root := c.root()
+	if _, err := os.Stat(root); err != nil {
+		return nil, err
+	}
+
+	inventory := &imageInventory{Ref: c.Image}
+
+	for _, release := range imageOSReleases {
+		if contents, err := readInRoot(root, release); err == nil {
+			inventory.Distro, inventory.Release = parseOSRelease(contents)
+			break
+		}
+	}
+
+	for name, kind := range imagePackageDatabases {
+		if contents, err := readInRoot(root, name); err == nil {
+			inventory.Files = append(inventory.Files, imageFile{Path: "/" + name, Kind: kind, Contents: contents})
+		}
+	}
+
+	for _, dir := range imageRpmDirs {
+		contents, err := containerRpmPackages(root, dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Infof("Can't list the rpm packages in container %s: %s", c.shortID(), err)
+			continue
+		}
+		inventory.Files = append(inventory.Files, imageFile{Path: "/" + dir, Kind: "centos", Contents: contents})
+		break
+	}
+
+	for _, pattern := range paths {
+		names := []string{path.Clean("/" + pattern)}
+		if IsGlob(pattern) {
+			found, err := globPaths(filepath.Join(root, pattern))
+			if err != nil {
+				log.Infof("Can't expand %s in container %s: %s", pattern, c.shortID(), err)
+				continue
+			}
+
+			names = names[:0]
+			for _, match := range found {
+				names = append(names, "/"+strings.TrimPrefix(match, root+"/"))
+			}
+		}
+
+		for _, name := range names {
+			if inventory.has(name) {
+				continue
+			}
+
+			// patterns get expanded on the host's terms, which at worst
+			// finds names that aren't there, but files are read on the
+			// container's
+			contents, err := readInRoot(root, name)
+			if err != nil {
+				continue
+			}
+			inventory.Files = append(inventory.Files, imageFile{Path: name, Kind: DetectKind(name, contents), Contents: contents})
+		}
+	}
+
+	sort.Sort(byImagePath(inventory.Files))
+	return inventory, nil
+}
+
+// Like with images, rpm gets a copy of the database to list the packages in,
+// rather than be let loose on the container's filesystem.
+func containerRpmPackages(root string, dir string) ([]byte, error) {
+	dbPath, err := ioutil.TempDir("", "canaryrpm")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dbPath)
+
+	if err := copyDirInRoot(root, dir, dbPath); err != nil {
+		return nil, err
+	}
+	return rpmPackages(dbPath)
+}
+
+type byContainerID []container
+
+func (s byContainerID) Len() int           { return len(s) }
+func (s byContainerID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byContainerID) Less(i, j int) bool { return s[i].ID < s[j].ID }
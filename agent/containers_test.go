@@ -0,0 +1,194 @@
+package agent
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/appcanary/agent/conf"
+	"github.com/appcanary/testify/assert"
+)
+
+var (
+	dockerID = strings.Repeat("a1", 32)
+	criID    = strings.Repeat("b2", 32)
+)
+
+// fakes /proc (and docker's state) with a host process, a docker container
+// running two processes and a kubernetes one running one
+func fakeContainerHost(assert *assert.Assertions) string {
+	dir, err := ioutil.TempDir("", "canarycontainers")
+	assert.Nil(err)
+
+	write := func(path string, contents string) {
+		path = filepath.Join(dir, path)
+		assert.Nil(os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(ioutil.WriteFile(path, []byte(contents), 0644))
+	}
+
+	write("proc/1/cgroup", "0::/init.scope\n")
+	write("proc/1/stat", "1 (systemd) S 0 1 1 0 -1\n")
+
+	write("proc/100/cgroup", "0::/system.slice/docker-"+dockerID+".scope\n")
+	write("proc/100/stat", "100 (nginx) S 1 100 100 0 -1\n")
+	write("proc/100/root/etc/os-release", "ID=ubuntu\nVERSION_ID=\"22.04\"\n")
+	write("proc/100/root/var/lib/dpkg/status", "Package: nginx\nVersion: 1.18.0-6\n")
+	write("proc/100/root/app/Gemfile.lock", "GEM\n")
+
+	write("proc/101/cgroup", "0::/system.slice/docker-"+dockerID+".scope\n")
+	write("proc/101/stat", "101 (nginx: worker) S 100 100 100 0 -1\n")
+
+	write("proc/200/cgroup", "11:pids:/kubepods/burstable/pod1234/"+criID+"\n1:name=systemd:/kubepods/burstable/pod1234/"+criID+"\n")
+	write("proc/200/stat", "200 (sh) S 1 200 200 0 -1\n")
+	write("proc/200/root/lib/apk/db/installed", "C:Q1abc=\nP:musl\nV:1.2.4-r2\n")
+
+	write("proc/self", "")
+
+	write("docker/containers/"+dockerID+"/config.v2.json", `{"Name": "/web", "Config": {"Image": "nginx:1.25"}}`)
+
+	procRoot = filepath.Join(dir, "proc")
+	dockerRoot = filepath.Join(dir, "docker")
+	return dir
+}
+
+func resetContainerHost(dir string) {
+	procRoot = "/proc"
+	dockerRoot = "/var/lib/docker"
+	os.RemoveAll(dir)
+}
+
+func TestRunningContainers(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := fakeContainerHost(assert)
+	defer resetContainerHost(dir)
+
+	containers, err := runningContainers()
+	assert.Nil(err)
+	assert.Equal([]container{
+		{ID: dockerID, Name: "web", Image: "nginx:1.25", Pid: 100},
+		{ID: criID, Pid: 200},
+	}, containers)
+
+	web := containers[0]
+	assert.True(web.matches("*"))
+	assert.True(web.matches("web"))
+	assert.True(web.matches("nginx:*"))
+	assert.True(web.matches(dockerID[:12]))
+	assert.False(web.matches("db"))
+	assert.False(containers[1].matches("nginx:*"))
+}
+
+func TestInspectContainer(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	dir := fakeContainerHost(assert)
+	defer resetContainerHost(dir)
+
+	inventory, err := inspectContainer(container{ID: dockerID, Pid: 100}, []string{"/app/*.lock", "/var/lib/dpkg/status"})
+	assert.Nil(err)
+	assert.Equal("ubuntu", inventory.Distro)
+	assert.Equal("22.04", inventory.Release)
+	assert.Equal([]imageFile{
+		{Path: "/app/Gemfile.lock", Kind: "gemfile", Contents: []byte("GEM\n")},
+		{Path: "/var/lib/dpkg/status", Kind: "ubuntu", Contents: []byte("Package: nginx\nVersion: 1.18.0-6\n")},
+	}, inventory.Files)
+
+	// containers that stopped have nothing to show
+	_, err = inspectContainer(container{ID: dockerID, Pid: 300}, nil)
+	assert.NotNil(err)
+}
+
+func TestInspectContainerSymlinks(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	dir := fakeContainerHost(assert)
+	defer resetContainerHost(dir)
+
+	// something of the host's the container would like us to ship
+	secret := filepath.Join(dir, "shadow")
+	assert.Nil(ioutil.WriteFile(secret, []byte("root:$6$secret:19000::::::\n"), 0600))
+
+	root := filepath.Join(procRoot, "100", "root")
+	assert.Nil(os.Remove(filepath.Join(root, "var/lib/dpkg/status")))
+	assert.Nil(os.Symlink(secret, filepath.Join(root, "var/lib/dpkg/status")))
+	assert.Nil(os.Symlink("../../../../../../../../../.."+secret, filepath.Join(root, "app/Other.lock")))
+
+	// absolute links resolve within the container, same as they would for it
+	assert.Nil(os.MkdirAll(filepath.Join(root, "srv/app"), 0755))
+	assert.Nil(ioutil.WriteFile(filepath.Join(root, "srv/app/Gemfile.lock"), []byte("GEM\n  specs:\n"), 0644))
+	assert.Nil(os.Symlink("/srv/app", filepath.Join(root, "current")))
+	assert.Nil(os.Symlink("/dev/zero", filepath.Join(root, "app/Zero.lock")))
+
+	inventory, err := inspectContainer(container{ID: dockerID, Pid: 100}, []string{"/app/*.lock", "/current/Gemfile.lock"})
+	assert.Nil(err)
+	for _, file := range inventory.Files {
+		assert.NotContains(string(file.Contents), "secret", file.Path)
+	}
+	assert.Equal([]imageFile{
+		{Path: "/app/Gemfile.lock", Kind: "gemfile", Contents: []byte("GEM\n")},
+		{Path: "/current/Gemfile.lock", Kind: "gemfile", Contents: []byte("GEM\n  specs:\n")},
+	}, inventory.Files)
+
+	// the same goes for whatever's read directly
+	contents, err := readInRoot(root, "/current/../app/Gemfile.lock")
+	assert.Nil(err)
+	assert.Equal("GEM\n  specs:\n", string(contents))
+	_, err = readInRoot(root, "/var/lib/dpkg/status")
+	assert.NotNil(err)
+	_, err = readInRoot(root, "/app")
+	assert.NotNil(err)
+
+	// and files aren't directories, whatever comes after them
+	for _, name := range []string{"/app/Gemfile.lock/..", "/app/Gemfile.lock/../Gemfile.lock", "/app/Gemfile.lock/"} {
+		_, err = readInRoot(root, name)
+		assert.True(errors.Is(err, syscall.ENOTDIR), name)
+	}
+}
+
+func TestShipContainers(t *testing.T) {
+	assert := assert.New(t)
+
+	conf.InitEnv("test")
+	config, err := conf.NewConfFromEnv()
+	assert.Nil(err)
+
+	varDir := tempVarDir(assert)
+	defer os.RemoveAll(varDir)
+
+	dir := fakeContainerHost(assert)
+	defer resetContainerHost(dir)
+
+	client := &MockClient{}
+	client.On("CreateServer").Return("container-uuid")
+	client.On("SendFile").Return(nil)
+	client.On("Heartbeat").Return(nil)
+
+	agent := NewAgent("test", config, client)
+	watcher := NewContainerWatcher("*", testCallbackNOP).(*containerWatcher)
+	watcher.scan()
+	assert.Equal(2, len(watcher.Containers()))
+
+	agent.OnChange(watcher)
+	client.AssertNumberOfCalls(t, "CreateServer", 2)
+	client.AssertNumberOfCalls(t, "SendFile", 2)
+	assert.Equal("container-uuid", config.IdentityUUID("container:web"))
+	assert.Equal("container-uuid", config.IdentityUUID("container:"+criID))
+
+	// nothing changed, nothing to ship
+	agent.OnChange(watcher)
+	client.AssertNumberOfCalls(t, "SendFile", 2)
+
+	server := NewContainerServer(config, watcher.Containers()[0].Container, "ubuntu", "22.04")
+	assert.Equal("web", server.Name)
+	assert.Equal(dockerID[:12], server.Hostname)
+	assert.Equal("container-uuid", server.UUID)
+	assert.Contains(server.Tags, "container:"+dockerID)
+	assert.Contains(server.Tags, "image:nginx:1.25")
+}
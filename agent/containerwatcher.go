@@ -0,0 +1,187 @@
+package agent
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/appcanary/agent/conf"
+)
+
+type ContainerWatcher interface {
+	Start()
+	Stop()
+	Containers() []containerInventory
+	MarshalJSON() ([]byte, error)
+}
+
+// What we found in one running container
+type containerInventory struct {
+	Container container
+	Inventory *imageInventory
+}
+
+// Container watchers look inside the containers running on this host, the ones
+// whose name, image or id match, for their package databases and the files
+// at the paths setting. Each container gets reported as a server of its own.
+type containerWatcher struct {
+	sync.Mutex
+	keepPolling  bool
+	match        string
+	paths        []string
+	UpdatedAt    time.Time
+	BeingWatched bool
+	OnChange     ChangeHandler
+	LastError    string
+	containers   []containerInventory
+	checksum     string
+	pollSleep    time.Duration
+	pollJitter   time.Duration
+	stop         chan bool
+}
+
+func NewContainerWatcher(match string, callback ChangeHandler, settings ...conf.WatcherConf) Watcher {
+	env := conf.FetchEnv()
+	setting := watcherSettings(settings)
+
+	watcher := &containerWatcher{
+		match:     match,
+		paths:     setting.Paths,
+		OnChange:  callback,
+		UpdatedAt: time.Now(),
+	}
+	watcher.pollSleep, watcher.pollJitter = pollTimes(setting, env.PollSleep)
+
+	// like process watchers, we scan once we're started
+	return watcher
+}
+
+func (cw *containerWatcher) MarshalJSON() ([]byte, error) {
+	cw.Lock()
+	defer cw.Unlock()
+
+	containers := make([]map[string]interface{}, len(cw.containers))
+	for i, c := range cw.containers {
+		containers[i] = map[string]interface{}{
+			"id":    c.Container.ID,
+			"name":  c.Container.Name,
+			"image": c.Container.Image,
+		}
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"match":         cw.match,
+		"kind":          "containers",
+		"containers":    containers,
+		"updated-at":    cw.UpdatedAt,
+		"being-watched": cw.BeingWatched,
+		"error":         cw.LastError})
+}
+
+func (cw *containerWatcher) Containers() []containerInventory {
+	cw.Lock()
+	defer cw.Unlock()
+	return append([]containerInventory{}, cw.containers...)
+}
+
+func (cw *containerWatcher) KeepPolling() bool {
+	cw.Lock()
+	defer cw.Unlock()
+	return cw.keepPolling
+}
+
+func (cw *containerWatcher) Start() {
+	cw.Lock()
+	if cw.keepPolling {
+		cw.Unlock()
+		return
+	}
+	cw.keepPolling = true
+	cw.stop = make(chan bool)
+	stop := cw.stop
+	cw.Unlock()
+	go cw.listen(stop)
+}
+
+func (cw *containerWatcher) Stop() {
+	cw.Lock()
+	if cw.keepPolling {
+		close(cw.stop)
+	}
+	cw.keepPolling = false
+	cw.Unlock()
+}
+
+func (cw *containerWatcher) scan() {
+	log := conf.FetchLog()
+
+	running, err := runningContainers()
+
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	}
+
+	cw.Lock()
+	errChanged := msg != cw.LastError
+	cw.LastError = msg
+	cw.BeingWatched = err == nil
+	cw.Unlock()
+
+	if err != nil {
+		if errChanged {
+			log.Infof("Can't list containers: %s", msg)
+		}
+		return
+	}
+
+	found := []containerInventory{}
+	for _, c := range running {
+		if !c.matches(cw.match) {
+			continue
+		}
+
+		inventory, err := inspectContainer(c, cw.paths)
+		if err != nil {
+			// it probably just stopped
+			log.Debugf("Can't inspect container %s: %s", c.shortID(), err)
+			continue
+		}
+		found = append(found, containerInventory{Container: c, Inventory: inventory})
+	}
+
+	sum := containersChecksum(found)
+
+	cw.Lock()
+	changed := sum != cw.checksum
+	if changed {
+		cw.containers = found
+		cw.checksum = sum
+		cw.UpdatedAt = time.Now()
+	}
+	cw.Unlock()
+
+	if changed {
+		go cw.OnChange(cw)
+	}
+}
+
+func (cw *containerWatcher) listen(stop chan bool) {
+	for cw.KeepPolling() {
+		cw.scan()
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(nextPoll(cw.pollSleep, cw.pollJitter)):
+		}
+	}
+}
+
+func containersChecksum(containers []containerInventory) string {
+	var all []byte
+	for _, c := range containers {
+		all = append(all, c.Container.ID+" "+c.Container.Image+" "+c.Inventory.checksum()+"\n"...)
+	}
+	return checksum(all)
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/appcanary/agent/conf"
+)
+
+// The dependency manifests we go looking for
+var discoverableFiles = map[string]bool{
+	"Gemfile.lock":      true,
+	"package-lock.json": true,
+	"yarn.lock":         true,
+	"Pipfile.lock":      true,
+	"poetry.lock":       true,
+	"composer.lock":     true,
+	"go.sum":            true,
+	"Cargo.lock":        true,
+}
+
+// Discovery watchers walk a directory tree looking for lockfiles, so apps
+// don't have to be listed one by one. Directories deeper than the depth
+// setting, or whose name or path matches one of the exclude patterns, are
+// skipped.
+func NewDiscoveryWatcher(root string, callback PathsChangeHandler, settings ...conf.WatcherConf) Watcher {
+	env := conf.FetchEnv()
+	setting := watcherSettings(settings)
+
+	depth := setting.Depth
+	if depth <= 0 {
+		depth = conf.DEFAULT_DISCOVER_DEPTH
+	}
+
+	exclude := setting.Exclude
+	if exclude == nil {
+		exclude = conf.DEFAULT_DISCOVER_EXCLUDE
+	}
+
+	watcher := &pathsWatcher{
+		description: root,
+		find:        func() ([]string, error) { return discoverPaths(root, depth, exclude) },
+		matches:     map[string]bool{},
+		OnChange:    callback,
+	}
+	watcher.pollSleep, watcher.pollJitter = pollTimes(setting, env.PollSleep)
+
+	watcher.scan()
+	return watcher
+}
+
+func discoverPaths(root string, depth int, exclude []string) ([]string, error) {
+	// a missing root is an error, anything missing below it is not
+	if _, err := os.Stat(root); err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	discoverIn(filepath.Clean(root), depth, exclude, map[string]bool{}, &paths)
+	return paths, nil
+}
+
+// Symlinked directories are followed, since that's how most deploy tools point
+// at the live release, but every real directory is only visited once. Paths are
+// reported as we found them, i.e. through the symlink, so they stay put across
+// deploys. The releases it doesn't point at are left alone.
+func discoverIn(dir string, depth int, exclude []string, visited map[string]bool, paths *[]string) {
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil || visited[realDir] {
+		return
+	}
+	visited[realDir] = true
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+
+		if excluded(path, exclude) {
+			continue
+		}
+
+		// ReadDir doesn't follow symlinks, Stat does
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		if info.IsDir() {
+			if depth > 1 && !staleRelease(path) {
+				discoverIn(path, depth-1, exclude, visited, paths)
+			}
+		} else if info.Mode().IsRegular() && discoverableFiles[entry.Name()] {
+			*paths = append(*paths, path)
+		}
+	}
+}
+
+// staleRelease tells whether dir is one of the releases a capistrano style
+// deploy keeps around (app/releases/*) other than the one app/current points
+// at. Without a current symlink there's no telling, so none are.
+func staleRelease(dir string) bool {
+	releases := filepath.Dir(dir)
+	if filepath.Base(releases) != "releases" {
+		return false
+	}
+
+	current, err := filepath.EvalSymlinks(filepath.Join(filepath.Dir(releases), "current"))
+	if err != nil {
+		return false
+	}
+	release, err := filepath.EvalSymlinks(dir)
+	return err == nil && release != current
+}
+
+func excluded(path string, exclude []string) bool {
+	for _, pattern := range exclude {
+		if ok, _ := filepath.Match(pattern, filepath.Base(path)); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/appcanary/agent/conf"
+	"github.com/appcanary/testify/assert"
+)
+
+func TestDiscoverPaths(t *testing.T) {
+	assert := assert.New(t)
+
+	root, _ := ioutil.TempDir("", "canarydiscover")
+	defer os.RemoveAll(root)
+
+	for _, path := range []string{
+		"rails/releases/1/Gemfile.lock",
+		"rails/releases/0/Gemfile.lock",
+		"sinatra/releases/1/Gemfile.lock",
+		"node/package-lock.json",
+		"node/node_modules/dep/yarn.lock",
+		"deep/a/b/c/d/Cargo.lock",
+		"go/go.sum",
+		"go/README.md",
+	} {
+		full := filepath.Join(root, path)
+		os.MkdirAll(filepath.Dir(full), 0755)
+		ioutil.WriteFile(full, []byte("lock"), 0644)
+	}
+
+	// point current at the release, the way capistrano does; the release
+	// before it is left alone, and where there's no current there's no
+	// telling which release is live
+	os.Symlink("releases/1", filepath.Join(root, "rails/current"))
+
+	paths, err := discoverPaths(root, 4, conf.DEFAULT_DISCOVER_EXCLUDE)
+	assert.Nil(err)
+	assert.Equal([]string{
+		filepath.Join(root, "go/go.sum"),
+		filepath.Join(root, "node/package-lock.json"),
+		filepath.Join(root, "rails/current/Gemfile.lock"),
+		filepath.Join(root, "sinatra/releases/1/Gemfile.lock"),
+	}, paths)
+
+	paths, err = discoverPaths(root, 6, []string{"node*", filepath.Join(root, "rails")})
+	assert.Nil(err)
+	assert.Equal([]string{
+		filepath.Join(root, "deep/a/b/c/d/Cargo.lock"),
+		filepath.Join(root, "go/go.sum"),
+		filepath.Join(root, "sinatra/releases/1/Gemfile.lock"),
+	}, paths)
+
+	_, err = discoverPaths(filepath.Join(root, "nope"), 4, nil)
+	assert.NotNil(err)
+}
@@ -0,0 +1,562 @@
+package agent
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/appcanary/agent/conf"
+)
+
+// anything bigger than this in an image isn't a package database or lockfile
+// we'd know what to do with
+const maxImageFileSize = 64 * 1024 * 1024
+
+// Package databases we look for in images, and their kinds
+var imagePackageDatabases = map[string]string{
+	"var/lib/dpkg/status":  "ubuntu",
+	"lib/apk/db/installed": "alpine",
+}
+
+// rpm keeps its database in several files, in one of these directories
+var imageRpmDirs = []string{"var/lib/rpm", "usr/lib/sysimage/rpm"}
+
+var imageOSReleases = []string{"etc/os-release", "usr/lib/os-release"}
+
+// A file we pulled out of a container image
+type imageFile struct {
+	Path     string
+	Kind     string
+	Contents []byte
+}
+
+// What's in a container image, with all of its layers applied
+type imageInventory struct {
+	Ref     string
+	Distro  string
+	Release string
+	Files   []imageFile
+}
+
+// A checksum over everything we found, to tell whether we've shipped it already
+func (inventory *imageInventory) checksum() string {
+	var all bytes.Buffer
+	for _, file := range inventory.Files {
+		all.WriteString(file.Path + "\x00" + file.Kind + "\x00" + checksum(file.Contents) + "\n")
+	}
+	return checksum(all.Bytes())
+}
+
+func (inventory *imageInventory) has(path string) bool {
+	for _, file := range inventory.Files {
+		if file.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// inspectImage reads the image at imagePath, which is either a tarball made by
+// docker save (or of an OCI layout), or an unpacked OCI layout directory.
+func inspectImage(imagePath string) (*imageInventory, error) {
+	source, err := openImage(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	ref, layers, err := imageLayers(source)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", imagePath, err)
+	}
+
+	tree := imageTree{}
+	for _, layer := range layers {
+		if err := tree.applyLayerFrom(source, layer); err != nil {
+			return nil, fmt.Errorf("%s: layer %s: %s", imagePath, layer, err)
+		}
+	}
+
+	inventory := tree.inventory()
+	inventory.Ref = ref
+	return inventory, nil
+}
+
+// Images are files inside a tarball or a directory; either way we only need to
+// get at them by name.
+type imageSource interface {
+	Open(name string) (io.ReadCloser, error)
+	Close() error
+}
+
+func openImage(imagePath string) (imageSource, error) {
+	info, err := os.Stat(imagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return dirSource(imagePath), nil
+	}
+	return openTarSource(imagePath)
+}
+
+type dirSource string
+
+func (dir dirSource) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(dir), filepath.FromSlash(name)))
+}
+
+func (dir dirSource) Close() error {
+	return nil
+}
+
+// Image tarballs run into the gigabytes, so rather than unpacking them we note
+// where each member starts and read it in place.
+type tarSource struct {
+	file    *os.File
+	members map[string]tarMember
+}
+
+type tarMember struct {
+	offset int64
+	size   int64
+}
+
+func openTarSource(tarPath string) (*tarSource, error) {
+	file, err := os.Open(tarPath)
+	if err != nil {
+		return nil, err
+	}
+
+	source := &tarSource{file: file, members: map[string]tarMember{}}
+
+	// tar.Reader reads no further than the header, so once it's done the
+	// file is positioned at the start of the member's contents
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %s", tarPath, err)
+		}
+
+		if !header.FileInfo().Mode().IsRegular() {
+			continue
+		}
+
+		offset, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		source.members[cleanImagePath(header.Name)] = tarMember{offset: offset, size: header.Size}
+	}
+
+	return source, nil
+}
+
+func (source *tarSource) Open(name string) (io.ReadCloser, error) {
+	member, ok := source.members[cleanImagePath(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(io.NewSectionReader(source.file, member.offset, member.size)), nil
+}
+
+func (source *tarSource) Close() error {
+	return source.file.Close()
+}
+
+// paths in images are relative to the image's root, whichever way they're written
+func cleanImagePath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func readImageJSON(source imageSource, name string, v interface{}) error {
+	file, err := source.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return json.NewDecoder(file).Decode(v)
+}
+
+// What docker save writes to manifest.json, one per image in the tarball
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform"`
+}
+
+// OCI indexes and manifests, which differ in which of these they have
+type ociManifest struct {
+	Manifests []ociDescriptor `json:"manifests"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+// imageLayers returns the paths of the image's layers within source, bottom
+// layer first, and the reference the image was saved under if any. Tarballs
+// from docker save come with a manifest.json (newer ones are also OCI
+// layouts), anything else has to be an OCI layout.
+func imageLayers(source imageSource) (string, []string, error) {
+	var manifests []dockerManifest
+	err := readImageJSON(source, "manifest.json", &manifests)
+	if err == nil {
+		if len(manifests) == 0 {
+			return "", nil, errors.New("manifest.json lists no images")
+		}
+		if len(manifests) > 1 {
+			conf.FetchLog().Infof("Image has %d manifests, only looking at the first", len(manifests))
+		}
+
+		manifest := manifests[0]
+		ref := ""
+		if len(manifest.RepoTags) > 0 {
+			ref = manifest.RepoTags[0]
+		}
+		return ref, manifest.Layers, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", nil, fmt.Errorf("manifest.json: %s", err)
+	}
+
+	return ociLayers(source)
+}
+
+// OCI layouts start from index.json, which points at an image manifest, or at
+// further indexes for multi-platform images.
+func ociLayers(source imageSource) (string, []string, error) {
+	var doc ociManifest
+	if err := readImageJSON(source, "index.json", &doc); err != nil {
+		if os.IsNotExist(err) {
+			return "", nil, errors.New("neither a docker save tarball nor an OCI layout")
+		}
+		return "", nil, fmt.Errorf("index.json: %s", err)
+	}
+
+	ref := ""
+	for depth := 0; len(doc.Layers) == 0; depth++ {
+		if len(doc.Manifests) == 0 || depth > 3 {
+			return "", nil, errors.New("no image manifest found")
+		}
+
+		descriptor := pickManifest(doc.Manifests)
+		if ref == "" {
+			ref = refAnnotation(descriptor)
+		}
+
+		blob, err := blobPath(descriptor.Digest)
+		if err != nil {
+			return "", nil, err
+		}
+
+		doc = ociManifest{}
+		if err := readImageJSON(source, blob, &doc); err != nil {
+			return "", nil, fmt.Errorf("%s: %s", blob, err)
+		}
+	}
+
+	layers := make([]string, len(doc.Layers))
+	for i, layer := range doc.Layers {
+		blob, err := blobPath(layer.Digest)
+		if err != nil {
+			return "", nil, err
+		}
+		layers[i] = blob
+	}
+
+	return ref, layers, nil
+}
+
+// For multi-platform images we go for the one that would run here
+func pickManifest(manifests []ociDescriptor) ociDescriptor {
+	for _, manifest := range manifests {
+		if manifest.Platform != nil && manifest.Platform.OS == "linux" && manifest.Platform.Architecture == runtime.GOARCH {
+			return manifest
+		}
+	}
+	return manifests[0]
+}
+
+func refAnnotation(descriptor ociDescriptor) string {
+	// containerd puts the full reference here, the OCI annotation is often
+	// just the tag
+	for _, key := range []string{"io.containerd.image.name", "org.opencontainers.image.ref.name"} {
+		if ref := descriptor.Annotations[key]; ref != "" {
+			return ref
+		}
+	}
+	return ""
+}
+
+func blobPath(digest string) (string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.ContainsAny(digest, "/\\") {
+		return "", fmt.Errorf("bad digest %q", digest)
+	}
+	return "blobs/" + parts[0] + "/" + parts[1], nil
+}
+
+// The files we care about, by path within the image, as of the layers applied
+// so far.
+type imageTree map[string][]byte
+
+func (tree imageTree) applyLayerFrom(source imageSource, layer string) error {
+	file, err := source.Open(layer)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := decompressLayer(file)
+	if err != nil {
+		return err
+	}
+	return tree.applyLayer(reader)
+}
+
+// Layers may or may not be compressed, and the media type isn't always there
+// to say, so we go by the magic number.
+func decompressLayer(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	magic, _ := buffered.Peek(4)
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(buffered)
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return nil, errors.New("zstd compressed layers are not supported")
+	}
+	return buffered, nil
+}
+
+// applyLayer lays a layer over the tree. Whiteouts (.wh.name) delete name from
+// the layers below, opaque whiteouts (.wh..wh..opq) everything in their
+// directory; anything other than a directory hides whatever was at its path.
+func (tree imageTree) applyLayer(r io.Reader) error {
+	log := conf.FetchLog()
+
+	added := imageTree{}
+	var deleted, replaced []string
+
+	reader := tar.NewReader(r)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := cleanImagePath(header.Name)
+		dir, base := path.Dir(name), path.Base(name)
+
+		if base == ".wh..wh..opq" {
+			deleted = append(deleted, dir+"/")
+			continue
+		}
+		if strings.HasPrefix(base, ".wh.") {
+			deleted = append(deleted, path.Join(dir, strings.TrimPrefix(base, ".wh.")))
+			continue
+		}
+
+		if header.Typeflag == tar.TypeDir {
+			replaced = append(replaced, name)
+			continue
+		}
+		deleted = append(deleted, name)
+
+		if !header.FileInfo().Mode().IsRegular() || !keepImageFile(name) {
+			continue
+		}
+
+		if header.Size > maxImageFileSize {
+			log.Infof("Skipping /%s in image, it's too big (%d bytes)", name, header.Size)
+			continue
+		}
+
+		contents, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		added[name] = contents
+	}
+
+	// the layer's own deletions only apply to the layers below it
+	for _, name := range deleted {
+		tree.remove(name)
+	}
+	for _, name := range replaced {
+		delete(tree, name)
+	}
+	for name, contents := range added {
+		tree[name] = contents
+	}
+	return nil
+}
+
+// remove drops name, along with everything below it; a name ending in a slash
+// only drops what's below it.
+func (tree imageTree) remove(name string) {
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	for file := range tree {
+		if file == name || strings.HasPrefix(file, prefix) {
+			delete(tree, file)
+		}
+	}
+}
+
+func keepImageFile(name string) bool {
+	if _, ok := imagePackageDatabases[name]; ok {
+		return true
+	}
+
+	for _, release := range imageOSReleases {
+		if name == release {
+			return true
+		}
+	}
+
+	for _, dir := range imageRpmDirs {
+		if path.Dir(name) == dir {
+			return true
+		}
+	}
+
+	if !discoverableFiles[path.Base(name)] {
+		return false
+	}
+
+	// same as discovery watchers, skip what's vendored
+	for _, segment := range strings.Split(path.Dir(name), "/") {
+		if excluded(segment, conf.DEFAULT_DISCOVER_EXCLUDE) {
+			return false
+		}
+	}
+	return true
+}
+
+func (tree imageTree) inventory() *imageInventory {
+	log := conf.FetchLog()
+	inventory := &imageInventory{}
+
+	for _, release := range imageOSReleases {
+		if contents, ok := tree[release]; ok {
+			inventory.Distro, inventory.Release = parseOSRelease(contents)
+			break
+		}
+	}
+
+	for name, contents := range tree {
+		if kind, ok := imagePackageDatabases[name]; ok {
+			inventory.Files = append(inventory.Files, imageFile{Path: "/" + name, Kind: kind, Contents: contents})
+		} else if discoverableFiles[path.Base(name)] {
+			inventory.Files = append(inventory.Files, imageFile{Path: "/" + name, Kind: KindByName(name), Contents: contents})
+		}
+	}
+
+	for _, dir := range imageRpmDirs {
+		if !tree.hasFilesIn(dir) {
+			continue
+		}
+
+		contents, err := tree.rpmPackageList(dir)
+		if err != nil {
+			log.Infof("Can't list the rpm packages in image: %s", err)
+			continue
+		}
+		inventory.Files = append(inventory.Files, imageFile{Path: "/" + dir, Kind: "centos", Contents: contents})
+		break
+	}
+
+	sort.Sort(byImagePath(inventory.Files))
+	return inventory
+}
+
+func (tree imageTree) hasFilesIn(dir string) bool {
+	for name := range tree {
+		if path.Dir(name) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// rpm databases are binary (Berkeley DB, sqlite or ndb depending on the
+// distro), so we have rpm list the packages, same as a command watcher would.
+func (tree imageTree) rpmPackageList(dir string) ([]byte, error) {
+	dbPath, err := ioutil.TempDir("", "canaryrpm")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dbPath)
+
+	for name, contents := range tree {
+		if path.Dir(name) != dir {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(dbPath, path.Base(name)), contents, 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	return rpmPackages(dbPath)
+}
+
+func rpmPackages(dbPath string) ([]byte, error) {
+	cmd := &command{Name: "rpm", Args: []string{"--dbpath", dbPath, "-qa"}, Timeout: conf.DEFAULT_COMMAND_TIMEOUT}
+	return cmd.Output()
+}
+
+// os-release is a list of shell variable assignments, e.g. VERSION_ID="12"
+func parseOSRelease(contents []byte) (distro string, release string) {
+	for _, line := range strings.Split(string(contents), "\n") {
+		field := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(field) != 2 {
+			continue
+		}
+
+		value := strings.Trim(field[1], `"'`)
+		switch field[0] {
+		case "ID":
+			distro = strings.ToLower(value)
+		case "VERSION_ID":
+			release = value
+		}
+	}
+	return
+}
+
+type byImagePath []imageFile
+
+func (s byImagePath) Len() int           { return len(s) }
+func (s byImagePath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byImagePath) Less(i, j int) bool { return s[i].Path < s[j].Path }
@@ -0,0 +1,205 @@
+package agent
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/appcanary/agent/conf"
+	"github.com/appcanary/testify/assert"
+)
+
+type tarEntry struct {
+	name     string
+	contents string
+}
+
+func makeTar(assert *assert.Assertions, entries ...tarEntry) []byte {
+	var buf bytes.Buffer
+	writer := tar.NewWriter(&buf)
+
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.contents)), Typeflag: tar.TypeReg}
+		if entry.name[len(entry.name)-1] == '/' {
+			header = &tar.Header{Name: entry.name, Mode: 0755, Typeflag: tar.TypeDir}
+		}
+
+		assert.Nil(writer.WriteHeader(header))
+		_, err := writer.Write([]byte(entry.contents))
+		assert.Nil(err)
+	}
+
+	assert.Nil(writer.Close())
+	return buf.Bytes()
+}
+
+func gzipped(assert *assert.Assertions, data []byte) []byte {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, err := writer.Write(data)
+	assert.Nil(err)
+	assert.Nil(writer.Close())
+	return buf.Bytes()
+}
+
+func mustJSON(assert *assert.Assertions, v interface{}) string {
+	data, err := json.Marshal(v)
+	assert.Nil(err)
+	return string(data)
+}
+
+// a docker save tarball with two layers, the second one compressed
+func dockerSaveImage(assert *assert.Assertions, dir string) string {
+	bottom := makeTar(assert,
+		tarEntry{"etc/", ""},
+		tarEntry{"etc/os-release", "NAME=\"Debian GNU/Linux\"\nID=debian\nVERSION_ID=\"12\"\n"},
+		tarEntry{"var/lib/dpkg/status", "Package: bash\nVersion: 5.1-2\n"},
+		tarEntry{"srv/app/Gemfile.lock", "GEM\n"},
+		tarEntry{"srv/old/Gemfile.lock", "GEM\n"},
+		tarEntry{"srv/app/node_modules/left-pad/package-lock.json", "{}"},
+		tarEntry{"srv/app/README", "hi"},
+	)
+	top := gzipped(assert, makeTar(assert,
+		tarEntry{"./var/lib/dpkg/status", "Package: bash\nVersion: 5.2-1\n"},
+		tarEntry{"srv/.wh.old", ""},
+		tarEntry{"srv/app/yarn.lock", "# yarn lockfile v1\n"},
+	))
+
+	manifest := []map[string]interface{}{{
+		"Config":   "config.json",
+		"RepoTags": []string{"example/app:1.0"},
+		"Layers":   []string{"bottom/layer.tar", "top/layer.tar"},
+	}}
+
+	path := filepath.Join(dir, "app.tar")
+	ioutil.WriteFile(path, makeTar(assert,
+		tarEntry{"bottom/layer.tar", string(bottom)},
+		tarEntry{"top/layer.tar", string(top)},
+		tarEntry{"config.json", "{}"},
+		tarEntry{"manifest.json", mustJSON(assert, manifest)},
+	), 0644)
+	return path
+}
+
+func TestInspectDockerSaveImage(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	dir, _ := ioutil.TempDir("", "canaryimage")
+	defer os.RemoveAll(dir)
+
+	inventory, err := inspectImage(dockerSaveImage(assert, dir))
+	assert.Nil(err)
+
+	assert.Equal("example/app:1.0", inventory.Ref)
+	assert.Equal("debian", inventory.Distro)
+	assert.Equal("12", inventory.Release)
+
+	// the old app got deleted, vendored lockfiles are skipped, and later
+	// layers win
+	assert.Equal([]imageFile{
+		{Path: "/srv/app/Gemfile.lock", Kind: "gemfile", Contents: []byte("GEM\n")},
+		{Path: "/srv/app/yarn.lock", Kind: "yarn", Contents: []byte("# yarn lockfile v1\n")},
+		{Path: "/var/lib/dpkg/status", Kind: "ubuntu", Contents: []byte("Package: bash\nVersion: 5.2-1\n")},
+	}, inventory.Files)
+}
+
+func TestInspectOCILayout(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	dir, _ := ioutil.TempDir("", "canaryimage")
+	defer os.RemoveAll(dir)
+
+	blob := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		digest := hex.EncodeToString(sum[:])
+		os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755)
+		ioutil.WriteFile(filepath.Join(dir, "blobs", "sha256", digest), data, 0644)
+		return "sha256:" + digest
+	}
+
+	bottom := blob(gzipped(assert, makeTar(assert,
+		tarEntry{"lib/apk/db/installed", "C:Q1abc=\nP:musl\nV:1.2.4-r2\n"},
+		tarEntry{"app/Cargo.lock", "# @generated by Cargo\n"},
+	)))
+	// an opaque directory hides everything below it
+	top := blob(makeTar(assert,
+		tarEntry{"app/", ""},
+		tarEntry{"app/.wh..wh..opq", ""},
+		tarEntry{"app/Pipfile.lock", "{}"},
+	))
+
+	manifest := blob([]byte(mustJSON(assert, map[string]interface{}{
+		"schemaVersion": 2,
+		"layers": []map[string]string{
+			{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": bottom},
+			{"mediaType": "application/vnd.oci.image.layer.v1.tar", "digest": top},
+		},
+	})))
+	ioutil.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion": "1.0.0"}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "index.json"), []byte(mustJSON(assert, map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests": []map[string]interface{}{{
+			"mediaType":   "application/vnd.oci.image.manifest.v1+json",
+			"digest":      manifest,
+			"annotations": map[string]string{"org.opencontainers.image.ref.name": "example/worker:2.0"},
+		}},
+	})), 0644)
+
+	inventory, err := inspectImage(dir)
+	assert.Nil(err)
+
+	assert.Equal("example/worker:2.0", inventory.Ref)
+	assert.Equal([]imageFile{
+		{Path: "/app/Pipfile.lock", Kind: "pipfile", Contents: []byte("{}")},
+		{Path: "/lib/apk/db/installed", Kind: "alpine", Contents: []byte("C:Q1abc=\nP:musl\nV:1.2.4-r2\n")},
+	}, inventory.Files)
+
+	// which is neither a docker save tarball nor an OCI layout
+	_, err = inspectImage(filepath.Join(dir, "blobs"))
+	assert.NotNil(err)
+}
+
+func TestShipImage(t *testing.T) {
+	assert := assert.New(t)
+
+	conf.InitEnv("test")
+	config, err := conf.NewConfFromEnv()
+	assert.Nil(err)
+
+	varDir := tempVarDir(assert)
+	defer os.RemoveAll(varDir)
+
+	image := dockerSaveImage(assert, varDir)
+
+	client := &MockClient{}
+	client.On("CreateServer").Return("image-uuid")
+	client.On("SendFile").Return(nil)
+	client.On("Heartbeat").Return(nil)
+
+	agent := NewAgent("test", config, client)
+	assert.Nil(agent.ShipImage(image, ""))
+	client.AssertNumberOfCalls(t, "CreateServer", 1)
+	client.AssertNumberOfCalls(t, "SendFile", 3)
+	assert.Equal("image-uuid", config.IdentityUUID("image:example/app:1.0"))
+
+	// the image is registered once, and a watcher seeing the same image
+	// doesn't ship it again
+	watcher := NewImageWatcher(image, testCallbackNOP)
+	agent.OnChange(watcher)
+	client.AssertNumberOfCalls(t, "CreateServer", 1)
+	client.AssertNumberOfCalls(t, "SendFile", 3)
+
+	// but syncing everything does
+	agent.handleChange(watcher, true)
+	client.AssertNumberOfCalls(t, "CreateServer", 1)
+	client.AssertNumberOfCalls(t, "SendFile", 6)
+}
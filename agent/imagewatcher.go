@@ -0,0 +1,168 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/appcanary/agent/conf"
+)
+
+type ImageWatcher interface {
+	Start()
+	Stop()
+	Path() string
+	Ref() string
+	MarshalJSON() ([]byte, error)
+}
+
+// Image watchers keep an eye on a container image saved to disk, be it a
+// docker save tarball or an OCI layout, and report a change whenever it gets
+// replaced. They only look at the outside of the image (its size and mtime,
+// or its index's for a directory) since reading every layer each poll would
+// be a lot of I/O for nothing.
+type imageWatcher struct {
+	sync.Mutex
+	keepPolling  bool
+	path         string
+	ref          string
+	UpdatedAt    time.Time
+	BeingWatched bool
+	OnChange     ChangeHandler
+	LastError    string
+	stamp        string
+	pollSleep    time.Duration
+	pollJitter   time.Duration
+	stop         chan bool
+}
+
+// The image gets reported under the ref setting if there is one, otherwise
+// under the reference it was saved with.
+func NewImageWatcher(path string, callback ChangeHandler, settings ...conf.WatcherConf) Watcher {
+	env := conf.FetchEnv()
+	setting := watcherSettings(settings)
+
+	watcher := &imageWatcher{
+		path:      path,
+		ref:       setting.Ref,
+		OnChange:  callback,
+		UpdatedAt: time.Now(),
+	}
+	watcher.pollSleep, watcher.pollJitter = pollTimes(setting, env.PollSleep)
+
+	watcher.scan()
+	return watcher
+}
+
+func (iw *imageWatcher) MarshalJSON() ([]byte, error) {
+	iw.Lock()
+	defer iw.Unlock()
+	ret, err := json.Marshal(map[string]interface{}{
+		"path":          iw.path,
+		"kind":          "image",
+		"ref":           iw.ref,
+		"updated-at":    iw.UpdatedAt,
+		"being-watched": iw.BeingWatched,
+		"error":         iw.LastError})
+	return ret, err
+}
+
+func (iw *imageWatcher) Path() string {
+	return iw.path
+}
+
+func (iw *imageWatcher) Ref() string {
+	return iw.ref
+}
+
+func (iw *imageWatcher) KeepPolling() bool {
+	iw.Lock()
+	defer iw.Unlock()
+	return iw.keepPolling
+}
+
+func (iw *imageWatcher) Start() {
+	iw.Lock()
+	if iw.keepPolling {
+		iw.Unlock()
+		return
+	}
+	iw.keepPolling = true
+	iw.stop = make(chan bool)
+	stop := iw.stop
+	iw.Unlock()
+	go iw.listen(stop)
+}
+
+func (iw *imageWatcher) Stop() {
+	iw.Lock()
+	if iw.keepPolling {
+		close(iw.stop)
+	}
+	iw.keepPolling = false
+	iw.Unlock()
+}
+
+func (iw *imageWatcher) scan() {
+	log := conf.FetchLog()
+
+	stamp, err := imageStamp(iw.path)
+
+	iw.Lock()
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	}
+	errChanged := msg != iw.LastError
+	iw.LastError = msg
+	iw.BeingWatched = err == nil
+
+	changed := err == nil && stamp != iw.stamp
+	if changed {
+		iw.stamp = stamp
+		iw.UpdatedAt = time.Now()
+	}
+	iw.Unlock()
+
+	if errChanged && err != nil {
+		log.Infof("Can't read image %s: %s", iw.path, msg)
+	}
+
+	if changed {
+		go iw.OnChange(iw)
+	}
+}
+
+func (iw *imageWatcher) listen(stop chan bool) {
+	for iw.KeepPolling() {
+		select {
+		case <-stop:
+			return
+		case <-time.After(nextPoll(iw.pollSleep, iw.pollJitter)):
+			iw.scan()
+		}
+	}
+}
+
+// imageStamp changes whenever the image at path gets replaced
+func imageStamp(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	if info.IsDir() {
+		// a new image means a new index, the blobs just pile up
+		for _, index := range []string{"index.json", "manifest.json"} {
+			if indexInfo, err := os.Stat(filepath.Join(path, index)); err == nil {
+				info = indexInfo
+				break
+			}
+		}
+	}
+
+	return fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano()), nil
+}
@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// As many symlinks as the kernel follows resolving one path
+const maxSymlinks = 40
+
+var errNotRegular = errors.New("not a regular file or directory")
+
+// openInRoot opens name as if root were /, the way a container sees its own
+// filesystem: symlinks (absolute or not) and ".." resolve within root rather
+// than against the host's root. Each component is opened without following
+// symlinks, so a container can't swap one in while we look, and only
+// directories and regular files get opened at all, so it can't get us to read
+// a device or block on a fifo either.
+func openInRoot(root string, name string) (*os.File, error) {
+	pathErr := func(err error) error {
+		return &os.PathError{Op: "open", Path: filepath.Join(root, name), Err: err}
+	}
+
+	rootFd, err := syscall.Open(root, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, pathErr(err)
+	}
+
+	// the directories we're in, so ".." can go back up (but not past root)
+	dirs := []int{rootFd}
+	defer func() {
+		for _, fd := range dirs {
+			syscall.Close(fd)
+		}
+	}()
+
+	rest := strings.Split(name, "/")
+	links := 0
+	for len(rest) > 0 {
+		component := rest[0]
+		rest = rest[1:]
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if len(dirs) > 1 {
+				syscall.Close(dirs[len(dirs)-1])
+				dirs = dirs[:len(dirs)-1]
+			}
+			continue
+		}
+
+		dir := dirs[len(dirs)-1]
+		fd, err := syscall.Openat(dir, component, syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+		if err == syscall.ELOOP {
+			links++
+			if links > maxSymlinks {
+				return nil, pathErr(syscall.ELOOP)
+			}
+
+			// read through the directory we hold, whatever's at its path now
+			target, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d/%s", dir, component))
+			if err != nil {
+				return nil, pathErr(err)
+			}
+			if strings.HasPrefix(target, "/") {
+				for _, fd := range dirs[1:] {
+					syscall.Close(fd)
+				}
+				dirs = dirs[:1]
+			}
+			rest = append(strings.Split(target, "/"), rest...)
+			continue
+		}
+		if err != nil {
+			return nil, pathErr(err)
+		}
+
+		var stat syscall.Stat_t
+		if err := syscall.Fstat(fd, &stat); err != nil {
+			syscall.Close(fd)
+			return nil, pathErr(err)
+		}
+		syscall.SetNonblock(fd, false)
+
+		switch stat.Mode & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+			dirs = append(dirs, fd)
+		case syscall.S_IFREG:
+			// not even "." or ".." may follow, as a file isn't a
+			// directory to be in or go up from
+			if len(rest) > 0 {
+				syscall.Close(fd)
+				return nil, pathErr(syscall.ENOTDIR)
+			}
+			return os.NewFile(uintptr(fd), filepath.Join(root, name)), nil
+		default:
+			syscall.Close(fd)
+			return nil, pathErr(errNotRegular)
+		}
+	}
+
+	// it's a directory, hand over the one we ended up in
+	fd := dirs[len(dirs)-1]
+	dirs = dirs[:len(dirs)-1]
+	return os.NewFile(uintptr(fd), filepath.Join(root, name)), nil
+}
+
+// readInRoot reads the regular file at name, resolved within root (see
+// openInRoot)
+func readInRoot(root string, name string) ([]byte, error) {
+	file, err := openInRoot(root, name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, &os.PathError{Op: "read", Path: file.Name(), Err: syscall.EISDIR}
+	}
+	return ioutil.ReadAll(file)
+}
+
+// copyDirInRoot copies the regular files in the directory at name, resolved
+// within root, to dest. Anything else in there (or that we can't open) is
+// skipped.
+func copyDirInRoot(root string, name string, dest string) error {
+	dir, err := openInRoot(root, name)
+	if err != nil {
+		return err
+	}
+	entries, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		file, err := openInRoot(root, filepath.Join(name, entry))
+		if err != nil {
+			continue
+		}
+
+		info, err := file.Stat()
+		if err == nil && info.Mode().IsRegular() {
+			err = copyFile(file, filepath.Join(dest, entry))
+		} else {
+			err = nil
+		}
+		file.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(file *os.File, dest string) error {
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, file)
+	return err
+}
@@ -0,0 +1,331 @@
+package agent
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Nested jars (as in spring boot's fat jars) get read into memory, so only up
+// to this size
+const maxNestedJarSize = 64 * 1024 * 1024
+
+// What a jar file holds, as of its mtime
+type jarContents struct {
+	modified time.Time
+	deps     []loadedDependency
+}
+
+// JVM options that take their value as the next argument
+var jvmValueOptions = map[string]bool{
+	"--add-exports": true, "--add-modules": true, "--add-opens": true, "--add-reads": true,
+	"--limit-modules": true, "--module": true, "-m": true, "--patch-module": true,
+	"--upgrade-module-path": true,
+}
+
+// isJVM tells whether a process we don't know by its executable (a launcher
+// that embeds the JVM, say) has one loaded
+func isJVM(pid int) bool {
+	paths, _ := processMaps(pid)
+	for _, path := range paths {
+		if filepath.Base(path) == "libjvm.so" {
+			return true
+		}
+	}
+	return false
+}
+
+// jvmDependencies lists what's in the jars a JVM has open or on its class and
+// module paths, by their Maven coordinates (group:artifact).
+func (pw *processWatcher) jvmDependencies(pid int) []loadedDependency {
+	jars := map[string]bool{}
+
+	open, _ := processOpenFiles(pid)
+	for _, path := range open {
+		if isJar(path) {
+			jars[path] = true
+		}
+	}
+	for _, path := range jvmClasspath(pid) {
+		jars[path] = true
+	}
+
+	found := map[string]loadedDependency{}
+	for _, jar := range sortedKeys(jars) {
+		for _, dep := range pw.jarDependencies(pid, jar) {
+			key := dep.Name + "@" + dep.Version
+			if _, ok := found[key]; !ok {
+				found[key] = dep
+			}
+		}
+	}
+
+	deps := make([]loadedDependency, 0, len(found))
+	for _, dep := range found {
+		deps = append(deps, dep)
+	}
+	sort.Sort(byDependencyName(deps))
+	return deps
+}
+
+func isJar(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".jar" || ext == ".war"
+}
+
+// jvmClasspath works out the jars on a JVM's class and module paths from its
+// command line (or failing that, its CLASSPATH), as the process sees them
+func jvmClasspath(pid int) []string {
+	args, err := processCmdline(pid)
+	if err != nil || len(args) == 0 {
+		return nil
+	}
+
+	var entries []string
+	classpathGiven := false
+
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-cp" || arg == "-classpath" || arg == "--class-path":
+			if i+1 < len(args) {
+				entries = append(entries, strings.Split(args[i+1], ":")...)
+				i++
+			}
+			classpathGiven = true
+		case strings.HasPrefix(arg, "--class-path="):
+			entries = append(entries, strings.Split(strings.TrimPrefix(arg, "--class-path="), ":")...)
+			classpathGiven = true
+		case arg == "-p" || arg == "--module-path":
+			if i+1 < len(args) {
+				entries = append(entries, strings.Split(args[i+1], ":")...)
+				i++
+			}
+		case strings.HasPrefix(arg, "--module-path="):
+			entries = append(entries, strings.Split(strings.TrimPrefix(arg, "--module-path="), ":")...)
+		case arg == "-jar":
+			// the jar is the classpath, and what follows is the program's
+			if i+1 < len(args) {
+				entries = append(entries, args[i+1])
+			}
+			classpathGiven = true
+			i = len(args)
+		case jvmValueOptions[arg]:
+			i++
+		case !strings.HasPrefix(arg, "-"):
+			// the main class; what follows is the program's
+			i = len(args)
+		}
+	}
+
+	if !classpathGiven {
+		entries = append(entries, strings.Split(processEnv(pid, "CLASSPATH"), ":")...)
+	}
+
+	cwd, _ := processCwd(pid)
+	jars := []string{}
+	for _, entry := range entries {
+		if entry == "" {
+			continue
+		}
+		if !filepath.IsAbs(entry) {
+			entry = filepath.Join(cwd, entry)
+		}
+
+		// dir/* is every jar in dir
+		if filepath.Base(entry) == "*" {
+			dir := filepath.Dir(entry)
+			files, _ := ioutil.ReadDir(processPath(pid, dir))
+			for _, file := range files {
+				if isJar(file.Name()) {
+					jars = append(jars, filepath.Join(dir, file.Name()))
+				}
+			}
+			continue
+		}
+
+		if isJar(entry) {
+			jars = append(jars, entry)
+		}
+	}
+	return jars
+}
+
+// jarDependencies reads what's in a jar, unless we did since it last changed.
+func (pw *processWatcher) jarDependencies(pid int, jar string) []loadedDependency {
+	file := processPath(pid, jar)
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil
+	}
+
+	// like site-packages, the same jar may be used by many processes
+	key := file
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		key = fmt.Sprintf("%d:%d", stat.Dev, stat.Ino)
+	}
+	pw.jarsSeen[key] = true
+
+	if cached, ok := pw.jarCache[key]; ok && cached.modified.Equal(info.ModTime()) {
+		return cached.deps
+	}
+
+	var deps []loadedDependency
+	if archive, err := zip.OpenReader(file); err == nil {
+		deps = archiveDependencies(&archive.Reader, jar)
+		archive.Close()
+	}
+
+	pw.jarCache[key] = jarContents{modified: info.ModTime(), deps: deps}
+	return deps
+}
+
+// archiveDependencies reads the Maven coordinates out of a jar: every
+// pom.properties in it (shaded jars have many), or else its manifest, or
+// else its file name. Jars nested in it (in BOOT-INF/lib or WEB-INF/lib) get
+// read too.
+func archiveDependencies(archive *zip.Reader, name string) []loadedDependency {
+	deps := []loadedDependency{}
+	var manifest *zip.File
+
+	for _, entry := range archive.File {
+		switch {
+		case strings.HasPrefix(entry.Name, "META-INF/maven/") && path.Base(entry.Name) == "pom.properties":
+			if dep, ok := pomDependency(entry, name); ok {
+				deps = append(deps, dep)
+			}
+		case entry.Name == "META-INF/MANIFEST.MF":
+			manifest = entry
+		}
+	}
+
+	if len(deps) == 0 && manifest != nil {
+		if dep, ok := manifestDependency(manifest, name); ok {
+			deps = append(deps, dep)
+		}
+	}
+	if len(deps) == 0 {
+		if artifact, version, ok := splitGemDir(strings.TrimSuffix(path.Base(name), path.Ext(name))); ok {
+			deps = append(deps, loadedDependency{Name: artifact, Version: version, Path: name})
+		}
+	}
+
+	for _, entry := range archive.File {
+		dir := path.Dir(entry.Name)
+		if (dir != "BOOT-INF/lib" && dir != "WEB-INF/lib") || !isJar(entry.Name) {
+			continue
+		}
+		if entry.UncompressedSize64 > maxNestedJarSize {
+			continue
+		}
+
+		contents, err := readZipEntry(entry)
+		if err != nil {
+			continue
+		}
+		nested, err := zip.NewReader(bytes.NewReader(contents), int64(len(contents)))
+		if err != nil {
+			continue
+		}
+		deps = append(deps, archiveDependencies(nested, name+"!/"+entry.Name)...)
+	}
+
+	return deps
+}
+
+func pomDependency(entry *zip.File, jar string) (loadedDependency, bool) {
+	contents, err := readZipEntry(entry)
+	if err != nil {
+		return loadedDependency{}, false
+	}
+
+	props := parseProperties(contents, "=")
+	group, artifact, version := props["groupId"], props["artifactId"], props["version"]
+	if artifact == "" || version == "" {
+		return loadedDependency{}, false
+	}
+	return loadedDependency{Name: group + ":" + artifact, Version: version, Path: jar}, true
+}
+
+// Manifests say what they are in a few different ways; OSGi bundles' names
+// are the closest to Maven coordinates.
+func manifestDependency(entry *zip.File, jar string) (loadedDependency, bool) {
+	contents, err := readZipEntry(entry)
+	if err != nil {
+		return loadedDependency{}, false
+	}
+
+	attrs := parseProperties(contents, ":")
+	for _, pair := range [][2]string{
+		{"Bundle-SymbolicName", "Bundle-Version"},
+		{"Implementation-Title", "Implementation-Version"},
+		{"Specification-Title", "Specification-Version"},
+	} {
+		name := strings.TrimSpace(strings.SplitN(attrs[pair[0]], ";", 2)[0])
+		version := attrs[pair[1]]
+		if name == "" || version == "" {
+			continue
+		}
+
+		if vendor := attrs["Implementation-Vendor-Id"]; vendor != "" && pair[0] == "Implementation-Title" {
+			name = vendor + ":" + name
+		}
+		return loadedDependency{Name: name, Version: version, Path: jar}, true
+	}
+	return loadedDependency{}, false
+}
+
+// key=value (or key: value) lines, skipping comments. Manifest lines that
+// start with a space continue the previous one.
+func parseProperties(contents []byte, separator string) map[string]string {
+	props := map[string]string{}
+	lastKey := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(line, " ") && lastKey != "" {
+			props[lastKey] += line[1:]
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		field := strings.SplitN(line, separator, 2)
+		if len(field) != 2 {
+			continue
+		}
+		lastKey = strings.TrimSpace(field[0])
+		props[lastKey] = strings.TrimSpace(field[1])
+	}
+	return props
+}
+
+func readZipEntry(entry *zip.File) ([]byte, error) {
+	reader, err := entry.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(io.LimitReader(reader, maxNestedJarSize))
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/appcanary/agent/conf"
+	"github.com/appcanary/testify/assert"
+)
+
+// a jar with the given files in it
+func makeJar(assert *assert.Assertions, files map[string][]byte) []byte {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for name, contents := range files {
+		w, err := archive.Create(name)
+		assert.Nil(err)
+		w.Write(contents)
+	}
+	assert.Nil(archive.Close())
+	return buf.Bytes()
+}
+
+func TestJVMDependencies(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	dir, _ := ioutil.TempDir("", "canaryjvm")
+	defer os.RemoveAll(dir)
+	procRoot = dir
+	defer func() { procRoot = "/proc" }()
+
+	write := func(path string, contents []byte) {
+		path = filepath.Join(dir, path)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, contents, 0644)
+	}
+	link := func(path string, target string) {
+		path = filepath.Join(dir, path)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.Symlink(target, path)
+	}
+
+	guava := makeJar(assert, map[string][]byte{
+		"META-INF/MANIFEST.MF":                                         []byte("Manifest-Version: 1.0\n"),
+		"META-INF/maven/com.google.guava/guava/pom.properties":         []byte("#Created by Maven\ngroupId=com.google.guava\nartifactId=guava\nversion=32.1.2-jre\n"),
+		"com/google/common/base/Strings.class":                         []byte{},
+		"META-INF/maven/com.google.guava/failureaccess/pom.xml":        []byte("<project/>"),
+		"META-INF/maven/com.google.guava/failureaccess/pom.properties": []byte("groupId=com.google.guava\nartifactId=failureaccess\nversion=1.0.1\n"),
+	})
+	bundle := makeJar(assert, map[string][]byte{
+		"META-INF/MANIFEST.MF": []byte("Manifest-Version: 1.0\r\nBundle-SymbolicName: org.apache.commons.t\r\n ext;singleton:=true\r\nBundle-Version: 1.10.0\r\n"),
+	})
+	plain := makeJar(assert, map[string][]byte{"Plain.class": []byte{}})
+	fat := makeJar(assert, map[string][]byte{
+		"META-INF/MANIFEST.MF": []byte("Implementation-Title: shop\nImplementation-Version: 0.0.1-SNAPSHOT\n"),
+		"BOOT-INF/lib/jackson-databind-2.15.2.jar": makeJar(assert, map[string][]byte{
+			"META-INF/maven/com.fasterxml.jackson.core/jackson-databind/pom.properties": []byte("groupId=com.fasterxml.jackson.core\nartifactId=jackson-databind\nversion=2.15.2\n"),
+		}),
+	})
+
+	// java -cp lib/*:classes -Xmx1g com.example.Main --port 8080, run from /srv/app
+	write("10/cmdline", []byte("java\x00-cp\x00lib/*:classes\x00-Xmx1g\x00com.example.Main\x00-jar\x00not-this.jar\x00"))
+	link("10/cwd", "/srv/app")
+	write("10/root/srv/app/lib/guava-32.1.2-jre.jar", guava)
+	write("10/root/srv/app/lib/commons-text.jar", bundle)
+	write("10/root/srv/app/lib/plain-1.2.jar", plain)
+	write("10/root/srv/app/lib/README", []byte("not a jar\n"))
+
+	// java -jar /opt/shop/shop.jar, with its jar open
+	write("20/cmdline", []byte("/usr/lib/jvm/java-17/bin/java\x00-jar\x00/opt/shop/shop.jar\x00"))
+	link("20/fd/3", "/opt/shop/shop.jar")
+	write("20/root/opt/shop/shop.jar", fat)
+
+	pw := NewProcessWatcher("*", testCallbackNOP).(*processWatcher)
+	lib := "/srv/app/lib/"
+	assert.Equal([]loadedDependency{
+		{Name: "com.google.guava:failureaccess", Version: "1.0.1", Path: lib + "guava-32.1.2-jre.jar"},
+		{Name: "com.google.guava:guava", Version: "32.1.2-jre", Path: lib + "guava-32.1.2-jre.jar"},
+		{Name: "org.apache.commons.text", Version: "1.10.0", Path: lib + "commons-text.jar"},
+		{Name: "plain", Version: "1.2", Path: lib + "plain-1.2.jar"},
+	}, pw.jvmDependencies(10))
+	assert.Equal(3, len(pw.jarCache))
+
+	assert.Equal([]loadedDependency{
+		{Name: "com.fasterxml.jackson.core:jackson-databind", Version: "2.15.2", Path: "/opt/shop/shop.jar!/BOOT-INF/lib/jackson-databind-2.15.2.jar"},
+		{Name: "shop", Version: "0.0.1-SNAPSHOT", Path: "/opt/shop/shop.jar"},
+	}, pw.loadedDependencies(20, "java", time.Now()))
+
+	assert.Equal("java", processLanguage("/usr/lib/jvm/java-17/bin/java"))
+}
@@ -0,0 +1,231 @@
+package agent
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/appcanary/agent/conf"
+)
+
+// where installed kernels and the reboot flag can be found
+var (
+	bootDir            = "/boot"
+	modulesDir         = "/lib/modules"
+	rebootRequiredFile = "/var/run/reboot-required"
+)
+
+// Which kernel we're running, which ones are installed, and whether the
+// system says it's due a reboot
+type kernelState struct {
+	Running        string   // e.g. 5.15.0-91-generic
+	Version        string   // the running kernel's build, per uname -v
+	Installed      []string // oldest first
+	Newest         string
+	Outdated       bool // running something older than the newest installed
+	RebootRequired bool
+	RebootPackages []string // what asked for it, where we know
+}
+
+func (ks *kernelState) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"running":         ks.Running,
+		"version":         ks.Version,
+		"installed":       ks.Installed,
+		"newest":          ks.Newest,
+		"outdated":        ks.Outdated,
+		"reboot_required": ks.RebootRequired,
+		"reboot_packages": ks.RebootPackages,
+	}
+}
+
+func acquireKernelState() *kernelState {
+	ks := &kernelState{Installed: installedKernels()}
+
+	release, _ := ioutil.ReadFile(filepath.Join(procRoot, "sys", "kernel", "osrelease"))
+	ks.Running = strings.TrimSpace(string(release))
+	version, _ := ioutil.ReadFile(filepath.Join(procRoot, "sys", "kernel", "version"))
+	ks.Version = strings.TrimSpace(string(version))
+
+	if len(ks.Installed) > 0 {
+		ks.Newest = ks.Installed[len(ks.Installed)-1]
+		ks.Outdated = ks.Running != "" && compareKernelVersions(ks.Running, ks.Newest) < 0
+	}
+
+	// debian and friends leave a flag (and the packages that raised it);
+	// on rpm systems, dnf-utils can tell us
+	if _, err := os.Stat(rebootRequiredFile); err == nil {
+		ks.RebootRequired = true
+		pkgs, _ := ioutil.ReadFile(rebootRequiredFile + ".pkgs")
+		ks.RebootPackages = uniqueLines(string(pkgs))
+	} else {
+		ks.RebootRequired = rebootNeeded()
+	}
+
+	return ks
+}
+
+// installedKernels lists the kernel versions with an image in /boot or, as
+// newer Fedoras keep them, in /lib/modules/<version>/vmlinuz
+func installedKernels() []string {
+	found := map[string]bool{}
+
+	images, _ := filepath.Glob(filepath.Join(bootDir, "vmlinuz-*"))
+	for _, image := range images {
+		version := strings.TrimPrefix(filepath.Base(image), "vmlinuz-")
+		// rescue images aren't kernels anyone runs on purpose
+		if !strings.Contains(version, "rescue") {
+			found[version] = true
+		}
+	}
+
+	images, _ = filepath.Glob(filepath.Join(modulesDir, "*", "vmlinuz"))
+	for _, image := range images {
+		found[filepath.Base(filepath.Dir(image))] = true
+	}
+
+	versions := make([]string, 0, len(found))
+	for version := range found {
+		versions = append(versions, version)
+	}
+	sort.Sort(byKernelVersion(versions))
+	return versions
+}
+
+// compareKernelVersions compares versions like 5.15.0-91-generic and
+// 5.15.0-101-generic, or 5.14.0-362.8.1.el9_3.x86_64, number by number
+func compareKernelVersions(a string, b string) int {
+	as, bs := versionRuns(a), versionRuns(b)
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, y := as[i], bs[i]
+		xNum, yNum := isDigits(x), isDigits(y)
+
+		switch {
+		case xNum && yNum:
+			x, y = strings.TrimLeft(x, "0"), strings.TrimLeft(y, "0")
+			if len(x) != len(y) {
+				if len(x) < len(y) {
+					return -1
+				}
+				return 1
+			}
+		case xNum:
+			return 1
+		case yNum:
+			return -1
+		}
+
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(as) - len(bs)
+}
+
+// "5.15.0-91-generic" => 5 15 0 91 generic
+func versionRuns(version string) []string {
+	runs := []string{}
+	start := -1
+	for i := 0; i <= len(version); i++ {
+		if i < len(version) && isAlnum(version[i]) {
+			if start >= 0 && isDigit(version[start]) != isDigit(version[i]) {
+				runs = append(runs, version[start:i])
+				start = i
+			} else if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			runs = append(runs, version[start:i])
+			start = -1
+		}
+	}
+	return runs
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isAlnum(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isDigit(s[i]) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func uniqueLines(text string) []string {
+	seen := map[string]bool{}
+	lines := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !seen[line] {
+			seen[line] = true
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Every process scan wants to know too, and running needs-restarting on each
+// is a lot more than what changes in between warrants
+var rebootNeededCache struct {
+	sync.Mutex
+	checkedAt time.Time
+	needed    bool
+}
+
+// rebootNeeded is what needsRestarting last said, unless that's too long ago.
+// Callers wait on whoever's asking already rather than ask again.
+func rebootNeeded() bool {
+	rebootNeededCache.Lock()
+	defer rebootNeededCache.Unlock()
+
+	if time.Since(rebootNeededCache.checkedAt) >= conf.NEEDS_RESTARTING_TTL {
+		rebootNeededCache.needed = needsRestarting()
+		rebootNeededCache.checkedAt = time.Now()
+	}
+	return rebootNeededCache.needed
+}
+
+// needsRestarting asks dnf-utils' needs-restarting, which exits with 1 when a
+// reboot is due. Without it, or if it doesn't answer in time, we can't tell.
+var needsRestarting = func() bool {
+	log := conf.FetchLog()
+
+	path, err := exec.LookPath("needs-restarting")
+	if err != nil {
+		return false
+	}
+
+	cmd := &command{Name: path, Args: []string{"-r"}, Timeout: conf.NEEDS_RESTARTING_TIMEOUT}
+	_, err = cmd.Output()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return true
+	}
+	if err != nil {
+		log.Debugf("Can't tell whether a reboot's due: %s", err)
+	}
+	return false
+}
+
+type byKernelVersion []string
+
+func (s byKernelVersion) Len() int           { return len(s) }
+func (s byKernelVersion) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byKernelVersion) Less(i, j int) bool { return compareKernelVersions(s[i], s[j]) < 0 }
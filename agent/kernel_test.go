@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/appcanary/agent/conf"
+	"github.com/appcanary/testify/assert"
+)
+
+func TestCompareKernelVersions(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(compareKernelVersions("5.15.0-91-generic", "5.15.0-101-generic") < 0)
+	assert.True(compareKernelVersions("6.1.0-13-amd64", "5.10.0-26-amd64") > 0)
+	assert.True(compareKernelVersions("5.14.0-362.8.1.el9_3.x86_64", "5.14.0-362.13.1.el9_3.x86_64") < 0)
+	assert.True(compareKernelVersions("5.14.0-362.el9.x86_64", "5.14.0-362.8.1.el9_3.x86_64") < 0)
+	assert.Equal(0, compareKernelVersions("5.15.0-91-generic", "5.15.0-91-generic"))
+}
+
+func TestKernelState(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	dir, _ := ioutil.TempDir("", "canarykernel")
+	defer os.RemoveAll(dir)
+
+	write := func(path string, contents string) {
+		path = filepath.Join(dir, path)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, []byte(contents), 0644)
+	}
+
+	procRoot = filepath.Join(dir, "proc")
+	bootDir = filepath.Join(dir, "boot")
+	modulesDir = filepath.Join(dir, "lib/modules")
+	rebootRequiredFile = filepath.Join(dir, "run/reboot-required")
+	realNeedsRestarting := needsRestarting
+	asked := 0
+	needsRestarting = func() bool {
+		asked++
+		return false
+	}
+	rebootNeededCache.checkedAt = time.Time{}
+	defer func() {
+		rebootNeededCache.checkedAt = time.Time{}
+		needsRestarting = realNeedsRestarting
+		procRoot = "/proc"
+		bootDir = "/boot"
+		modulesDir = "/lib/modules"
+		rebootRequiredFile = "/var/run/reboot-required"
+	}()
+
+	write("proc/sys/kernel/osrelease", "5.15.0-91-generic\n")
+	write("proc/sys/kernel/version", "#101-Ubuntu SMP Tue Nov 14 13:30:08 UTC 2023\n")
+	write("boot/vmlinuz-5.15.0-91-generic", "")
+	write("boot/vmlinuz-0-rescue-abcdef", "")
+	write("lib/modules/5.15.0-101-generic/vmlinuz", "")
+	write("lib/modules/5.15.0-88-generic/modules.dep", "")
+
+	ks := acquireKernelState()
+	assert.Equal("5.15.0-91-generic", ks.Running)
+	assert.Equal([]string{"5.15.0-91-generic", "5.15.0-101-generic"}, ks.Installed)
+	assert.Equal("5.15.0-101-generic", ks.Newest)
+	assert.True(ks.Outdated)
+	assert.False(ks.RebootRequired)
+
+	// needs-restarting gets asked once in a while, not on every scan
+	acquireKernelState()
+	assert.Equal(1, asked)
+
+	changes := make(chan Watcher, 10)
+	watcher := NewKernelWatcher(func(w Watcher) { changes <- w }).(*kernelWatcher)
+
+	// the upgrade that put the new kernel in place wants a reboot
+	write("run/reboot-required", "*** System restart required ***\n")
+	write("run/reboot-required.pkgs", "linux-image-5.15.0-101-generic\nlinux-base\nlinux-base\n")
+	watcher.scan()
+	select {
+	case <-changes:
+	case <-time.After(time.Second):
+		t.Error("no change after a reboot got required")
+	}
+
+	var shipped map[string]interface{}
+	data, err := watcher.MarshalJSON()
+	assert.Nil(err)
+	assert.Nil(json.Unmarshal(data, &shipped))
+	kernel := shipped["kernel"].(map[string]interface{})
+	assert.Equal(true, kernel["reboot_required"])
+	assert.Equal([]interface{}{"linux-image-5.15.0-101-generic", "linux-base"}, kernel["reboot_packages"])
+	assert.True(watcher.KernelState().RebootRequired)
+
+	// only kernel watchers get handled as such
+	var other Watcher = NewImageWatcher(filepath.Join(dir, "image.tar"), testCallbackNOP)
+	_, ok := other.(KernelWatcher)
+	assert.False(ok)
+
+	watcher.scan()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(0, len(changes))
+
+	// and the process map says what it's all running on
+	pw := NewProcessWatcher("*", testCallbackNOP, conf.WatcherConf{Exe: "^/nonexistent/"}).(*processWatcher)
+	var state map[string]map[string]map[string]interface{}
+	assert.Nil(json.Unmarshal(pw.StateJson(), &state))
+	assert.Equal("5.15.0-91-generic", state["server"]["kernel"]["running"])
+	assert.Equal(true, state["server"]["kernel"]["outdated"])
+}
@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/appcanary/agent/conf"
+)
+
+type KernelWatcher interface {
+	Start()
+	Stop()
+	KernelState() kernelState
+	MarshalJSON() ([]byte, error)
+}
+
+// Kernel watchers keep track of whether the kernel we're running is the newest
+// one installed, and whether the system wants a reboot. What they find goes
+// out with the heartbeat, so it's shipped whenever it changes.
+type kernelWatcher struct {
+	sync.Mutex
+	keepPolling  bool
+	UpdatedAt    time.Time
+	BeingWatched bool
+	OnChange     ChangeHandler
+	state        *kernelState
+	pollSleep    time.Duration
+	pollJitter   time.Duration
+	stop         chan bool
+}
+
+func NewKernelWatcher(callback ChangeHandler, settings ...conf.WatcherConf) Watcher {
+	env := conf.FetchEnv()
+	setting := watcherSettings(settings)
+
+	watcher := &kernelWatcher{
+		OnChange:  callback,
+		UpdatedAt: time.Now(),
+	}
+	watcher.pollSleep, watcher.pollJitter = pollTimes(setting, env.PollSleep)
+	watcher.state = acquireKernelState()
+	watcher.BeingWatched = true
+	return watcher
+}
+
+func (kw *kernelWatcher) MarshalJSON() ([]byte, error) {
+	kw.Lock()
+	defer kw.Unlock()
+	return json.Marshal(map[string]interface{}{
+		"kind":          "kernel",
+		"kernel":        kw.state.toMap(),
+		"updated-at":    kw.UpdatedAt,
+		"being-watched": kw.BeingWatched,
+	})
+}
+
+// KernelState is what the kernel watcher last found
+func (kw *kernelWatcher) KernelState() kernelState {
+	kw.Lock()
+	defer kw.Unlock()
+	return *kw.state
+}
+
+func (kw *kernelWatcher) KeepPolling() bool {
+	kw.Lock()
+	defer kw.Unlock()
+	return kw.keepPolling
+}
+
+func (kw *kernelWatcher) Start() {
+	kw.Lock()
+	if kw.keepPolling {
+		kw.Unlock()
+		return
+	}
+	kw.keepPolling = true
+	kw.stop = make(chan bool)
+	stop := kw.stop
+	kw.Unlock()
+	go kw.listen(stop)
+}
+
+func (kw *kernelWatcher) Stop() {
+	kw.Lock()
+	if kw.keepPolling {
+		close(kw.stop)
+	}
+	kw.keepPolling = false
+	kw.Unlock()
+}
+
+func (kw *kernelWatcher) scan() {
+	state := acquireKernelState()
+
+	kw.Lock()
+	changed := !reflect.DeepEqual(state, kw.state)
+	if changed {
+		kw.state = state
+		kw.UpdatedAt = time.Now()
+	}
+	kw.Unlock()
+
+	if changed {
+		go kw.OnChange(kw)
+	}
+}
+
+func (kw *kernelWatcher) listen(stop chan bool) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(nextPoll(kw.pollSleep, kw.pollJitter)):
+		}
+
+		if !kw.KeepPolling() {
+			return
+		}
+		kw.scan()
+	}
+}
@@ -0,0 +1,164 @@
+package agent
+
+import (
+	"bytes"
+	"path/filepath"
+	"sync"
+)
+
+// A KindDetector recognises one kind of file, first by its name and failing
+// that, by sniffing its contents. Either field may be left out.
+type KindDetector struct {
+	Kind  string
+	Names []string // patterns for the base name, as in filepath.Match
+	Sniff func(contents []byte) bool
+}
+
+var kindDetectors struct {
+	sync.Mutex
+	list []KindDetector
+}
+
+// RegisterKind adds a detector. Detectors are consulted in the order they were
+// registered, so more specific ones should go first.
+func RegisterKind(detector KindDetector) {
+	kindDetectors.Lock()
+	defer kindDetectors.Unlock()
+	kindDetectors.list = append(kindDetectors.list, detector)
+}
+
+func registeredKinds() []KindDetector {
+	kindDetectors.Lock()
+	defer kindDetectors.Unlock()
+	return append([]KindDetector{}, kindDetectors.list...)
+}
+
+// KindByName returns the kind of file path going by its name alone, or "" if
+// we can't tell.
+func KindByName(path string) string {
+	name := filepath.Base(path)
+	for _, detector := range registeredKinds() {
+		for _, pattern := range detector.Names {
+			if ok, _ := filepath.Match(pattern, name); ok {
+				return detector.Kind
+			}
+		}
+	}
+	return ""
+}
+
+// DetectKind returns the kind of file path, looking at its contents if the
+// name isn't conclusive, or "" if we can't tell.
+func DetectKind(path string, contents []byte) string {
+	if kind := KindByName(path); kind != "" {
+		return kind
+	}
+
+	for _, detector := range registeredKinds() {
+		if detector.Sniff != nil && detector.Sniff(contents) {
+			return detector.Kind
+		}
+	}
+	return ""
+}
+
+// true if contents start with prefix, ignoring leading whitespace
+func startsWith(prefix string) func([]byte) bool {
+	return func(contents []byte) bool {
+		return bytes.HasPrefix(bytes.TrimSpace(contents), []byte(prefix))
+	}
+}
+
+// true if contents contain every one of the markers
+func containsAll(markers ...string) func([]byte) bool {
+	return func(contents []byte) bool {
+		for _, marker := range markers {
+			if !bytes.Contains(contents, []byte(marker)) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func init() {
+	// the kinds the server has always known about
+	RegisterKind(KindDetector{
+		Kind:  "gemfile",
+		Names: []string{"Gemfile.lock", "gems.locked"},
+		Sniff: containsAll("GEM\n", "specs:", "DEPENDENCIES"),
+	})
+	RegisterKind(KindDetector{
+		//todo support debian
+		Kind:  "ubuntu",
+		Names: []string{"available", "status"},
+		Sniff: func(contents []byte) bool {
+			return startsWith("Package: ")(contents) && containsAll("\nVersion: ")(contents)
+		},
+	})
+
+	RegisterKind(KindDetector{
+		// apk's database has no name of its own to speak of
+		Kind:  "alpine",
+		Sniff: startsWith("C:Q1"),
+	})
+	RegisterKind(KindDetector{
+		Kind:  "npm",
+		Names: []string{"package-lock.json", "npm-shrinkwrap.json"},
+		Sniff: func(contents []byte) bool {
+			return startsWith("{")(contents) && containsAll(`"lockfileVersion"`)(contents)
+		},
+	})
+	RegisterKind(KindDetector{
+		Kind:  "yarn",
+		Names: []string{"yarn.lock"},
+		Sniff: containsAll("# yarn lockfile v1"),
+	})
+	RegisterKind(KindDetector{
+		Kind:  "pnpm",
+		Names: []string{"pnpm-lock.yaml"},
+		Sniff: startsWith("lockfileVersion:"),
+	})
+	RegisterKind(KindDetector{
+		Kind:  "pipfile",
+		Names: []string{"Pipfile.lock"},
+		Sniff: func(contents []byte) bool {
+			return startsWith("{")(contents) && containsAll(`"_meta"`, `"pipfile-spec"`)(contents)
+		},
+	})
+	RegisterKind(KindDetector{
+		Kind:  "poetry",
+		Names: []string{"poetry.lock"},
+		Sniff: containsAll("@generated by Poetry"),
+	})
+	RegisterKind(KindDetector{
+		Kind:  "pip",
+		Names: []string{"requirements*.txt", "constraints*.txt"},
+	})
+	RegisterKind(KindDetector{
+		Kind:  "composer",
+		Names: []string{"composer.lock"},
+		Sniff: func(contents []byte) bool {
+			return startsWith("{")(contents) && containsAll(`"content-hash"`, `"packages"`)(contents)
+		},
+	})
+	RegisterKind(KindDetector{
+		Kind:  "gomod",
+		Names: []string{"go.sum", "go.mod"},
+	})
+	RegisterKind(KindDetector{
+		Kind:  "cargo",
+		Names: []string{"Cargo.lock"},
+		Sniff: containsAll("@generated by Cargo"),
+	})
+	RegisterKind(KindDetector{
+		Kind:  "maven",
+		Names: []string{"pom.xml"},
+		Sniff: containsAll("<project", "maven.apache.org/POM"),
+	})
+	RegisterKind(KindDetector{
+		Kind:  "gradle",
+		Names: []string{"gradle.lockfile", "*.lockfile"},
+		Sniff: startsWith("# This is a Gradle generated file for dependency locking."),
+	})
+}
@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/appcanary/agent/conf"
+	"github.com/appcanary/testify/assert"
+)
+
+func TestKindByName(t *testing.T) {
+	assert := assert.New(t)
+
+	for path, kind := range map[string]string{
+		"/app/Gemfile.lock":                       "gemfile",
+		"/var/lib/dpkg/status":                    "ubuntu",
+		"/app/package-lock.json":                  "npm",
+		"/app/yarn.lock":                          "yarn",
+		"/app/pnpm-lock.yaml":                     "pnpm",
+		"/app/requirements-dev.txt":               "pip",
+		"/app/Pipfile.lock":                       "pipfile",
+		"/app/poetry.lock":                        "poetry",
+		"/app/composer.lock":                      "composer",
+		"/app/go.sum":                             "gomod",
+		"/app/Cargo.lock":                         "cargo",
+		"/app/pom.xml":                            "maven",
+		"/app/gradle.lockfile":                    "gradle",
+		"/app/gradle/dependency-locks/x.lockfile": "gradle",
+		"/app/README.md":                          "",
+	} {
+		assert.Equal(kind, KindByName(path), path)
+	}
+}
+
+func TestDetectKind(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	gemfile, _ := ioutil.ReadFile(conf.DEV_CONF_PATH + "/Gemfile.lock")
+	assert.Equal("gemfile", DetectKind("/app/deps.lock", gemfile))
+
+	assert.Equal("npm", DetectKind("/app/lock.json", []byte(`{"name": "app", "lockfileVersion": 2}`)))
+	assert.Equal("cargo", DetectKind("/app/deps.lock", []byte("# This file is automatically @generated by Cargo.\n")))
+	assert.Equal("", DetectKind("/app/deps.lock", []byte("nothing to see here")))
+
+	// the name wins over the contents
+	assert.Equal("yarn", DetectKind("/app/yarn.lock", gemfile))
+}
+
+func TestFileWatcherKind(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	dir, _ := ioutil.TempDir("", "canarykinds")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "deps.lock")
+	ioutil.WriteFile(path, []byte("# yarn lockfile v1\n"), 0644)
+
+	// sniffed from the contents
+	wfile := NewFileWatcher(path, testCallbackNOP).(TextWatcher)
+	assert.Equal("yarn", wfile.Kind())
+
+	// the configuration has the last word
+	wfile = NewFileWatcher(path, testCallbackNOP, conf.WatcherConf{Kind: "npm"}).(TextWatcher)
+	assert.Equal("npm", wfile.Kind())
+}
@@ -0,0 +1,406 @@
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A gem, python package or jar a running interpreter (or JVM) has loaded
+type loadedDependency struct {
+	Name    string
+	Version string
+	Path    string // where it's installed (or the jar, or the lockfile), as the process sees it
+	Native  bool   // whether it's got a compiled extension mapped in
+}
+
+// e.g. ruby, ruby3.1, python3, python3.11, java
+var interpreterPattern = regexp.MustCompile(`^(ruby|python|java)[0-9.]*$`)
+
+// processLanguage tells which interpreter (if any) an executable is
+func processLanguage(exe string) string {
+	match := interpreterPattern.FindStringSubmatch(filepath.Base(exe))
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// A site-packages directory's distributions, by the top level module they
+// install, as of the directory's mtime
+type sitePackages struct {
+	modified      time.Time
+	modules       map[string]loadedDependency
+	distributions []siteDistribution
+}
+
+// A distribution installed in site-packages, and when its metadata was written
+type siteDistribution struct {
+	dep       loadedDependency
+	installed time.Time
+}
+
+// e.g. "    nokogiri (1.15.4-x86_64-linux)", a gem in one of a lockfile's specs
+var lockfileSpecPattern = regexp.MustCompile(`^    ([^ ]+) \(([^)]+)\)$`)
+
+// loadedDependencies works out which gems or python packages an interpreter
+// has loaded. Native extensions stay mapped and whatever it's reading right
+// now is open, but pure ruby and python files are closed once they're loaded,
+// so for those we go by what the process runs with: the bundle in (or
+// configured for) its working directory, or the site-packages of its
+// virtualenv. Those only count as of when the process started; a lockfile or
+// distribution that changed since says what it'll load next time, and
+// whatever it's still holding on to from before shows up in its maps.
+func (pw *processWatcher) loadedDependencies(pid int, language string, started time.Time) []loadedDependency {
+	if language == "java" {
+		return pw.jvmDependencies(pid)
+	}
+
+	mapped, _ := processMaps(pid)
+	open, _ := processOpenFiles(pid)
+
+	found := map[string]loadedDependency{}
+	note := func(path string, native bool) {
+		var dep loadedDependency
+		var ok bool
+		switch language {
+		case "ruby":
+			dep, ok = gemFromPath(path)
+		case "python":
+			dep, ok = pw.pythonPackageFromPath(pid, path)
+		}
+		if !ok {
+			return
+		}
+
+		key := dep.Name + "@" + dep.Version
+		if seen, ok := found[key]; ok {
+			native = native || seen.Native
+		}
+		dep.Native = native
+		found[key] = dep
+	}
+
+	for _, path := range mapped {
+		note(path, isNativeExtension(path))
+	}
+	for _, path := range open {
+		note(path, false)
+	}
+
+	var environment []loadedDependency
+	switch language {
+	case "ruby":
+		environment = bundledGems(pid, started)
+	case "python":
+		environment = pw.virtualenvPackages(pid, started)
+	}
+	for _, dep := range environment {
+		// what we've seen it use tells us more (where from, and if it's native)
+		if _, ok := found[dep.Name+"@"+dep.Version]; !ok {
+			found[dep.Name+"@"+dep.Version] = dep
+		}
+	}
+
+	deps := make([]loadedDependency, 0, len(found))
+	for _, dep := range found {
+		deps = append(deps, dep)
+	}
+	sort.Sort(byDependencyName(deps))
+	return deps
+}
+
+func isNativeExtension(path string) bool {
+	return strings.HasSuffix(path, ".so") || strings.HasSuffix(path, ".bundle") || strings.Contains(path, ".so.")
+}
+
+// gemFromPath finds the gem a file belongs to, from either where gems get
+// installed (.../gems/nokogiri-1.15.4-x86_64-linux/lib/...) or where their
+// compiled extensions do (.../extensions/x86_64-linux/3.1.0/puma-6.4.0/...).
+// Gems bundler checked out from git (.../bundler/gems/rails-5d1b2ef9a3c7)
+// don't have a version to go by.
+func gemFromPath(path string) (loadedDependency, bool) {
+	segments := strings.Split(path, "/")
+	for i := len(segments) - 2; i >= 0; i-- {
+		var gemDir int
+		switch {
+		case segments[i] == "gems" && (i == 0 || segments[i-1] != "bundler"):
+			gemDir = i + 1
+		case segments[i] == "extensions" && i+3 < len(segments):
+			gemDir = i + 3
+		default:
+			continue
+		}
+
+		name, version, ok := splitGemDir(segments[gemDir])
+		if !ok {
+			continue
+		}
+		return loadedDependency{
+			Name:    name,
+			Version: version,
+			Path:    strings.Join(segments[:gemDir+1], "/"),
+		}, true
+	}
+	return loadedDependency{}, false
+}
+
+// "nokogiri-1.15.4-x86_64-linux" is nokogiri 1.15.4, built for x86_64-linux
+func splitGemDir(dir string) (string, string, bool) {
+	for i := 1; i < len(dir)-1; i++ {
+		if dir[i] == '-' && dir[i+1] >= '0' && dir[i+1] <= '9' {
+			version := dir[i+1:]
+			if platform := strings.Index(version, "-"); platform >= 0 {
+				version = version[:platform]
+			}
+			return dir[:i], version, true
+		}
+	}
+	return "", "", false
+}
+
+// pythonPackageFromPath finds the distribution a file in site-packages (or
+// debian's dist-packages) belongs to
+func (pw *processWatcher) pythonPackageFromPath(pid int, path string) (loadedDependency, bool) {
+	segments := strings.Split(path, "/")
+	for i := len(segments) - 2; i >= 0; i-- {
+		if segments[i] != "site-packages" && segments[i] != "dist-packages" {
+			continue
+		}
+
+		site := strings.Join(segments[:i+1], "/")
+		dep, ok := pw.sitePackages(pid, site).modules[moduleName(segments[i+1])]
+		return dep, ok
+	}
+	return loadedDependency{}, false
+}
+
+// sitePackages indexes the distributions installed in a site-packages
+// directory, unless we did since it last changed.
+func (pw *processWatcher) sitePackages(pid int, site string) sitePackages {
+	dir := processPath(pid, site)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return sitePackages{}
+	}
+
+	// the same path can be different directories in different containers,
+	// while the same directory is shared by every process using it
+	key := dir
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		key = fmt.Sprintf("%d:%d", stat.Dev, stat.Ino)
+	}
+	pw.sitesSeen[key] = true
+
+	if cached, ok := pw.siteCache[key]; ok && cached.modified.Equal(info.ModTime()) {
+		return cached
+	}
+
+	modules := map[string]loadedDependency{}
+	distributions := []siteDistribution{}
+	entries, _ := ioutil.ReadDir(dir)
+	for _, entry := range entries {
+		var meta string
+		switch {
+		case strings.HasSuffix(entry.Name(), ".dist-info"):
+			meta = strings.TrimSuffix(entry.Name(), ".dist-info")
+		case strings.HasSuffix(entry.Name(), ".egg-info"):
+			meta = strings.TrimSuffix(entry.Name(), ".egg-info")
+		default:
+			continue
+		}
+
+		// name-version, or name-version-pyX.Y for eggs
+		parts := strings.SplitN(meta, "-", 3)
+		if len(parts) < 2 {
+			continue
+		}
+		dep := loadedDependency{Name: parts[0], Version: parts[1], Path: site}
+		distributions = append(distributions, siteDistribution{dep: dep, installed: entry.ModTime()})
+
+		for _, module := range distributionModules(filepath.Join(dir, entry.Name())) {
+			modules[module] = dep
+		}
+		// it's a good bet the package is called what the distribution is
+		if _, ok := modules[dep.Name]; !ok {
+			modules[dep.Name] = dep
+		}
+	}
+
+	packages := sitePackages{modified: info.ModTime(), modules: modules, distributions: distributions}
+	pw.siteCache[key] = packages
+	return packages
+}
+
+// bundledGems lists the gems in the bundle a ruby process runs with: the
+// Gemfile BUNDLE_GEMFILE names (bundle exec sets it), or that the app's
+// .bundle/config does, or else the one in its working directory. A lockfile
+// that changed after the process started doesn't count.
+func bundledGems(pid int, started time.Time) []loadedDependency {
+	cwd, err := processCwd(pid)
+	if err != nil {
+		return nil
+	}
+
+	gemfile := processEnv(pid, "BUNDLE_GEMFILE")
+	if gemfile == "" {
+		gemfile = bundleConfig(processPath(pid, cwd), "BUNDLE_GEMFILE")
+	}
+	if gemfile == "" {
+		gemfile = "Gemfile"
+	}
+	if !filepath.IsAbs(gemfile) {
+		gemfile = filepath.Join(cwd, gemfile)
+	}
+
+	lockfile := gemfile + ".lock"
+	if filepath.Base(gemfile) == "gems.rb" {
+		lockfile = filepath.Join(filepath.Dir(gemfile), "gems.locked")
+	}
+
+	file, err := os.Open(processPath(pid, lockfile))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() || info.ModTime().After(started) {
+		return nil
+	}
+	return lockfileGems(file, lockfile)
+}
+
+// bundleConfig looks up a setting in an app's .bundle/config, which is YAML
+// but only ever flat KEY: "value" lines
+func bundleConfig(app string, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join(app, ".bundle", "config"))
+	if err != nil {
+		return ""
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == name {
+			return strings.Trim(strings.TrimSpace(parts[1]), `"'`)
+		}
+	}
+	return ""
+}
+
+// lockfileGems lists the gems in a lockfile's GEM, GIT and PATH specs (the
+// gems they depend on are indented further), leaving out their platform
+func lockfileGems(lockfile io.Reader, path string) []loadedDependency {
+	gems := []loadedDependency{}
+
+	scanner := bufio.NewScanner(lockfile)
+	for scanner.Scan() {
+		match := lockfileSpecPattern.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		version := strings.SplitN(match[2], "-", 2)[0]
+		gems = append(gems, loadedDependency{Name: match[1], Version: version, Path: path})
+	}
+	return gems
+}
+
+// virtualenvPackages lists the distributions installed in the virtualenv a
+// python process runs in: VIRTUAL_ENV, or else one in its working directory
+// (.venv or venv). Distributions installed after the process started don't
+// count.
+func (pw *processWatcher) virtualenvPackages(pid int, started time.Time) []loadedDependency {
+	venvs := []string{}
+	if venv := processEnv(pid, "VIRTUAL_ENV"); venv != "" {
+		venvs = append(venvs, venv)
+	}
+	if cwd, err := processCwd(pid); err == nil {
+		venvs = append(venvs, filepath.Join(cwd, ".venv"), filepath.Join(cwd, "venv"))
+	}
+
+	for _, venv := range venvs {
+		if _, err := os.Stat(processPath(pid, filepath.Join(venv, "pyvenv.cfg"))); err != nil {
+			continue
+		}
+
+		deps := []loadedDependency{}
+		versions, _ := ioutil.ReadDir(processPath(pid, filepath.Join(venv, "lib")))
+		for _, version := range versions {
+			if !strings.HasPrefix(version.Name(), "python") {
+				continue
+			}
+			site := filepath.Join(venv, "lib", version.Name(), "site-packages")
+			for _, dist := range pw.sitePackages(pid, site).distributions {
+				if !dist.installed.After(started) {
+					deps = append(deps, dist.dep)
+				}
+			}
+		}
+		return deps
+	}
+	return nil
+}
+
+// distributionModules lists the top level modules a distribution installs,
+// per its top_level.txt or failing that, the files in its RECORD
+func distributionModules(metaDir string) []string {
+	modules := []string{}
+
+	if data, err := ioutil.ReadFile(filepath.Join(metaDir, "top_level.txt")); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				modules = append(modules, moduleName(line))
+			}
+		}
+		return modules
+	}
+
+	file, err := os.Open(filepath.Join(metaDir, "RECORD"))
+	if err != nil {
+		return modules
+	}
+	defer file.Close()
+
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// path,hash,size
+		path := strings.SplitN(scanner.Text(), ",", 2)[0]
+		top := strings.SplitN(path, "/", 2)[0]
+		if top == "" || top == ".." || strings.HasSuffix(top, ".dist-info") || top == "__pycache__" {
+			continue
+		}
+
+		module := moduleName(top)
+		if !seen[module] {
+			seen[module] = true
+			modules = append(modules, module)
+		}
+	}
+	return modules
+}
+
+// "six.py", "_cffi_backend.cpython-311-x86_64-linux-gnu.so" and "numpy.libs"
+// are the six, _cffi_backend and numpy modules
+func moduleName(entry string) string {
+	return strings.SplitN(entry, ".", 2)[0]
+}
+
+type byDependencyName []loadedDependency
+
+func (s byDependencyName) Len() int      { return len(s) }
+func (s byDependencyName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byDependencyName) Less(i, j int) bool {
+	if s[i].Name == s[j].Name {
+		return s[i].Version < s[j].Version
+	}
+	return s[i].Name < s[j].Name
+}
@@ -0,0 +1,135 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/appcanary/agent/conf"
+	"github.com/appcanary/testify/assert"
+)
+
+func TestLoadedDependencies(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	dir, _ := ioutil.TempDir("", "canarydeps")
+	defer os.RemoveAll(dir)
+	procRoot = dir
+	defer func() { procRoot = "/proc" }()
+
+	write := func(path string, contents string) {
+		path = filepath.Join(dir, path)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, []byte(contents), 0644)
+	}
+	link := func(path string, target string) {
+		path = filepath.Join(dir, path)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.Symlink(target, path)
+	}
+
+	// a rails app that's still got the old nokogiri loaded after a bundle install
+	gems := "/app/vendor/bundle/ruby/3.1.0"
+	write("10/maps", "7f0000000000-7f0000001000 r-xp 00000000 08:01 1234 /usr/lib/x86_64-linux-gnu/libc.so.6\n"+
+		"7f0000001000-7f0000002000 r-xp 00000000 08:01 1235 "+gems+"/gems/nokogiri-1.13.1-x86_64-linux/lib/nokogiri/3.1/nokogiri.so (deleted)\n"+
+		"7f0000002000-7f0000003000 r-xp 00000000 08:01 1236 "+gems+"/extensions/x86_64-linux/3.1.0/puma-6.4.0/puma/puma_http11.so\n"+
+		"7f0000003000-7f0000004000 rw-p 00000000 00:00 0 [heap]\n")
+	link("10/fd/0", "/dev/null")
+	link("10/fd/5", "socket:[12345]")
+	link("10/fd/7", gems+"/gems/rack-2.2.8/lib/rack/lint.rb")
+	link("10/fd/8", gems+"/bundler/gems/rails-5d1b2ef9a3c7/README.md")
+
+	pw := NewProcessWatcher("*", testCallbackNOP).(*processWatcher)
+	assert.Equal([]loadedDependency{
+		{Name: "nokogiri", Version: "1.13.1", Path: gems + "/gems/nokogiri-1.13.1-x86_64-linux", Native: true},
+		{Name: "puma", Version: "6.4.0", Path: gems + "/extensions/x86_64-linux/3.1.0/puma-6.4.0", Native: true},
+		{Name: "rack", Version: "2.2.8", Path: gems + "/gems/rack-2.2.8"},
+	}, pw.loadedDependencies(10, "ruby", time.Now()))
+
+	// a python process, in a container
+	site := "/usr/local/lib/python3.11/site-packages"
+	write("20/root"+site+"/cffi-1.15.1.dist-info/top_level.txt", "_cffi_backend\ncffi\n")
+	write("20/root"+site+"/PyYAML-6.0.1.dist-info/RECORD", "yaml/__init__.py,sha256=x,1\n_yaml/__init__.py,sha256=x,1\nPyYAML-6.0.1.dist-info/RECORD,,\n")
+	write("20/root"+site+"/requests-2.31.0.dist-info/METADATA", "Name: requests\n")
+	write("20/maps", "7f0000000000-7f0000001000 r-xp 00000000 08:01 1 "+site+"/_cffi_backend.cpython-311-x86_64-linux-gnu.so\n"+
+		"7f0000001000-7f0000002000 r-xp 00000000 08:01 2 "+site+"/yaml/_yaml.cpython-311-x86_64-linux-gnu.so\n")
+	link("20/fd/3", site+"/requests/sessions.py")
+	link("20/fd/4", site+"/unknown/thing.py")
+
+	assert.Equal([]loadedDependency{
+		{Name: "PyYAML", Version: "6.0.1", Path: site, Native: true},
+		{Name: "cffi", Version: "1.15.1", Path: site, Native: true},
+		{Name: "requests", Version: "2.31.0", Path: site},
+	}, pw.loadedDependencies(20, "python", time.Now()))
+
+	assert.Equal("ruby", processLanguage("/usr/bin/ruby3.1"))
+	assert.Equal("python", processLanguage("/usr/local/bin/python3.11"))
+	assert.Equal("", processLanguage("/usr/bin/rubocop"))
+	assert.Equal("", processLanguage("/usr/sbin/nginx"))
+}
+
+func TestEnvironmentDependencies(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	dir, _ := ioutil.TempDir("", "canarydeps")
+	defer os.RemoveAll(dir)
+	procRoot = dir
+	defer func() { procRoot = "/proc" }()
+
+	write := func(path string, contents string) {
+		path = filepath.Join(dir, path)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, []byte(contents), 0644)
+	}
+	link := func(path string, target string) {
+		path = filepath.Join(dir, path)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.Symlink(target, path)
+	}
+	started := time.Now().Add(time.Minute)
+
+	// a rails app whose pure ruby gems are long closed: the bundle its
+	// working directory's configured with says what they are
+	app := "/srv/app"
+	lockfile := "GIT\n  remote: https://github.com/rails/rails.git\n  specs:\n    rails (7.1.0)\n      actionpack (= 7.1.0)\n\n" +
+		"GEM\n  remote: https://rubygems.org/\n  specs:\n    nokogiri (1.15.4-x86_64-linux)\n      racc (~> 1.4)\n    racc (1.7.1)\n\n" +
+		"PLATFORMS\n  x86_64-linux\n\nDEPENDENCIES\n  nokogiri\n  rails!\n\nBUNDLED WITH\n   2.4.19\n"
+	write("10/root"+app+"/Gemfile.lock", "GEM\n  specs:\n    rack (2.2.8)\n")
+	write("10/root"+app+"/Gemfile.next.lock", lockfile)
+	write("10/root"+app+"/.bundle/config", "---\nBUNDLE_GEMFILE: \"Gemfile.next\"\n")
+	link("10/cwd", app)
+	write("10/maps", "7f0000000000-7f0000001000 r-xp 00000000 08:01 1 /usr/local/bundle/gems/nokogiri-1.15.4-x86_64-linux/lib/nokogiri/3.2/nokogiri.so\n")
+
+	pw := NewProcessWatcher("*", testCallbackNOP).(*processWatcher)
+	assert.Equal([]loadedDependency{
+		{Name: "nokogiri", Version: "1.15.4", Path: "/usr/local/bundle/gems/nokogiri-1.15.4-x86_64-linux", Native: true},
+		{Name: "racc", Version: "1.7.1", Path: app + "/Gemfile.next.lock"},
+		{Name: "rails", Version: "7.1.0", Path: app + "/Gemfile.next.lock"},
+	}, pw.loadedDependencies(10, "ruby", started))
+
+	// unless it got bundled again after the process started
+	assert.Equal([]loadedDependency{
+		{Name: "nokogiri", Version: "1.15.4", Path: "/usr/local/bundle/gems/nokogiri-1.15.4-x86_64-linux", Native: true},
+	}, pw.loadedDependencies(10, "ruby", time.Now().Add(-time.Hour)))
+
+	// a python app with a virtualenv in its working directory, that's had a
+	// package installed since it started
+	api := "/srv/api"
+	site := api + "/.venv/lib/python3.11/site-packages"
+	write("20/root"+api+"/.venv/pyvenv.cfg", "home = /usr/bin\n")
+	write("20/root"+site+"/flask-3.0.0.dist-info/top_level.txt", "flask\n")
+	write("20/root"+site+"/Jinja2-3.1.2.dist-info/top_level.txt", "jinja2\n")
+	write("20/root"+site+"/rich-13.7.0.dist-info/top_level.txt", "rich\n")
+	later := started.Add(time.Hour)
+	os.Chtimes(filepath.Join(dir, "20/root"+site+"/rich-13.7.0.dist-info"), later, later)
+	link("20/cwd", api)
+
+	assert.Equal([]loadedDependency{
+		{Name: "Jinja2", Version: "3.1.2", Path: site},
+		{Name: "flask", Version: "3.0.0", Path: site},
+	}, pw.loadedDependencies(20, "python", started))
+}
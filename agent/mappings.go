@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Why a mapped file no longer is what's on disk
+const (
+	staleDeleted  = "deleted"  // it's gone (upgrades usually unlink and replace)
+	staleReplaced = "replaced" // something else is at its path now
+	staleModified = "modified" // it was written to after the process started
+)
+
+// Mappings of these aren't libraries that get upgraded: shared memory, JIT
+// scratch files and the like, which are routinely deleted while in use.
+var volatileMappingPrefixes = []string{"/dev/", "/run/", "/tmp/", "/var/tmp/", "/memfd:", "/SYSV"}
+
+// staleMappings goes through what a process has mapped and compares it with
+// what's on disk now, without needing to know which package anything came
+// from. It returns why each stale file is stale, by path.
+func staleMappings(pid int, started time.Time) (map[string]string, error) {
+	mappings, err := processMappings(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	stale := map[string]string{}
+	for _, m := range mappings {
+		if isVolatileMapping(m.Path) {
+			continue
+		}
+		if reason := m.staleness(pid, started); reason != "" {
+			stale[m.Path] = reason
+		}
+	}
+	return stale, nil
+}
+
+func isVolatileMapping(path string) bool {
+	for _, prefix := range volatileMappingPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// staleness compares the mapping with the file at its path. Inodes are only
+// compared when the file's on the device the mapping says it's on, since the
+// overlay filesystems containers run on report different ones. It goes by
+// mtime rather than ctime, which chmod, chown and hardlinking change too.
+func (m mapping) staleness(pid int, started time.Time) string {
+	if m.Deleted {
+		return staleDeleted
+	}
+
+	info, err := os.Stat(processPath(pid, m.Path))
+	if errors.Is(err, os.ErrNotExist) {
+		return staleDeleted
+	}
+	if err != nil {
+		// we can't tell, which is no reason to think it's stale
+		return ""
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+
+	if deviceString(uint64(stat.Dev)) == m.Dev && uint64(stat.Ino) != m.Inode {
+		return staleReplaced
+	}
+
+	if info.ModTime().After(started) {
+		return staleModified
+	}
+	return ""
+}
+
+func mappingDisagreement(pid int, spectorOutdated bool, reason string) error {
+	if spectorOutdated {
+		return fmt.Errorf("outdated according to libspector, but not to /proc/%d/maps", pid)
+	}
+	return fmt.Errorf("%s according to /proc/%d/maps, but not outdated according to libspector", reason, pid)
+}
+
+func sortedPaths(stale map[string]string) []string {
+	paths := make([]string, 0, len(stale))
+	for path := range stale {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// deviceString formats a device number the way /proc/<pid>/maps does
+func deviceString(dev uint64) string {
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	return fmt.Sprintf("%02x:%02x", major, minor)
+}
@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/appcanary/testify/assert"
+)
+
+func TestStaleMappings(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "canarymaps")
+	defer os.RemoveAll(dir)
+	procRoot = dir
+	defer func() { procRoot = "/proc" }()
+
+	write := func(path string, contents string) {
+		path = filepath.Join(dir, path)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, []byte(contents), 0644)
+	}
+
+	// what the maps say about a file on disk, give or take its inode
+	onDisk := func(path string, inodeOffset uint64) string {
+		info, err := os.Stat(filepath.Join(dir, "42/root", path))
+		assert.Nil(err)
+		stat := info.Sys().(*syscall.Stat_t)
+		return fmt.Sprintf("%s %d %s", deviceString(uint64(stat.Dev)), uint64(stat.Ino)+inodeOffset, path)
+	}
+
+	write("42/root/lib/libc.so.6", "")
+	write("42/root/lib/libz.so.1", "")
+	write("42/root/lib/libpng.so.16", "")
+	write("42/root/lib/libm.so.6", "")
+	started := time.Now().Add(time.Minute)
+
+	// fixing up permissions doesn't make it any newer
+	old := started.Add(-2 * time.Hour)
+	os.Chtimes(filepath.Join(dir, "42/root/lib/libm.so.6"), old, old)
+	os.Chmod(filepath.Join(dir, "42/root/lib/libm.so.6"), 0755)
+
+	write("42/maps", "7f0000000000-7f0000001000 r-xp 00000000 "+onDisk("/lib/libc.so.6", 0)+"\n"+
+		"7f0000001000-7f0000002000 r--p 00001000 "+onDisk("/lib/libc.so.6", 0)+"\n"+
+		"7f0000002000-7f0000003000 r-xp 00000000 "+onDisk("/lib/libz.so.1", 1)+"\n"+
+		"7f0000003000-7f0000004000 r-xp 00000000 08:01 1234 /lib/libssl.so.3 (deleted)\n"+
+		"7f0000004000-7f0000005000 r-xp 00000000 ff:ff 1234 /lib/libpng.so.16\n"+
+		"7f0000005000-7f0000006000 r-xp 00000000 "+onDisk("/lib/libm.so.6", 0)+"\n"+
+		"7f0000006000-7f0000007000 rw-s 00000000 00:05 99 /dev/shm/scratch (deleted)\n"+
+		"7f0000007000-7f0000008000 rw-p 00000000 00:00 0 [stack]\n")
+
+	stale, err := staleMappings(42, started)
+	assert.Nil(err)
+	assert.Equal(map[string]string{
+		"/lib/libz.so.1":   staleReplaced,
+		"/lib/libssl.so.3": staleDeleted,
+	}, stale)
+
+	// started before the files were put in place
+	stale, err = staleMappings(42, started.Add(-time.Hour))
+	assert.Nil(err)
+	assert.Equal(staleModified, stale["/lib/libc.so.6"])
+	// on another device as far as the maps go, so only its mtime counts
+	assert.Equal(staleModified, stale["/lib/libpng.so.16"])
+	assert.Equal("", stale["/lib/libm.so.6"])
+
+	_, err = staleMappings(43, started)
+	assert.NotNil(err)
+}
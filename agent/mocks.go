@@ -1,6 +1,9 @@
 package agent
 
 import (
+	"io"
+	"io/ioutil"
+
 	"github.com/appcanary/testify/mock"
 )
 
@@ -16,7 +19,9 @@ func (m *MockClient) Heartbeat(_a0 string, _a1 Watchers) error {
 	return r0
 }
 
-func (m *MockClient) SendFile(_a0 string, _a1 string, _a2 []byte) error {
+func (m *MockClient) SendFile(_a0 string, _a1 string, _a2 io.Reader) error {
+	// as the API would, read what's sent
+	io.Copy(ioutil.Discard, _a2)
 	ret := m.Called()
 
 	r0 := ret.Error(0)
@@ -24,10 +29,18 @@ func (m *MockClient) SendFile(_a0 string, _a1 string, _a2 []byte) error {
 	return r0
 }
 
+func (m *MockClient) SendFileDiff(_a0 string, _a1 string, _a2 PackageDiff) error {
+	return m.Called().Error(0)
+}
+
 func (m *MockClient) SendProcessState(_a0 string, _a1 []byte) error {
 	return m.Called().Error(0)
 }
 
+func (m *MockClient) SendProcessEvents(_a0 string, _a1 []byte) error {
+	return m.Called().Error(0)
+}
+
 func (m *MockClient) CreateServer(_a0 *Server) (string, error) {
 	return m.Called().String(0), nil
 }
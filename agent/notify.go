@@ -0,0 +1,189 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/appcanary/agent/conf"
+	"github.com/fsnotify/fsnotify"
+)
+
+// fileNotifier relays kernel change notifications (inotify on linux) for a
+// single file. We watch both the file and its parent directory: the file watch
+// catches in place writes, the directory watch catches deploys and package
+// managers that replace the file by renaming a new one over it.
+type fileNotifier struct {
+	path string
+	dir  string
+	hub  *notifyHub
+	C    chan bool
+}
+
+// All file notifiers share one fsnotify watcher, and so one inotify instance
+// (of which a user only gets 128 by default), which hands events to whichever
+// notifiers watch the file or directory they're about. It's closed once the
+// last of them is.
+type notifyHub struct {
+	watcher  *fsnotify.Watcher
+	watching map[string]map[*fileNotifier]bool
+	watched  map[string]os.FileInfo // what the watch on a path is on
+}
+
+var (
+	hubLock sync.Mutex
+	hub     *notifyHub
+)
+
+func newFileNotifier(path string) (*fileNotifier, error) {
+	hubLock.Lock()
+	defer hubLock.Unlock()
+
+	if hub == nil {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return nil, err
+		}
+		hub = &notifyHub{
+			watcher:  watcher,
+			watching: map[string]map[*fileNotifier]bool{},
+			watched:  map[string]os.FileInfo{},
+		}
+		go hub.run()
+	}
+
+	fn := &fileNotifier{
+		path: path,
+		dir:  filepath.Dir(path),
+		hub:  hub,
+		// one pending notification is as good as many, see notify()
+		C: make(chan bool, 1),
+	}
+
+	for _, p := range []string{fn.dir, fn.path} {
+		if hub.watching[p] == nil {
+			hub.watching[p] = map[*fileNotifier]bool{}
+		}
+		hub.watching[p][fn] = true
+		hub.watch(p)
+	}
+
+	return fn, nil
+}
+
+// rewatch (re)attaches the watches on the file and its directory, if they're
+// gone. Watches disappear when their target gets removed or renamed, so we do
+// this whenever that happens and on every fallback poll. Either path may be
+// missing, in which case we rely on polling until it shows up again.
+func (fn *fileNotifier) rewatch() {
+	hubLock.Lock()
+	defer hubLock.Unlock()
+
+	for _, p := range []string{fn.dir, fn.path} {
+		fn.hub.watch(p)
+	}
+}
+
+// watch adds a watch on p, unless the one there is on what's at p already:
+// other notifiers rely on it, and wouldn't hear a thing while it's away. One
+// that's on something since removed or replaced is of no use to anyone,
+// though, and gets dropped. Called with hubLock held.
+func (hub *notifyHub) watch(p string) {
+	info, err := os.Stat(p)
+	if err != nil {
+		hub.unwatch(p)
+		return
+	}
+
+	if watched, ok := hub.watched[p]; ok {
+		if os.SameFile(watched, info) {
+			return
+		}
+		hub.unwatch(p)
+	}
+
+	if hub.watcher.Add(p) == nil {
+		hub.watched[p] = info
+	}
+}
+
+// unwatch drops the watch on p. Called with hubLock held.
+func (hub *notifyHub) unwatch(p string) {
+	if _, ok := hub.watched[p]; ok {
+		hub.watcher.Remove(p)
+		delete(hub.watched, p)
+	}
+}
+
+func (hub *notifyHub) run() {
+	log := conf.FetchLog()
+
+	for {
+		select {
+		case event, ok := <-hub.watcher.Events:
+			if !ok {
+				return
+			}
+
+			hubLock.Lock()
+			notifiers := make([]*fileNotifier, 0, len(hub.watching[event.Name]))
+			for fn := range hub.watching[event.Name] {
+				notifiers = append(notifiers, fn)
+			}
+			hubLock.Unlock()
+
+			for _, fn := range notifiers {
+				fn.handle(event)
+			}
+
+		case err, ok := <-hub.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Debugf("Notification error: %v", err)
+		}
+	}
+}
+
+func (fn *fileNotifier) handle(event fsnotify.Event) {
+	switch event.Name {
+	case fn.path:
+		if event.Op&(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+			fn.rewatch()
+		}
+		fn.notify()
+	case fn.dir:
+		// the directory itself went away or got moved
+		fn.rewatch()
+		fn.notify()
+	}
+}
+
+func (fn *fileNotifier) notify() {
+	select {
+	case fn.C <- true:
+	default:
+	}
+}
+
+// Close drops the watches no other notifier needs, and the fsnotify watcher
+// with the last of them
+func (fn *fileNotifier) Close() {
+	hubLock.Lock()
+	defer hubLock.Unlock()
+
+	for _, p := range []string{fn.dir, fn.path} {
+		delete(fn.hub.watching[p], fn)
+		if len(fn.hub.watching[p]) == 0 {
+			delete(fn.hub.watching, p)
+			fn.hub.unwatch(p)
+		}
+	}
+
+	if len(fn.hub.watching) == 0 {
+		fn.hub.watcher.Close()
+		if hub == fn.hub {
+			hub = nil
+		}
+	}
+}
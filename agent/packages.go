@@ -0,0 +1,247 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/appcanary/agent/conf"
+)
+
+var errNoBaseline = errors.New("no baseline to diff against")
+
+// One installed (or available) package, as far as a package database says
+type packageEntry struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Arch    string `json:"arch,omitempty"`
+	Status  string `json:"status,omitempty"`
+}
+
+// keyed by name and arch, since multiarch systems can have one of each
+type packageSet map[string]packageEntry
+
+func (p packageEntry) key() string {
+	return p.Name + ":" + p.Arch
+}
+
+type packageChange struct {
+	From packageEntry `json:"from"`
+	To   packageEntry `json:"to"`
+}
+
+// What changed in a package database between two versions of it. Base and
+// Checksum identify the contents before and after.
+type PackageDiff struct {
+	Base     string          `json:"base"`
+	Checksum string          `json:"checksum"`
+	Added    []packageEntry  `json:"added"`
+	Removed  []packageEntry  `json:"removed"`
+	Changed  []packageChange `json:"changed"`
+}
+
+// parsePackages reads the package database kind of file is. It returns false
+// if we don't know how to, in which case the file just gets shipped whole.
+func parsePackages(kind string, contents []byte) (packageSet, bool) {
+	var packages packageSet
+
+	switch kind {
+	case "ubuntu":
+		packages = parseDpkg(contents)
+	case "centos":
+		packages = parseRpmList(contents)
+	default:
+		return nil, false
+	}
+
+	// if nothing made sense, it probably wasn't what we thought it was
+	if len(packages) == 0 && len(bytes.TrimSpace(contents)) > 0 {
+		return nil, false
+	}
+	return packages, true
+}
+
+// dpkg's status and available files are made of stanzas like
+//
+//	Package: tcpd
+//	Status: install ok installed
+//	Architecture: i386
+//	Version: 7.6.q-21
+//
+// separated by blank lines.
+func parseDpkg(contents []byte) packageSet {
+	packages := packageSet{}
+	var current packageEntry
+
+	flush := func() {
+		if current.Name != "" && current.Version != "" {
+			packages[current.key()] = current
+		}
+		current = packageEntry{}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+
+		// continuation lines, i.e. long descriptions
+		if line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+
+		field := strings.SplitN(line, ":", 2)
+		if len(field) != 2 {
+			continue
+		}
+
+		value := strings.TrimSpace(field[1])
+		switch field[0] {
+		case "Package":
+			current.Name = value
+		case "Version":
+			current.Version = value
+		case "Architecture":
+			current.Arch = value
+		case "Status":
+			current.Status = value
+		}
+	}
+	flush()
+
+	return packages
+}
+
+var rpmArches = map[string]bool{
+	"noarch": true, "x86_64": true, "i386": true, "i586": true, "i686": true,
+	"aarch64": true, "armv7hl": true, "ppc64": true, "ppc64le": true, "s390x": true,
+}
+
+// rpm -qa lists one name-version-release.arch per line
+func parseRpmList(contents []byte) packageSet {
+	packages := packageSet{}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+
+		var arch string
+		if dot := strings.LastIndex(line, "."); dot >= 0 && rpmArches[line[dot+1:]] {
+			arch = line[dot+1:]
+			line = line[:dot]
+		}
+
+		release := strings.LastIndex(line, "-")
+		if release <= 0 {
+			continue
+		}
+		version := strings.LastIndex(line[:release], "-")
+		if version <= 0 {
+			continue
+		}
+
+		entry := packageEntry{Name: line[:version], Version: line[version+1:], Arch: arch}
+		packages[entry.key()] = entry
+	}
+
+	return packages
+}
+
+func diffPackages(old packageSet, current packageSet) PackageDiff {
+	diff := PackageDiff{
+		Added:   []packageEntry{},
+		Removed: []packageEntry{},
+		Changed: []packageChange{},
+	}
+
+	for key, entry := range current {
+		if was, ok := old[key]; !ok {
+			diff.Added = append(diff.Added, entry)
+		} else if was != entry {
+			diff.Changed = append(diff.Changed, packageChange{From: was, To: entry})
+		}
+	}
+
+	for key, entry := range old {
+		if _, ok := current[key]; !ok {
+			diff.Removed = append(diff.Removed, entry)
+		}
+	}
+
+	sort.Sort(byPackageKey(diff.Added))
+	sort.Sort(byPackageKey(diff.Removed))
+	sort.Sort(byChangeKey(diff.Changed))
+	return diff
+}
+
+type byPackageKey []packageEntry
+
+func (s byPackageKey) Len() int           { return len(s) }
+func (s byPackageKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byPackageKey) Less(i, j int) bool { return s[i].key() < s[j].key() }
+
+type byChangeKey []packageChange
+
+func (s byChangeKey) Len() int           { return len(s) }
+func (s byChangeKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byChangeKey) Less(i, j int) bool { return s[i].To.key() < s[j].To.key() }
+
+// The package set we last shipped for a path, kept on disk so we can still
+// diff against it after a restart.
+type packageSnapshot struct {
+	Path     string     `json:"path"`
+	Checksum string     `json:"checksum"`
+	Packages packageSet `json:"packages"`
+}
+
+func snapshotFile(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return filepath.Join(conf.VarPath("snapshots"), hex.EncodeToString(sum[:])+".json")
+}
+
+func loadSnapshot(path string) (*packageSnapshot, error) {
+	data, err := ioutil.ReadFile(snapshotFile(path))
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot packageSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+
+	if snapshot.Path != path {
+		return nil, errNoBaseline
+	}
+	return &snapshot, nil
+}
+
+func saveSnapshot(snapshot *packageSnapshot) error {
+	file := snapshotFile(snapshot.Path)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	// write and rename, so a crash can't leave a half written baseline
+	if err := ioutil.WriteFile(file+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
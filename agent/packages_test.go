@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/appcanary/agent/conf"
+	"github.com/appcanary/testify/assert"
+)
+
+func TestParseDpkg(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	contents, err := ioutil.ReadFile(conf.DEV_CONF_PATH + "/dpkg/available")
+	assert.Nil(err)
+
+	packages, ok := parsePackages("ubuntu", contents)
+	assert.True(ok)
+	assert.Equal(packageEntry{Name: "tcpd", Version: "7.6.q-21", Arch: "i386"}, packages["tcpd:i386"])
+
+	packages = parseDpkg([]byte("Package: bash\nStatus: install ok installed\nArchitecture: amd64\n" +
+		"Description: shell\n more: description\nVersion: 4.3-7\n\nPackage: broken\n"))
+	assert.Equal(1, len(packages))
+	assert.Equal(packageEntry{Name: "bash", Version: "4.3-7", Arch: "amd64", Status: "install ok installed"}, packages["bash:amd64"])
+}
+
+func TestParseRpmList(t *testing.T) {
+	assert := assert.New(t)
+
+	packages, ok := parsePackages("centos", []byte("bash-4.2.46-34.el7.x86_64\ngpg-pubkey-f4a80eb5-53a7ff4b\nperl-Pod-Escapes-1.04-292.el7.noarch\n"))
+	assert.True(ok)
+	assert.Equal(3, len(packages))
+	assert.Equal(packageEntry{Name: "bash", Version: "4.2.46-34.el7", Arch: "x86_64"}, packages["bash:x86_64"])
+	assert.Equal(packageEntry{Name: "gpg-pubkey", Version: "f4a80eb5-53a7ff4b"}, packages["gpg-pubkey:"])
+	assert.Equal(packageEntry{Name: "perl-Pod-Escapes", Version: "1.04-292.el7", Arch: "noarch"}, packages["perl-Pod-Escapes:noarch"])
+
+	// whatever this is, it's not a package list
+	_, ok = parsePackages("centos", []byte("hello world\n"))
+	assert.False(ok)
+
+	_, ok = parsePackages("gemfile", []byte("GEM\n"))
+	assert.False(ok)
+}
+
+func TestDiffPackages(t *testing.T) {
+	assert := assert.New(t)
+
+	old := parseRpmList([]byte("bash-4.2-1.x86_64\nzsh-5.0-1.x86_64\nopenssl-1.0.1-1.x86_64\n"))
+	current := parseRpmList([]byte("bash-4.2-1.x86_64\nopenssl-1.0.2-1.x86_64\ncurl-7.29-1.x86_64\n"))
+
+	diff := diffPackages(old, current)
+	assert.Equal([]packageEntry{{Name: "curl", Version: "7.29-1", Arch: "x86_64"}}, diff.Added)
+	assert.Equal([]packageEntry{{Name: "zsh", Version: "5.0-1", Arch: "x86_64"}}, diff.Removed)
+	assert.Equal([]packageChange{{
+		From: packageEntry{Name: "openssl", Version: "1.0.1-1", Arch: "x86_64"},
+		To:   packageEntry{Name: "openssl", Version: "1.0.2-1", Arch: "x86_64"},
+	}}, diff.Changed)
+
+	diff = diffPackages(current, current)
+	assert.Equal(0, len(diff.Added)+len(diff.Removed)+len(diff.Changed))
+}
+
+func TestPackageSnapshot(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	varDir := tempVarDir(assert)
+	defer os.RemoveAll(varDir)
+
+	_, err := loadSnapshot("/var/lib/dpkg/status")
+	assert.NotNil(err)
+
+	snapshot := &packageSnapshot{
+		Path:     "/var/lib/dpkg/status",
+		Checksum: "abc",
+		Packages: parseRpmList([]byte("bash-4.2-1.x86_64\n")),
+	}
+	assert.Nil(saveSnapshot(snapshot))
+
+	loaded, err := loadSnapshot("/var/lib/dpkg/status")
+	assert.Nil(err)
+	assert.Equal(snapshot, loaded)
+}
@@ -0,0 +1,234 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/appcanary/agent/conf"
+)
+
+// Gets told which paths started and stopped matching since the last scan
+type PathsChangeHandler func(added []string, removed []string)
+
+// Paths watchers track the set of files matching some criteria, e.g. a glob
+// pattern. They don't look at the files themselves; whoever receives the
+// changes is expected to set up (and tear down) a watcher per file.
+type pathsWatcher struct {
+	sync.Mutex
+	keepPolling bool
+	description string
+	find        func() ([]string, error)
+	matches     map[string]bool
+	OnChange    PathsChangeHandler
+	pollSleep   time.Duration
+	pollJitter  time.Duration
+	stop        chan bool
+}
+
+// Glob watchers expand a pattern such as /var/www/*/current/Gemfile.lock, or
+// /srv/apps/**/Gemfile.lock where ** stands for any number of directories.
+// The pattern gets re-evaluated as often as the settings say files get polled.
+func NewGlobWatcher(pattern string, callback PathsChangeHandler, settings ...conf.WatcherConf) Watcher {
+	env := conf.FetchEnv()
+
+	watcher := &pathsWatcher{
+		description: pattern,
+		find:        func() ([]string, error) { return globPaths(pattern) },
+		matches:     map[string]bool{},
+		OnChange:    callback,
+	}
+	watcher.pollSleep, watcher.pollJitter = pollTimes(watcherSettings(settings), env.PollSleep)
+
+	// expand right away so the matching files get synced on boot
+	watcher.scan()
+	return watcher
+}
+
+func IsGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+func (pw *pathsWatcher) Start() {
+	pw.Lock()
+	if pw.keepPolling {
+		pw.Unlock()
+		return
+	}
+	pw.keepPolling = true
+	pw.stop = make(chan bool)
+	stop := pw.stop
+	pw.Unlock()
+	go pw.listen(stop)
+}
+
+func (pw *pathsWatcher) Stop() {
+	pw.Lock()
+	if pw.keepPolling {
+		close(pw.stop)
+	}
+	pw.keepPolling = false
+	pw.Unlock()
+}
+
+func (pw *pathsWatcher) KeepPolling() bool {
+	pw.Lock()
+	defer pw.Unlock()
+	return pw.keepPolling
+}
+
+func (pw *pathsWatcher) Matches() []string {
+	pw.Lock()
+	defer pw.Unlock()
+
+	paths := make([]string, 0, len(pw.matches))
+	for path := range pw.matches {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (pw *pathsWatcher) scan() {
+	log := conf.FetchLog()
+
+	found, err := pw.find()
+	if err != nil {
+		// keep what we had, maybe it's a transient problem
+		log.Infof("Can't expand %s: %s", pw.description, err)
+		return
+	}
+
+	current := make(map[string]bool, len(found))
+	for _, path := range found {
+		current[path] = true
+	}
+
+	pw.Lock()
+	var added, removed []string
+	for path := range current {
+		if !pw.matches[path] {
+			added = append(added, path)
+		}
+	}
+	for path := range pw.matches {
+		if !current[path] {
+			removed = append(removed, path)
+		}
+	}
+	pw.matches = current
+	pw.Unlock()
+
+	if len(added) > 0 || len(removed) > 0 {
+		sort.Strings(added)
+		sort.Strings(removed)
+		pw.OnChange(added, removed)
+	}
+}
+
+func (pw *pathsWatcher) listen(stop chan bool) {
+	for pw.KeepPolling() {
+		select {
+		case <-stop:
+			return
+		case <-time.After(nextPoll(pw.pollSleep, pw.pollJitter)):
+			pw.scan()
+		}
+	}
+}
+
+// globPaths returns the regular files matching pattern. Unlike filepath.Glob it
+// understands ** as "zero or more directories"; note that the directory walk
+// this requires does not follow symlinks.
+func globPaths(pattern string) ([]string, error) {
+	var candidates []string
+
+	if !strings.Contains(pattern, "**") {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		candidates = matches
+	} else {
+		segments := splitPath(pattern)
+
+		// validate the pattern up front, Walk would just swallow the error
+		for _, segment := range segments {
+			if _, err := filepath.Match(segment, segment); err != nil {
+				return nil, err
+			}
+		}
+
+		root := globRoot(pattern)
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				// unreadable directories are simply not matched
+				return nil
+			}
+			if matchSegments(segments, splitPath(path)) {
+				candidates = append(candidates, path)
+			}
+			return nil
+		})
+	}
+
+	paths := make([]string, 0, len(candidates))
+	for _, path := range candidates {
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// the longest leading part of a pattern that has no wildcards in it
+func globRoot(pattern string) string {
+	var root []string
+	for _, segment := range strings.Split(filepath.Clean(pattern), string(filepath.Separator)) {
+		if IsGlob(segment) {
+			break
+		}
+		root = append(root, segment)
+	}
+
+	dir := strings.Join(root, string(filepath.Separator))
+	if dir == "" {
+		if filepath.IsAbs(pattern) {
+			return string(filepath.Separator)
+		}
+		return "."
+	}
+	return dir
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(filepath.Clean(path), string(filepath.Separator)), string(filepath.Separator))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+
+		if ok, _ := filepath.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/appcanary/agent/conf"
+	"github.com/appcanary/testify/assert"
+)
+
+func TestGlobPaths(t *testing.T) {
+	assert := assert.New(t)
+
+	root, _ := ioutil.TempDir("", "canaryglob")
+	defer os.RemoveAll(root)
+
+	for _, path := range []string{
+		"www/app1/current/Gemfile.lock",
+		"www/app2/current/Gemfile.lock",
+		"www/app3/shared/Gemfile.lock",
+		"apps/a/Gemfile.lock",
+		"apps/b/c/d/Gemfile.lock",
+	} {
+		full := filepath.Join(root, path)
+		os.MkdirAll(filepath.Dir(full), 0755)
+		ioutil.WriteFile(full, []byte("GEM"), 0644)
+	}
+
+	paths, err := globPaths(root + "/www/*/current/Gemfile.lock")
+	assert.Nil(err)
+	assert.Equal([]string{
+		root + "/www/app1/current/Gemfile.lock",
+		root + "/www/app2/current/Gemfile.lock",
+	}, paths)
+
+	paths, err = globPaths(root + "/apps/**/Gemfile.lock")
+	assert.Nil(err)
+	assert.Equal([]string{
+		root + "/apps/a/Gemfile.lock",
+		root + "/apps/b/c/d/Gemfile.lock",
+	}, paths)
+
+	// ** also matches no directories at all
+	paths, err = globPaths(root + "/**/app3/**/Gemfile.lock")
+	assert.Nil(err)
+	assert.Equal([]string{root + "/www/app3/shared/Gemfile.lock"}, paths)
+
+	// directories themselves never match
+	paths, err = globPaths(root + "/www/*")
+	assert.Nil(err)
+	assert.Equal(0, len(paths))
+
+	_, err = globPaths(root + "/**/[")
+	assert.NotNil(err)
+}
+
+func TestGlobWatcher(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	root, _ := ioutil.TempDir("", "canaryglob")
+	defer os.RemoveAll(root)
+
+	first := filepath.Join(root, "app1", "Gemfile.lock")
+	second := filepath.Join(root, "app2", "Gemfile.lock")
+	os.MkdirAll(filepath.Dir(first), 0755)
+	ioutil.WriteFile(first, []byte("GEM"), 0644)
+
+	var added, removed []string
+	testcb := func(a []string, r []string) {
+		added = a
+		removed = r
+	}
+
+	// the initial expansion happens on creation
+	pw := NewGlobWatcher(root+"/*/Gemfile.lock", testcb).(*pathsWatcher)
+	assert.Equal([]string{first}, added)
+	assert.Equal(0, len(removed))
+
+	os.MkdirAll(filepath.Dir(second), 0755)
+	ioutil.WriteFile(second, []byte("GEM"), 0644)
+	os.RemoveAll(filepath.Dir(first))
+
+	pw.scan()
+	assert.Equal([]string{second}, added)
+	assert.Equal([]string{first}, removed)
+	assert.Equal([]string{second}, pw.Matches())
+}
@@ -0,0 +1,243 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// where we look for processes
+var procRoot = "/proc"
+
+// The contents of /proc/<pid>/cgroup, i.e. a hierarchy-id:controllers:path
+// line per hierarchy (just the one, 0::path, with cgroups v2)
+func readCgroup(pid int) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "cgroup"))
+	return string(data), err
+}
+
+func readStat(pid int) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "stat"))
+	return string(data), err
+}
+
+// The command name in /proc/<pid>/stat may contain spaces and parens, so the
+// fields we want are counted from the last paren.
+func parentPid(pid int) (int, error) {
+	stat, err := readStat(pid)
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 2 {
+		return 0, os.ErrInvalid
+	}
+	return strconv.Atoi(fields[1])
+}
+
+// The path of the executable a process is running. If it was deleted (say, by
+// an upgrade) the kernel tacks " (deleted)" onto it, which we leave off.
+func processExe(pid int) (string, error) {
+	exe, err := os.Readlink(filepath.Join(procRoot, strconv.Itoa(pid), "exe"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(exe, " (deleted)"), nil
+}
+
+// The real uid a process runs as, per the Uid line of /proc/<pid>/status
+func processUid(pid int) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "status"))
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "Uid:") {
+			fields := strings.Fields(strings.TrimPrefix(line, "Uid:"))
+			if len(fields) > 0 {
+				return fields[0], nil
+			}
+		}
+	}
+	return "", os.ErrInvalid
+}
+
+// cgroupPath picks the path that best describes where a process lives: the
+// unified (v2) hierarchy if there is one, else systemd's own.
+func cgroupPath(cgroup string) string {
+	var fallback string
+	for _, line := range strings.Split(cgroup, "\n") {
+		field := strings.SplitN(line, ":", 3)
+		if len(field) != 3 {
+			continue
+		}
+
+		switch {
+		case field[0] == "0" && field[1] == "":
+			return field[2]
+		case field[1] == "name=systemd":
+			fallback = field[2]
+		case fallback == "":
+			fallback = field[2]
+		}
+	}
+	return fallback
+}
+
+// systemdSlice returns the innermost systemd slice a cgroup path is in, or ""
+func systemdSlice(path string) string {
+	segments := strings.Split(path, "/")
+	for i := len(segments) - 1; i >= 0; i-- {
+		if strings.HasSuffix(segments[i], ".slice") {
+			return segments[i]
+		}
+	}
+	return ""
+}
+
+// systemdUnit returns the systemd unit (the innermost service or scope) a
+// cgroup path belongs to, or "" if it's not in one
+func systemdUnit(path string) string {
+	segments := strings.Split(path, "/")
+	for i := len(segments) - 1; i >= 0; i-- {
+		for _, suffix := range []string{".service", ".scope", ".socket", ".mount", ".swap"} {
+			if strings.HasSuffix(segments[i], suffix) {
+				return segments[i]
+			}
+		}
+	}
+	return ""
+}
+
+// cpuTime is how much CPU time we've used so far
+var cpuTime = processCPUTime
+
+// counting the commands we ran (libspector shells out to the package manager)
+// and all of our goroutines
+func processCPUTime() time.Duration {
+	var self, children syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &self)
+	syscall.Getrusage(syscall.RUSAGE_CHILDREN, &children)
+
+	total := time.Duration(0)
+	for _, tv := range []syscall.Timeval{self.Utime, self.Stime, children.Utime, children.Stime} {
+		total += time.Duration(tv.Nano())
+	}
+	return total
+}
+
+// A file a process has mapped into memory
+type mapping struct {
+	Path    string
+	Dev     string // major:minor, in hex
+	Inode   uint64
+	Deleted bool // the file's since been removed (or replaced)
+}
+
+// The files a process has mapped into memory, per /proc/<pid>/maps, each once
+func processMappings(pid int) ([]mapping, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "maps"))
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	mappings := []mapping{}
+	for _, line := range strings.Split(string(data), "\n") {
+		// address perms offset dev inode path
+		fields := strings.SplitN(line, " ", 6)
+		if len(fields) < 6 {
+			continue
+		}
+
+		path := strings.TrimSpace(fields[5])
+		if !strings.HasPrefix(path, "/") {
+			continue
+		}
+
+		// a file that's since been replaced gets " (deleted)" tacked on
+		deleted := strings.HasSuffix(path, " (deleted)")
+		path = strings.TrimSuffix(path, " (deleted)")
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+
+		inode, _ := strconv.ParseUint(fields[4], 10, 64)
+		mappings = append(mappings, mapping{Path: path, Dev: fields[3], Inode: inode, Deleted: deleted})
+	}
+	return mappings, nil
+}
+
+// Just the paths of the files a process has mapped
+func processMaps(pid int) ([]string, error) {
+	mappings, err := processMappings(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, len(mappings))
+	for i, m := range mappings {
+		paths[i] = m.Path
+	}
+	return paths, nil
+}
+
+// The files a process has open, leaving out sockets, pipes and the like
+func processOpenFiles(pid int) ([]string, error) {
+	fdDir := filepath.Join(procRoot, strconv.Itoa(pid), "fd")
+	fds, err := ioutil.ReadDir(fdDir)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for _, fd := range fds {
+		path, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+		if err != nil || !strings.HasPrefix(path, "/") {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// The arguments a process was started with, per /proc/<pid>/cmdline
+func processCmdline(pid int) ([]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimRight(string(data), "\x00"), "\x00"), nil
+}
+
+// The value of a variable in the environment a process was started with, or ""
+func processEnv(pid int, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "environ"))
+	if err != nil {
+		return ""
+	}
+
+	for _, variable := range strings.Split(string(data), "\x00") {
+		if strings.HasPrefix(variable, name+"=") {
+			return strings.TrimPrefix(variable, name+"=")
+		}
+	}
+	return ""
+}
+
+func processCwd(pid int) (string, error) {
+	return os.Readlink(filepath.Join(procRoot, strconv.Itoa(pid), "cwd"))
+}
+
+// Where a path as the process sees it can be found from here, which matters
+// for processes running in containers
+func processPath(pid int, path string) string {
+	return filepath.Join(procRoot, strconv.Itoa(pid), "root", path)
+}
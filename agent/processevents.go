@@ -0,0 +1,150 @@
+package agent
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// What can happen to the processes we watch between two scans
+const (
+	eventProcessStarted  = "process_started"
+	eventProcessExited   = "process_exited"
+	eventProcessOutdated = "process_outdated"
+	eventLibraryReplaced = "library_replaced"
+)
+
+// Past this many events waiting to go out, it's cheaper to send a snapshot
+const maxPendingEvents = 1000
+
+type processEvent struct {
+	Type    string
+	At      time.Time
+	Process watchedProcess
+	Library string // for library_replaced
+	Reason  string // ditto, why the library's stale (if we know)
+}
+
+// diffStates works out what happened between two scans. Processes the new scan
+// didn't get around to (it ran out of CPU time) didn't go anywhere, unless
+// their pid now belongs to another one.
+func diffStates(old *systemState, current *systemState, at time.Time) []processEvent {
+	events := []processEvent{}
+
+	before := map[int]watchedProcess{}
+	for _, proc := range old.processes {
+		before[proc.Pid] = proc
+	}
+	after := map[int]bool{}
+
+	for _, proc := range current.processes {
+		after[proc.Pid] = true
+
+		prev, ok := before[proc.Pid]
+		if !ok || !prev.ProcessStartedAt.Equal(proc.ProcessStartedAt) {
+			if ok {
+				// the pid got reused
+				events = append(events, processEvent{Type: eventProcessExited, At: at, Process: prev})
+			}
+			events = append(events, processEvent{Type: eventProcessStarted, At: at, Process: proc})
+			continue
+		}
+
+		wasOutdated := map[string]bool{}
+		for _, lib := range prev.ProcessLibraries {
+			wasOutdated[lib.libraryPath] = lib.Outdated
+		}
+		for _, lib := range proc.ProcessLibraries {
+			if lib.Outdated && !wasOutdated[lib.libraryPath] {
+				events = append(events, processEvent{
+					Type:    eventLibraryReplaced,
+					At:      at,
+					Process: proc,
+					Library: lib.libraryPath,
+					Reason:  lib.Reason,
+				})
+			}
+		}
+
+		if proc.Outdated && !prev.Outdated {
+			events = append(events, processEvent{Type: eventProcessOutdated, At: at, Process: proc})
+		}
+	}
+
+	for _, proc := range old.processes {
+		started, unscanned := current.unscanned[proc.Pid]
+		if !after[proc.Pid] && !(unscanned && started.Equal(proc.ProcessStartedAt)) {
+			events = append(events, processEvent{Type: eventProcessExited, At: at, Process: proc})
+		}
+	}
+
+	sort.Stable(byEventPid(events))
+	return events
+}
+
+// The libraries the events refer to, so they can go out along with them
+func eventLibraries(events []processEvent, state *systemState) processLibraryMap {
+	libraries := processLibraryMap{}
+	for _, event := range events {
+		switch event.Type {
+		case eventProcessStarted, eventProcessOutdated:
+			for _, lib := range event.Process.ProcessLibraries {
+				libraries[lib.libraryPath] = state.libraries[lib.libraryPath]
+			}
+		case eventLibraryReplaced:
+			libraries[event.Library] = state.libraries[event.Library]
+		}
+	}
+	return libraries
+}
+
+func marshalEvents(events []processEvent, libraries processLibraryMap) ([]byte, error) {
+	eventMaps := make([]map[string]interface{}, len(events))
+	for i, event := range events {
+		eventMap := map[string]interface{}{
+			"type":    event.Type,
+			"at":      event.At,
+			"pid":     event.Process.Pid,
+			"started": event.Process.ProcessStartedAt,
+		}
+
+		switch event.Type {
+		case eventProcessStarted:
+			eventMap["process"] = processToMap(event.Process)
+		case eventProcessOutdated:
+			outdated := []string{}
+			for _, lib := range event.Process.ProcessLibraries {
+				if lib.Outdated {
+					outdated = append(outdated, lib.libraryPath)
+				}
+			}
+			eventMap["libraries"] = outdated
+		case eventLibraryReplaced:
+			eventMap["library_path"] = event.Library
+			if event.Reason != "" {
+				eventMap["stale"] = event.Reason
+			}
+		}
+		eventMaps[i] = eventMap
+	}
+
+	libraryMaps := make(map[string]interface{}, len(libraries))
+	for path, lib := range libraries {
+		libraryMaps[path] = libToMap(lib)
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"server": map[string]interface{}{
+			"process_events": map[string]interface{}{
+				"events":    eventMaps,
+				"libraries": libraryMaps,
+			},
+		},
+	})
+}
+
+type byEventPid []processEvent
+
+func (s byEventPid) Len() int           { return len(s) }
+func (s byEventPid) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byEventPid) Less(i, j int) bool { return s[i].Process.Pid < s[j].Process.Pid }
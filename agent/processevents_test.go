@@ -0,0 +1,176 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/appcanary/agent/conf"
+	"github.com/appcanary/testify/assert"
+)
+
+func TestDiffStates(t *testing.T) {
+	assert := assert.New(t)
+
+	then := time.Now().Add(-time.Hour)
+	now := time.Now()
+
+	old := &systemState{processes: systemProcesses{
+		{Pid: 10, ProcessStartedAt: then, CommandName: "nginx", ProcessLibraries: []processLibrary{
+			{libraryPath: "/lib/libssl.so.3"},
+			{libraryPath: "/lib/libz.so.1"},
+		}},
+		{Pid: 20, ProcessStartedAt: then, CommandName: "cron"},
+		{Pid: 30, ProcessStartedAt: then, CommandName: "sshd"},
+		{Pid: 40, ProcessStartedAt: then, CommandName: "rsyslogd"},
+	}}
+
+	current := &systemState{
+		processes: systemProcesses{
+			// got its libssl upgraded from under it
+			{Pid: 10, ProcessStartedAt: then, CommandName: "nginx", Outdated: true, ProcessLibraries: []processLibrary{
+				{libraryPath: "/lib/libssl.so.3", Outdated: true, Reason: staleDeleted},
+				{libraryPath: "/lib/libz.so.1"},
+			}},
+			// same pid, different process
+			{Pid: 30, ProcessStartedAt: now, CommandName: "bash"},
+			{Pid: 50, ProcessStartedAt: now, CommandName: "ruby"},
+		},
+		libraries: processLibraryMap{
+			"/lib/libssl.so.3": {Path: "/lib/libssl.so.3", PackageName: "libssl3"},
+			"/lib/libz.so.1":   {Path: "/lib/libz.so.1", PackageName: "zlib1g"},
+		},
+		// we didn't get around to it, it didn't exit
+		unscanned: map[int]time.Time{40: then},
+	}
+
+	events := diffStates(old, current, now)
+
+	types := []string{}
+	pids := []int{}
+	for _, event := range events {
+		types = append(types, event.Type)
+		pids = append(pids, event.Process.Pid)
+	}
+	assert.Equal([]string{eventLibraryReplaced, eventProcessOutdated, eventProcessExited, eventProcessExited, eventProcessStarted, eventProcessStarted}, types)
+	assert.Equal([]int{10, 10, 20, 30, 30, 50}, pids)
+	assert.Equal("/lib/libssl.so.3", events[0].Library)
+	assert.Equal(staleDeleted, events[0].Reason)
+	assert.Equal("sshd", events[3].Process.CommandName)
+	assert.Equal("bash", events[4].Process.CommandName)
+
+	// the outdated library goes out with the events; zlib only goes along
+	// because it's part of a process we announce in full
+	libraries := eventLibraries(events, current)
+	assert.Equal(2, len(libraries))
+
+	body, err := marshalEvents(events, libraries)
+	assert.Nil(err)
+
+	var shipped map[string]map[string]map[string]interface{}
+	assert.Nil(json.Unmarshal(body, &shipped))
+	shippedEvents := shipped["server"]["process_events"]["events"].([]interface{})
+	assert.Equal(6, len(shippedEvents))
+	replaced := shippedEvents[0].(map[string]interface{})
+	assert.Equal("library_replaced", replaced["type"])
+	assert.Equal("/lib/libssl.so.3", replaced["library_path"])
+	assert.Equal("deleted", replaced["stale"])
+
+	assert.Equal(0, len(diffStates(current, current, now)))
+}
+
+func TestProcessWatcherSnapshots(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	pw := NewProcessWatcher("*", testCallbackNOP, conf.WatcherConf{Exe: "^/nonexistent/"}).(*processWatcher)
+
+	// the first thing to go out is the whole map
+	events, snapshot := pw.TakeEvents(false)
+	assert.Nil(events)
+	assert.True(snapshot)
+
+	// then nothing, as long as nothing happens
+	pw.scan()
+	events, snapshot = pw.TakeEvents(false)
+	assert.Nil(events)
+	assert.False(snapshot)
+
+	// and then only what happened
+	pw.Lock()
+	pw.state = &systemState{processes: systemProcesses{{Pid: 1234, CommandName: "gone"}}}
+	pw.Unlock()
+	pw.scan()
+	events, snapshot = pw.TakeEvents(false)
+	assert.NotNil(events)
+	assert.False(snapshot)
+	assert.Contains(string(events), `"type":"process_exited"`)
+
+	// unless it's time for another snapshot, or the last one didn't make it
+	pw.Resync()
+	_, snapshot = pw.TakeEvents(false)
+	assert.True(snapshot)
+
+	_, snapshot = pw.TakeEvents(true)
+	assert.True(snapshot)
+
+	pw.Lock()
+	pw.lastSnapshot = time.Now().Add(-conf.DEFAULT_PROCESS_SNAPSHOT_INTERVAL)
+	pw.Unlock()
+	_, snapshot = pw.TakeEvents(false)
+	assert.True(snapshot)
+}
+
+func TestUnscannedProcesses(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	then := time.Now().Add(-time.Hour)
+	pw := NewProcessWatcher("*", testCallbackNOP, conf.WatcherConf{Exe: "^/nonexistent/"}).(*processWatcher)
+
+	scanned := func(procs ...watchedProcess) *systemState {
+		return &systemState{
+			processes: procs,
+			libraries: processLibraryMap{"/lib/libssl.so.3": {Path: "/lib/libssl.so.3", PackageName: "libssl3"}},
+			unscanned: map[int]time.Time{},
+		}
+	}
+	record := func(state *systemState) []processEvent {
+		state.carryUnscanned(pw.state)
+		pw.recordEvents(state)
+		events := pw.events
+		pw.events = nil
+		return events
+	}
+
+	nginx := watchedProcess{Pid: 40, ProcessStartedAt: then, CommandName: "nginx", ProcessLibraries: []processLibrary{
+		{libraryPath: "/lib/libssl.so.3"},
+	}}
+	record(scanned(nginx))
+
+	// we ran out of CPU time before getting to it: it's still there as far
+	// as we know, libraries and all
+	skipped := &systemState{processes: systemProcesses{}, libraries: processLibraryMap{}, unscanned: map[int]time.Time{40: then}}
+	assert.Equal(0, len(record(skipped)))
+	assert.Equal(1, len(pw.state.processes))
+	assert.Equal("nginx", pw.state.processes[0].CommandName)
+	assert.Equal("libssl3", pw.state.libraries["/lib/libssl.so.3"].PackageName)
+
+	// so when we do get to it, it's not new
+	assert.Equal(0, len(record(scanned(nginx))))
+
+	// and when it's gone, it's gone
+	events := record(scanned())
+	assert.Equal(1, len(events))
+	assert.Equal(eventProcessExited, events[0].Type)
+	assert.Equal(40, events[0].Process.Pid)
+
+	// if its pid went to another process in the meantime it exited too,
+	// whatever the new one turns out to be
+	record(scanned(nginx))
+	reused := &systemState{processes: systemProcesses{}, libraries: processLibraryMap{}, unscanned: map[int]time.Time{40: time.Now()}}
+	events = record(reused)
+	assert.Equal(1, len(events))
+	assert.Equal(eventProcessExited, events[0].Type)
+	assert.Equal(0, len(pw.state.processes))
+}
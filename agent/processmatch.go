@@ -0,0 +1,189 @@
+package agent
+
+import (
+	"fmt"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/appcanary/agent/conf"
+	"github.com/appcanary/libspector"
+)
+
+// Which processes a process watcher looks at: those libspector finds by name
+// (or all of them, for "*"), narrowed down by whichever of the other criteria
+// are set.
+type processMatcher struct {
+	name    string
+	exe     *regexp.Regexp
+	cmdline *regexp.Regexp
+	user    string
+	ppid    int
+	unit    string
+	cgroup  *regexp.Regexp
+
+	// uid => user name, so we don't look up the same users over and over
+	usersLock sync.Mutex
+	users     map[string]string
+}
+
+func newProcessMatcher(name string, setting conf.WatcherConf) (*processMatcher, error) {
+	matcher := &processMatcher{
+		name:  name,
+		user:  setting.User,
+		ppid:  setting.Ppid,
+		unit:  setting.Unit,
+		users: map[string]string{},
+	}
+
+	var err error
+	if matcher.exe, err = compileMatch("exe", setting.Exe); err != nil {
+		return nil, err
+	}
+	if matcher.cmdline, err = compileMatch("cmdline", setting.Cmdline); err != nil {
+		return nil, err
+	}
+	if matcher.cgroup, err = compileMatch("cgroup", setting.Cgroup); err != nil {
+		return nil, err
+	}
+
+	if matcher.unit != "" {
+		if _, err := filepath.Match(matcher.unit, matcher.unit); err != nil {
+			return nil, fmt.Errorf("bad unit pattern %q: %s", matcher.unit, err)
+		}
+	}
+
+	return matcher, nil
+}
+
+func compileMatch(what string, expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("bad %s regexp %q: %s", what, expr, err)
+	}
+	return re, nil
+}
+
+// e.g. "* exe=~^/usr/bin/ruby user=deploy"
+func (m *processMatcher) String() string {
+	desc := []string{m.name}
+	if m.exe != nil {
+		desc = append(desc, "exe=~"+m.exe.String())
+	}
+	if m.cmdline != nil {
+		desc = append(desc, "cmdline=~"+m.cmdline.String())
+	}
+	if m.user != "" {
+		desc = append(desc, "user="+m.user)
+	}
+	if m.ppid != 0 {
+		desc = append(desc, "ppid="+strconv.Itoa(m.ppid))
+	}
+	if m.unit != "" {
+		desc = append(desc, "unit="+m.unit)
+	}
+	if m.cgroup != nil {
+		desc = append(desc, "cgroup=~"+m.cgroup.String())
+	}
+	return strings.Join(desc, " ")
+}
+
+func (m *processMatcher) processes() ([]libspector.Process, error) {
+	var procs []libspector.Process
+	var err error
+
+	if m.name == "*" {
+		procs, err = libspector.AllProcesses()
+	} else {
+		procs, err = libspector.FindProcess(m.name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	matched := make([]libspector.Process, 0, len(procs))
+	for _, proc := range procs {
+		if m.matches(proc) {
+			matched = append(matched, proc)
+		}
+	}
+	return matched, nil
+}
+
+// matches checks the criteria cheapest first. Anything we can't read about a
+// process (it may well have exited) means it doesn't match.
+func (m *processMatcher) matches(proc libspector.Process) bool {
+	pid := proc.PID()
+
+	if m.ppid != 0 {
+		if ppid, err := parentPid(pid); err != nil || ppid != m.ppid {
+			return false
+		}
+	}
+
+	if m.user != "" && !m.matchesUser(pid) {
+		return false
+	}
+
+	if m.exe != nil {
+		if exe, err := processExe(pid); err != nil || !m.exe.MatchString(exe) {
+			return false
+		}
+	}
+
+	if m.cmdline != nil {
+		args, err := proc.CommandArgs()
+		if err != nil || !m.cmdline.MatchString(args) {
+			return false
+		}
+	}
+
+	if m.unit != "" || m.cgroup != nil {
+		cgroup, err := readCgroup(pid)
+		if err != nil {
+			return false
+		}
+		path := cgroupPath(cgroup)
+
+		if m.cgroup != nil && !m.cgroup.MatchString(path) {
+			return false
+		}
+		if m.unit != "" {
+			if ok, _ := filepath.Match(m.unit, systemdUnit(path)); !ok {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// users can be given by name or uid
+func (m *processMatcher) matchesUser(pid int) bool {
+	uid, err := processUid(pid)
+	if err != nil {
+		return false
+	}
+	if uid == m.user {
+		return true
+	}
+
+	m.usersLock.Lock()
+	defer m.usersLock.Unlock()
+
+	name, ok := m.users[uid]
+	if !ok {
+		if u, err := user.LookupId(uid); err == nil {
+			name = u.Username
+		}
+		m.users[uid] = name
+	}
+	return name == m.user
+}
@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/appcanary/agent/conf"
+	"github.com/appcanary/testify/assert"
+)
+
+func matchedPids(assert *assert.Assertions, setting conf.WatcherConf) map[int]bool {
+	matcher, err := newProcessMatcher("*", setting)
+	assert.Nil(err)
+
+	procs, err := matcher.processes()
+	assert.Nil(err)
+
+	pids := map[int]bool{}
+	for _, proc := range procs {
+		pids[proc.PID()] = true
+	}
+	return pids
+}
+
+func TestProcessMatcher(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	exe, err := processExe(os.Getpid())
+	assert.Nil(err)
+	me, err := user.Current()
+	assert.Nil(err)
+
+	// that's us
+	pids := matchedPids(assert, conf.WatcherConf{
+		Exe:  "^" + regexp.QuoteMeta(exe) + "$",
+		Ppid: os.Getppid(),
+		User: me.Username,
+	})
+	assert.True(pids[os.Getpid()])
+
+	pids = matchedPids(assert, conf.WatcherConf{User: me.Uid, Cmdline: "test"})
+	assert.True(pids[os.Getpid()])
+
+	// and these aren't
+	pids = matchedPids(assert, conf.WatcherConf{Exe: "^/nonexistent/"})
+	assert.False(pids[os.Getpid()])
+
+	pids = matchedPids(assert, conf.WatcherConf{Unit: "no-such-thing.service"})
+	assert.False(pids[os.Getpid()])
+
+	_, err = newProcessMatcher("*", conf.WatcherConf{Cmdline: "(unbalanced"})
+	assert.NotNil(err)
+
+	matcher, err := newProcessMatcher("*", conf.WatcherConf{Exe: "ruby$", User: "deploy", Unit: "puma*.service"})
+	assert.Nil(err)
+	assert.Equal("* exe=~ruby$ user=deploy unit=puma*.service", matcher.String())
+}
+
+func TestCgroupPath(t *testing.T) {
+	assert := assert.New(t)
+
+	v2 := "0::/system.slice/puma.service\n"
+	assert.Equal("/system.slice/puma.service", cgroupPath(v2))
+	assert.Equal("puma.service", systemdUnit(cgroupPath(v2)))
+
+	v1 := "12:pids:/system.slice/sidekiq.service\n1:name=systemd:/system.slice/sidekiq.service\n"
+	assert.Equal("/system.slice/sidekiq.service", cgroupPath(v1))
+	assert.Equal("sidekiq.service", systemdUnit(cgroupPath(v1)))
+
+	assert.Equal("session-2.scope", systemdUnit("/user.slice/user-1000.slice/session-2.scope"))
+	assert.Equal("", systemdUnit("/"))
+}
+
+func TestAnnotateCgroup(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	dir, _ := ioutil.TempDir("", "canarycgroup")
+	defer os.RemoveAll(dir)
+	procRoot = dir
+	defer func() { procRoot = "/proc" }()
+
+	os.MkdirAll(filepath.Join(dir, "42"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "42", "cgroup"), []byte("0::/system.slice/nginx.service\n"), 0644)
+	os.MkdirAll(filepath.Join(dir, "43"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "43", "cgroup"), []byte("0::/system.slice/docker-"+dockerID+".scope\n"), 0644)
+
+	wp := watchedProcess{Pid: 42}
+	wp.annotateCgroup()
+	assert.Equal("/system.slice/nginx.service", wp.Cgroup)
+	assert.Equal("nginx.service", wp.Unit)
+	assert.Equal("system.slice", wp.Slice)
+	assert.Equal("", wp.ContainerID)
+
+	wp = watchedProcess{Pid: 43}
+	wp.annotateCgroup()
+	assert.Equal("docker-"+dockerID+".scope", wp.Unit)
+	assert.Equal(dockerID, wp.ContainerID)
+
+	// gone by the time we looked
+	wp = watchedProcess{Pid: 44}
+	wp.annotateCgroup()
+	assert.Equal("", wp.Cgroup)
+}
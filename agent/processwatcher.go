@@ -18,6 +18,8 @@ type ProcessWatcher interface {
 	Stop()
 	Match() string
 	StateJson() []byte
+	TakeEvents(forceSnapshot bool) ([]byte, bool)
+	Resync()
 }
 
 // Types
@@ -29,10 +31,27 @@ type processWatcher struct {
 	UpdatedAt    time.Time
 	OnChange     ChangeHandler
 	pollSleep    time.Duration
+	pollJitter   time.Duration
 	BeingWatched bool
 	match        string
+	matcher      *processMatcher
+	matcherErr   error
 	stateJson    []byte
 	checksum     uint32
+	cpuBudget    time.Duration
+	procCache    map[int]*cachedProcess
+	libCache     map[string]cachedLibrary
+	siteCache    map[string]sitePackages
+	sitesSeen    map[string]bool // during the current scan
+	jarCache     map[string]jarContents
+	jarsSeen     map[string]bool // ditto
+
+	// what changed since we last shipped, and when we last shipped it all
+	state            *systemState
+	events           []processEvent
+	eventLibraries   processLibraryMap
+	lastSnapshot     time.Time
+	snapshotInterval time.Duration
 }
 
 // process objects with references to systemLibraries
@@ -48,8 +67,55 @@ type systemLibrary struct {
 
 // "map" in the colloquial sense
 type systemState struct {
-	processes systemProcesses
-	libraries processLibraryMap
+	processes   systemProcesses
+	libraries   processLibraryMap
+	diagnostics []diagnostic
+	dropped     int               // diagnostics past maxDiagnostics
+	unscanned   map[int]time.Time // processes we ran out of CPU time for, by when they started
+}
+
+// carryUnscanned keeps what the previous scan found out about the processes
+// this one didn't get around to, as long as they're still the same processes,
+// so they don't drop out of the map (or come back as new) in the meantime.
+func (ss *systemState) carryUnscanned(prev *systemState) {
+	if prev == nil || len(ss.unscanned) == 0 {
+		return
+	}
+
+	for _, proc := range prev.processes {
+		started, ok := ss.unscanned[proc.Pid]
+		if !ok || !started.Equal(proc.ProcessStartedAt) {
+			continue
+		}
+
+		ss.processes = append(ss.processes, proc)
+		for _, lib := range proc.ProcessLibraries {
+			if _, ok := ss.libraries[lib.libraryPath]; ok {
+				continue
+			}
+			if sysLib, ok := prev.libraries[lib.libraryPath]; ok {
+				ss.libraries[lib.libraryPath] = sysLib
+			}
+		}
+	}
+}
+
+// one odd process or library shouldn't sink the whole process map, so what
+// went wrong gets shipped along with whatever we could find out
+type diagnostic struct {
+	Pid     int
+	Library string
+	Error   string
+}
+
+const maxDiagnostics = 100
+
+func (ss *systemState) diagnose(pid int, library string, err error) {
+	if len(ss.diagnostics) >= maxDiagnostics {
+		ss.dropped++
+		return
+	}
+	ss.diagnostics = append(ss.diagnostics, diagnostic{Pid: pid, Library: library, Error: err.Error()})
 }
 
 type processLibraryMap map[string]systemLibrary
@@ -61,11 +127,19 @@ type watchedProcess struct {
 	Pid              int
 	CommandName      string
 	CommandArgs      string
+	Cgroup           string
+	Unit             string
+	Slice            string
+	ContainerID      string
+	Language         string // ruby, python or java, if it's an interpreter we know
+	Cwd              string
+	Dependencies     []loadedDependency
 }
 
 type processLibrary struct {
 	libraryPath string // point to a systemLibrary
 	Outdated    bool
+	Reason      string // why the maps say it's stale, if they do
 }
 
 func (ss *systemState) MarshalJSON() ([]byte, error) {
@@ -76,22 +150,51 @@ func (ss *systemState) MarshalJSON() ([]byte, error) {
 
 	processes := make([]map[string]interface{}, len(ss.processes))
 	for i, proc := range ss.processes {
-		processes[i] = map[string]interface{}{
-			"started":   proc.ProcessStartedAt,
-			"libraries": procLibsToMapArray(proc.ProcessLibraries),
-			"outdated":  proc.Outdated,
-			"pid":       proc.Pid,
-			"name":      proc.CommandName,
-			"args":      proc.CommandArgs,
+		processes[i] = processToMap(proc)
+	}
+
+	diagnostics := make([]map[string]interface{}, len(ss.diagnostics))
+	for i, diag := range ss.diagnostics {
+		diagnostics[i] = map[string]interface{}{"error": diag.Error}
+		if diag.Pid != 0 {
+			diagnostics[i]["pid"] = diag.Pid
+		}
+		if diag.Library != "" {
+			diagnostics[i]["library"] = diag.Library
 		}
 	}
 
 	return json.Marshal(map[string]interface{}{
-		"processes": processes,
-		"libraries": libraries,
+		"processes":      processes,
+		"libraries":      libraries,
+		"errors":         diagnostics,
+		"errors_dropped": ss.dropped,
 	})
 }
 
+func processToMap(proc watchedProcess) map[string]interface{} {
+	procMap := map[string]interface{}{
+		"started":   proc.ProcessStartedAt,
+		"libraries": procLibsToMapArray(proc.ProcessLibraries),
+		"outdated":  proc.Outdated,
+		"pid":       proc.Pid,
+		"name":      proc.CommandName,
+		"args":      proc.CommandArgs,
+		"cgroup":    proc.Cgroup,
+		"unit":      proc.Unit,
+		"slice":     proc.Slice,
+		"container": proc.ContainerID,
+	}
+
+	if proc.Language != "" {
+		procMap["language"] = proc.Language
+		procMap["cwd"] = proc.Cwd
+		procMap["dependencies"] = dependenciesToMapArray(proc.Dependencies)
+	}
+
+	return procMap
+}
+
 func procLibsToMapArray(libs []processLibrary) []map[string]interface{} {
 	procLibs := make([]map[string]interface{}, len(libs))
 
@@ -100,11 +203,29 @@ func procLibsToMapArray(libs []processLibrary) []map[string]interface{} {
 			"outdated":     lib.Outdated,
 			"library_path": lib.libraryPath,
 		}
+		if lib.Reason != "" {
+			procLibs[i]["stale"] = lib.Reason
+		}
 	}
 
 	return procLibs
 }
 
+func dependenciesToMapArray(deps []loadedDependency) []map[string]interface{} {
+	procDeps := make([]map[string]interface{}, len(deps))
+
+	for i, dep := range deps {
+		procDeps[i] = map[string]interface{}{
+			"name":    dep.Name,
+			"version": dep.Version,
+			"path":    dep.Path,
+			"native":  dep.Native,
+		}
+	}
+
+	return procDeps
+}
+
 func libToMap(lib systemLibrary) map[string]interface{} {
 	return map[string]interface{}{
 		"path":            lib.Path,
@@ -114,84 +235,102 @@ func libToMap(lib systemLibrary) map[string]interface{} {
 	}
 }
 
+// acquireState inspects the processes we're watching. What we found out about
+// a process is cached for as long as it's the same process (same pid, start
+// time and executable), and which package a library belongs to for as long
+// as the library stays put (same path and ctime), so each scan only has to
+// look into what's new. Looking into new processes stops once the scan has
+// used up its CPU budget; the rest wait for the next scan.
 func (pw *processWatcher) acquireState() *systemState {
 	log := conf.FetchLog()
 
-	lsProcs, err := pw.processes()
-	if err != nil {
-		log.Fatalf("Couldn't load processes: %s", err)
-	}
-
 	ss := systemState{
-		processes: make(systemProcesses, 0, len(lsProcs)),
+		processes: systemProcesses{},
 		libraries: make(processLibraryMap, 0), // ¯\_(ツ)_/¯
+		unscanned: map[int]time.Time{},
+	}
+
+	lsProcs, err := pw.processes()
+	if err != nil {
+		log.Errorf("Couldn't load processes: %s", err)
+		ss.diagnose(0, "", err)
+		return &ss
 	}
 
 	rejects := map[string]bool{}
+	seenProcs := map[int]bool{}
+	pw.sitesSeen = map[string]bool{}
+	pw.jarsSeen = map[string]bool{}
+	seenLibs := map[string]bool{}
+	unresolved := map[string]bool{} // libraries we only know of from the maps
+
+	startedAt := cpuTime()
+	skipped := 0
 
 	for _, lsProc := range lsProcs {
+		pid := lsProc.PID()
+
 		started, err := lsProc.Started()
 		if err != nil {
-			log.Debugf("PID %d is not running, skipping", lsProc.PID())
+			log.Debugf("PID %d is not running, skipping", pid)
 			continue
 		}
 
-		commandArgs, err := lsProc.CommandArgs()
-		if err != nil {
-			log.Debugf("Can't read command line for PID %d: %v", lsProc.PID(), err)
-			// fall through, we can live without this (?)
-		}
-
-		commandName, err := lsProc.CommandName()
-		if err != nil {
-			log.Debugf("Can't read command line for PID %d: %v", lsProc.PID(), err)
-			// fall through, we can live without this (?)
-		}
-
-		spectorLibs, err := lsProc.Libraries()
-		if err != nil {
-			if os.Getuid() != 0 && os.Geteuid() != 0 {
-				log.Debugf("Cannot examine libs for PID %d, with UID:%d, EUID:%d",
-					lsProc.PID(), os.Getuid(), os.Geteuid())
+		exe, _ := processExe(pid)
+		cached, ok := pw.procCache[pid]
+		if !ok || !cached.process.ProcessStartedAt.Equal(started) || cached.exe != exe {
+			if pw.cpuBudget > 0 && cpuTime()-startedAt >= pw.cpuBudget {
+				skipped++
+				ss.unscanned[pid] = started
 				continue
 			}
 
-			if strings.Contains(err.Error(), "42") {
-				// process went away
-				log.Debugf("Cannot examine libs for PID %d, process disappeared",
-					lsProc.PID())
+			var cacheable bool
+			cached, cacheable = introspectProcess(lsProc, started, exe, &ss)
+			if cached == nil {
 				continue
 			}
+			if cacheable {
+				pw.procCache[pid] = cached
+			}
+		}
+		seenProcs[pid] = true
 
-			// otherwise barf
-			log.Fatalf("Couldn't load libs for process %v: %s", lsProc, err)
+		wp := cached.process
+		if wp.Language != "" {
+			// interpreters load more as they go, so this can't be cached
+			wp.Dependencies = pw.loadedDependencies(pid, wp.Language, wp.ProcessStartedAt)
 		}
+		wp.ProcessLibraries = make([]processLibrary, 0, len(cached.libraries))
 
-		wp := watchedProcess{
-			ProcessStartedAt: started,
-			Pid:              lsProc.PID(),
-			ProcessLibraries: make([]processLibrary, 0, len(spectorLibs)),
-			Outdated:         false,
-			CommandName:      commandName,
-			CommandArgs:      commandArgs,
+		// what's stale per /proc/<pid>/maps, to check libspector against
+		// and to fall back on for whatever it couldn't make out
+		stale, err := staleMappings(pid, started)
+		if err != nil {
+			log.Debugf("Can't read mappings for PID %d: %v", pid, err)
 		}
+		included := map[string]bool{}
 
-		for _, spectorLib := range spectorLibs {
+		for _, spectorLib := range cached.libraries {
 			path := spectorLib.Path()
+			seenLibs[path] = true
+
 			if rejects[path] {
 				// logSDebugf("Already rejected %v", path)
 				continue
 			}
 
-			if _, ok := ss.libraries[path]; !ok {
-				sysLib, err := NewSystemLibrary(spectorLib)
+			if _, ok := ss.libraries[path]; !ok || unresolved[path] {
+				sysLib, err := pw.systemLibrary(spectorLib)
 				if err != nil {
 					// log.Debugf("error introspecting system lib %s, %v; removing...", path, err)
 					rejects[path] = true
+					ss.diagnose(0, path, err)
 					continue
 				}
 
 				ss.libraries[path] = sysLib
+				delete(unresolved, path)
 			}
 
 			lib := processLibrary{
@@ -199,19 +338,187 @@ func (pw *processWatcher) acquireState() *systemState {
 				Outdated:    spectorLib.Outdated(lsProc),
 			}
 
+			if stale != nil {
+				reason, isStale := stale[path]
+				if isStale != lib.Outdated {
+					ss.diagnose(pid, path, mappingDisagreement(pid, lib.Outdated, reason))
+				}
+				lib.Outdated = lib.Outdated || isStale
+				lib.Reason = reason
+			}
+
 			if lib.Outdated && !wp.Outdated {
 				wp.Outdated = true
 			}
 
 			wp.ProcessLibraries = append(wp.ProcessLibraries, lib)
+			included[path] = true
+		}
+
+		// libspector couldn't tell us which package these came from (or
+		// didn't list them at all), but they're stale all the same
+		for _, path := range sortedPaths(stale) {
+			if included[path] {
+				continue
+			}
+			if _, ok := ss.libraries[path]; !ok {
+				ss.libraries[path] = systemLibrary{Path: path}
+				unresolved[path] = true
+			}
+
+			wp.ProcessLibraries = append(wp.ProcessLibraries, processLibrary{
+				libraryPath: path,
+				Outdated:    true,
+				Reason:      stale[path],
+			})
+			wp.Outdated = true
 		}
 
 		ss.processes = append(ss.processes, wp)
 	}
 
+	// forget about whatever went away
+	for pid := range pw.procCache {
+		if !seenProcs[pid] {
+			delete(pw.procCache, pid)
+		}
+	}
+	for path := range pw.libCache {
+		if !seenLibs[path] {
+			delete(pw.libCache, path)
+		}
+	}
+	for site := range pw.siteCache {
+		if !pw.sitesSeen[site] {
+			delete(pw.siteCache, site)
+		}
+	}
+	for jar := range pw.jarCache {
+		if !pw.jarsSeen[jar] {
+			delete(pw.jarCache, jar)
+		}
+	}
+
+	if skipped > 0 {
+		err := fmt.Errorf("ran out of CPU time (%s), %d processes left for the next scan", pw.cpuBudget, skipped)
+		log.Info(err)
+		ss.diagnose(0, "", err)
+	}
+
 	return &ss
 }
 
+// What we found out about a process the last time we looked into it
+type cachedProcess struct {
+	process   watchedProcess
+	exe       string
+	libraries []libspector.Library
+}
+
+// Which package a library belongs to, as of its ctime
+type cachedLibrary struct {
+	ctime time.Time
+	lib   systemLibrary
+	err   error
+}
+
+// introspectProcess looks into a process we haven't seen before. It returns
+// nil if there's nothing to be known about it, and whether what we did find
+// out is worth keeping (it isn't if we couldn't read its libraries).
+func introspectProcess(lsProc libspector.Process, started time.Time, exe string, ss *systemState) (*cachedProcess, bool) {
+	log := conf.FetchLog()
+	cacheable := true
+
+	commandArgs, err := lsProc.CommandArgs()
+	if err != nil {
+		log.Debugf("Can't read command line for PID %d: %v", lsProc.PID(), err)
+		// fall through, we can live without this (?)
+	}
+
+	commandName, err := lsProc.CommandName()
+	if err != nil {
+		log.Debugf("Can't read command line for PID %d: %v", lsProc.PID(), err)
+		// fall through, we can live without this (?)
+	}
+
+	spectorLibs, err := lsProc.Libraries()
+	if err != nil {
+		if os.Getuid() != 0 && os.Geteuid() != 0 {
+			log.Debugf("Cannot examine libs for PID %d, with UID:%d, EUID:%d",
+				lsProc.PID(), os.Getuid(), os.Geteuid())
+			return nil, false
+		}
+
+		if strings.Contains(err.Error(), "42") {
+			// process went away
+			log.Debugf("Cannot examine libs for PID %d, process disappeared",
+				lsProc.PID())
+			return nil, false
+		}
+
+		// otherwise note it, and ship what we know about the
+		// process anyway
+		log.Infof("Couldn't load libs for PID %d: %s", lsProc.PID(), err)
+		ss.diagnose(lsProc.PID(), "", err)
+		cacheable = false
+	}
+
+	wp := watchedProcess{
+		ProcessStartedAt: started,
+		Pid:              lsProc.PID(),
+		Outdated:         false,
+		CommandName:      commandName,
+		CommandArgs:      commandArgs,
+	}
+	wp.annotateCgroup()
+
+	wp.Language = processLanguage(exe)
+	if wp.Language == "" && isJVM(wp.Pid) {
+		wp.Language = "java"
+	}
+	if wp.Language != "" {
+		wp.Cwd, _ = processCwd(wp.Pid)
+	}
+
+	return &cachedProcess{process: wp, exe: exe, libraries: spectorLibs}, cacheable
+}
+
+// systemLibrary looks up which package lib belongs to, unless we already did
+// since it last changed.
+func (pw *processWatcher) systemLibrary(lib libspector.Library) (systemLibrary, error) {
+	path := lib.Path()
+
+	ctime, err := lib.Ctime()
+	if err != nil {
+		return systemLibrary{}, err
+	}
+
+	if cached, ok := pw.libCache[path]; ok && cached.ctime.Equal(ctime) {
+		return cached.lib, cached.err
+	}
+
+	sysLib, err := NewSystemLibrary(lib)
+	pw.libCache[path] = cachedLibrary{ctime: ctime, lib: sysLib, err: err}
+	return sysLib, err
+}
+
+// What launched the process, as far as its cgroup tells: the systemd unit and
+// slice it's in, or the container it's running in.
+func (wp *watchedProcess) annotateCgroup() {
+	log := conf.FetchLog()
+
+	cgroup, err := readCgroup(wp.Pid)
+	if err != nil {
+		log.Debugf("Can't read cgroup for PID %d: %v", wp.Pid, err)
+		return
+	}
+
+	wp.Cgroup = cgroupPath(cgroup)
+	wp.Unit = systemdUnit(wp.Cgroup)
+	wp.Slice = systemdSlice(wp.Cgroup)
+	wp.ContainerID = containerID(cgroup)
+}
+
 func NewSystemLibrary(lib libspector.Library) (sysLib systemLibrary, err error) {
 	path := lib.Path()
 
@@ -238,15 +545,37 @@ func NewSystemLibrary(lib libspector.Library) (sysLib systemLibrary, err error)
 	return
 }
 
-func NewProcessWatcher(match string, callback ChangeHandler) Watcher {
+// Inspecting processes is expensive, so unless the (optional) settings say
+// otherwise process watchers poll a lot less often than file watchers. The
+// settings may also narrow down which processes match, by executable, command
+// line, user, parent, systemd unit or cgroup.
+func NewProcessWatcher(match string, callback ChangeHandler, settings ...conf.WatcherConf) Watcher {
 	env := conf.FetchEnv()
+	setting := watcherSettings(settings)
 
 	watcher := &processWatcher{
 		match:     match,
 		OnChange:  callback,
 		UpdatedAt: time.Now(),
-		pollSleep: env.PollSleep,
+		cpuBudget: conf.DEFAULT_PROCESS_CPU_BUDGET,
+		procCache: map[int]*cachedProcess{},
+		libCache:  map[string]cachedLibrary{},
+		siteCache: map[string]sitePackages{},
+		sitesSeen: map[string]bool{},
+		jarCache:  map[string]jarContents{},
+		jarsSeen:  map[string]bool{},
+
+		eventLibraries:   processLibraryMap{},
+		snapshotInterval: conf.DEFAULT_PROCESS_SNAPSHOT_INTERVAL,
+	}
+	watcher.pollSleep, watcher.pollJitter = pollTimes(setting, env.ProcessPollSleep)
+	if setting.SnapshotInterval > 0 {
+		watcher.snapshotInterval = time.Duration(setting.SnapshotInterval) * time.Second
+	}
+	if setting.CPUBudget > 0 {
+		watcher.cpuBudget = time.Duration(setting.CPUBudget) * time.Second
 	}
+	watcher.matcher, watcher.matcherErr = newProcessMatcher(match, setting)
 
 	// Don't scan from here, we just end up with two running at once
 	return watcher
@@ -280,6 +609,9 @@ func (pw *processWatcher) Stop() {
 }
 
 func (pw *processWatcher) Match() string {
+	if pw.matcher != nil {
+		return pw.matcher.String()
+	}
 	return pw.match
 }
 
@@ -292,18 +624,92 @@ func (pw *processWatcher) KeepPolling() bool {
 func (pw *processWatcher) setStateAttribute() {
 	log := conf.FetchLog()
 	state := pw.acquireState()
+	state.carryUnscanned(pw.state)
+
+	// what the processes run on
+	kernel := acquireKernelState()
 
 	json, err := json.Marshal(map[string]interface{}{
 		"server": map[string]interface{}{
 			"system_state": state,
+			"kernel":       kernel.toMap(),
 		},
 	})
 
 	if err != nil {
-		log.Fatal(err) // really shouldn't happen
+		// really shouldn't happen; keep what we had
+		log.Errorf("Couldn't serialize process map: %s", err)
+		return
 	}
 
 	pw.stateJson = json
+	pw.recordEvents(state)
+}
+
+// recordEvents adds what changed since the last scan to what's waiting to be
+// shipped
+func (pw *processWatcher) recordEvents(state *systemState) {
+	if pw.state != nil {
+		events := diffStates(pw.state, state, time.Now())
+		for path, lib := range eventLibraries(events, state) {
+			pw.eventLibraries[path] = lib
+		}
+		pw.events = append(pw.events, events...)
+	}
+	pw.state = state
+}
+
+// snapshotDue tells whether it's time to ship the whole map again: at first,
+// every so often to make up for whatever got lost, and when too many events
+// have piled up.
+func (pw *processWatcher) snapshotDue() bool {
+	return pw.lastSnapshot.IsZero() ||
+		time.Since(pw.lastSnapshot) >= pw.snapshotInterval ||
+		len(pw.events) > maxPendingEvents
+}
+
+// TakeEvents hands over what happened since it was last called, unless a full
+// snapshot is due (or forced), in which case the events are dropped and it
+// returns true; the snapshot is then what StateJson returns. It returns nil
+// and false if there's nothing to ship.
+func (pw *processWatcher) TakeEvents(forceSnapshot bool) ([]byte, bool) {
+	log := conf.FetchLog()
+
+	pw.Lock()
+	defer pw.Unlock()
+
+	if pw.stateJson == nil {
+		pw.setStateAttribute()
+	}
+
+	events, libraries := pw.events, pw.eventLibraries
+	pw.events, pw.eventLibraries = nil, processLibraryMap{}
+
+	if forceSnapshot || pw.snapshotDue() {
+		pw.lastSnapshot = time.Now()
+		return nil, true
+	}
+
+	if len(events) == 0 {
+		return nil, false
+	}
+
+	body, err := marshalEvents(events, libraries)
+	if err != nil {
+		// really shouldn't happen; make up for it with a snapshot
+		log.Errorf("Couldn't serialize process events: %s", err)
+		pw.lastSnapshot = time.Now()
+		return nil, true
+	}
+	return body, false
+}
+
+// Resync makes the next thing shipped a snapshot, for when what was taken
+// last didn't make it.
+func (pw *processWatcher) Resync() {
+	pw.Lock()
+	defer pw.Unlock()
+	pw.lastSnapshot = time.Time{}
 }
 
 func (pw *processWatcher) StateJson() []byte {
@@ -315,13 +721,11 @@ func (pw *processWatcher) StateJson() []byte {
 	return pw.stateJson
 }
 
-func (pw *processWatcher) processes() (procs []libspector.Process, err error) {
-	if pw.match == "*" {
-		procs, err = libspector.AllProcesses()
-	} else {
-		procs, err = libspector.FindProcess(pw.match)
+func (pw *processWatcher) processes() ([]libspector.Process, error) {
+	if pw.matcherErr != nil {
+		return nil, pw.matcherErr
 	}
-	return
+	return pw.matcher.processes()
 }
 
 func (pw *processWatcher) scan() {
@@ -330,7 +734,7 @@ func (pw *processWatcher) scan() {
 	pw.setStateAttribute()
 
 	newChecksum := crc32.ChecksumIEEE(pw.stateJson)
-	changed := newChecksum != pw.checksum
+	changed := newChecksum != pw.checksum || pw.snapshotDue()
 	pw.checksum = newChecksum
 
 	pw.Unlock() // ¯\_(ツ)_/¯
@@ -343,18 +747,25 @@ func (pw *processWatcher) scan() {
 func (pw *processWatcher) listen() {
 	for pw.KeepPolling() {
 		pw.scan()
-		// TODO: make a new var for this, it shouldn't be bound to the other
-		// watchers' schedules.
-		time.Sleep(pw.pollSleep)
+		time.Sleep(nextPoll(pw.pollSleep, pw.pollJitter))
 	}
 }
 
-func ShipProcessMap(a *Agent) {
-	watcher := NewProcessWatcher("*", func(w Watcher) {}).(*processWatcher)
-	a.OnChange(watcher)
+// oneShotProcessWatcher inspects every process for a command that runs once.
+// There's no next scan for whatever it doesn't get round to, so it takes as
+// much CPU time as it needs.
+func oneShotProcessWatcher() *processWatcher {
+	watcher := NewAllProcessWatcher(func(w Watcher) {}).(*processWatcher)
+	watcher.cpuBudget = 0
+	return watcher
+}
+
+func ShipProcessMap(a *Agent) error {
+	watcher := oneShotProcessWatcher()
+	return a.client.SendProcessState("*", watcher.StateJson())
 }
 
 func DumpProcessMap() {
-	watcher := NewProcessWatcher("*", func(w Watcher) {}).(*processWatcher)
+	watcher := oneShotProcessWatcher()
 	fmt.Printf("%s\n", string(watcher.StateJson()))
 }
@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/appcanary/agent/conf"
+	"github.com/appcanary/testify/assert"
+)
+
+func TestProcessWatcherPollInterval(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	pw := NewProcessWatcher("*", testCallbackNOP).(*processWatcher)
+	assert.Equal(conf.FetchEnv().ProcessPollSleep, pw.pollSleep)
+
+	pw = NewProcessWatcher("*", testCallbackNOP, conf.WatcherConf{PollInterval: 3600}).(*processWatcher)
+	assert.Equal(time.Hour, pw.pollSleep)
+}
+
+func TestProcessWatcherDiagnostics(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	// a process listing that fails gets shipped as such, rather than taking
+	// the agent down
+	pw := NewProcessWatcher("*", testCallbackNOP, conf.WatcherConf{Exe: "(unbalanced"}).(*processWatcher)
+
+	var state map[string]map[string]map[string]interface{}
+	assert.Nil(json.Unmarshal(pw.StateJson(), &state))
+
+	shipped := state["server"]["system_state"]
+	assert.Equal(0, len(shipped["processes"].([]interface{})))
+
+	errors := shipped["errors"].([]interface{})
+	assert.Equal(1, len(errors))
+	assert.Contains(errors[0].(map[string]interface{})["error"], "bad exe regexp")
+
+	// and there's only so many errors we hang on to
+	ss := &systemState{}
+	for i := 0; i < maxDiagnostics+5; i++ {
+		ss.diagnose(i, "", os.ErrNotExist)
+	}
+	assert.Equal(maxDiagnostics, len(ss.diagnostics))
+	assert.Equal(5, ss.dropped)
+}
+
+func TestProcessWatcherCache(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	exe, err := processExe(os.Getpid())
+	assert.Nil(err)
+	setting := conf.WatcherConf{Exe: "^" + regexp.QuoteMeta(exe) + "$", Ppid: os.Getppid()}
+
+	pw := NewProcessWatcher("*", testCallbackNOP, setting).(*processWatcher)
+	state := pw.acquireState()
+	assert.Equal(1, len(state.processes))
+	cached, ok := pw.procCache[os.Getpid()]
+	if !assert.True(ok) {
+		return
+	}
+
+	// we're still the same process, so we don't get looked at again
+	cached.process.CommandName = "from the cache"
+	state = pw.acquireState()
+	assert.Equal(1, len(state.processes))
+	assert.Equal("from the cache", state.processes[0].CommandName)
+
+	// but anything we don't know about yet waits once the CPU budget's spent
+	pw.procCache = map[int]*cachedProcess{}
+	spent := time.Duration(0)
+	cpuTime = func() time.Duration {
+		spent += time.Hour
+		return spent
+	}
+	defer func() { cpuTime = processCPUTime }()
+
+	state = pw.acquireState()
+	assert.Equal(0, len(state.processes))
+	assert.Equal(1, len(state.diagnostics))
+	assert.Contains(state.diagnostics[0].Error, "ran out of CPU time")
+}
@@ -0,0 +1,216 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Processes running outdated libraries that get restarted together, along
+// with what's outdated and how to restart them (if we know)
+type RestartGroup struct {
+	Name      string
+	Command   *UpgradeCommand
+	Manual    bool // in a unit we won't restart, see manualRestartUnits
+	Processes []watchedProcess
+	Libraries []systemLibrary
+}
+
+// Units restarting which would do more harm than good: login sessions and
+// consoles, systemd's own plumbing, and (see ownUnit) the agent itself, which
+// wouldn't live to see the rest of the plan through.
+var manualRestartUnits = []string{"user@*.service", "session-*.scope", "getty@*", "serial-getty@*", "systemd-*"}
+
+type RestartPlan []RestartGroup
+
+// BuildRestartPlan inspects every process and works out what needs restarting
+// now that the libraries they loaded have been upgraded underneath them.
+func BuildRestartPlan() RestartPlan {
+	watcher := oneShotProcessWatcher()
+	return planRestarts(watcher.acquireState())
+}
+
+// planRestarts groups outdated processes by the systemd service they're part
+// of. Processes in a docker container go by container, anything else by its
+// oldest ancestor short of init, which is the best guess we have at what
+// started it.
+func planRestarts(state *systemState) RestartPlan {
+	groups := map[string]*RestartGroup{}
+	stale := map[string]map[string]bool{}
+	own := ownUnit()
+
+	for _, proc := range state.processes {
+		if !proc.Outdated {
+			continue
+		}
+
+		name, command := restartUnit(proc)
+		manual := manualRestart(proc.Unit, own)
+		if manual {
+			command = nil
+		}
+
+		group, ok := groups[name]
+		if !ok {
+			group = &RestartGroup{Name: name, Command: command, Manual: manual}
+			groups[name] = group
+			stale[name] = map[string]bool{}
+		}
+		group.Processes = append(group.Processes, proc)
+
+		for _, lib := range proc.ProcessLibraries {
+			if lib.Outdated && !stale[name][lib.libraryPath] {
+				stale[name][lib.libraryPath] = true
+				group.Libraries = append(group.Libraries, state.libraries[lib.libraryPath])
+			}
+		}
+	}
+
+	plan := make(RestartPlan, 0, len(groups))
+	for _, group := range groups {
+		sort.Sort(byLibraryPath(group.Libraries))
+		plan = append(plan, *group)
+	}
+	sort.Sort(byGroupName(plan))
+	return plan
+}
+
+func restartUnit(proc watchedProcess) (string, *UpgradeCommand) {
+	if strings.HasSuffix(proc.Unit, ".service") {
+		return proc.Unit, &UpgradeCommand{"systemctl", []string{"restart", proc.Unit}}
+	}
+
+	if proc.ContainerID != "" {
+		if name, _ := dockerContainerInfo(proc.ContainerID); name != "" {
+			return "container " + name, &UpgradeCommand{"docker", []string{"restart", name}}
+		}
+		return "container " + container{ID: proc.ContainerID}.shortID(), nil
+	}
+
+	pid, name := proc.Pid, proc.CommandName
+	for {
+		ppid, err := parentPid(pid)
+		if err != nil || ppid <= 1 {
+			break
+		}
+		pid = ppid
+		name = ""
+	}
+
+	if name == "" {
+		name = processName(pid)
+	}
+	return "process " + strconv.Itoa(pid) + " (" + name + ")", nil
+}
+
+func manualRestart(unit string, own string) bool {
+	if unit == "" {
+		return false
+	}
+	if unit == own {
+		return true
+	}
+	for _, pattern := range manualRestartUnits {
+		if ok, _ := filepath.Match(pattern, unit); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// The unit the agent's running in, if it's a service of its own (rather than,
+// say, run by hand from a session)
+func ownUnit() string {
+	cgroup, err := readCgroup(os.Getpid())
+	if err != nil {
+		return ""
+	}
+	unit := systemdUnit(cgroupPath(cgroup))
+	if !strings.HasSuffix(unit, ".service") {
+		return ""
+	}
+	return unit
+}
+
+// the command name of pid, as far as /proc/<pid>/stat says
+func processName(pid int) string {
+	stat, err := readStat(pid)
+	if err != nil {
+		return "?"
+	}
+
+	start, end := strings.Index(stat, "("), strings.LastIndex(stat, ")")
+	if start < 0 || end < start {
+		return "?"
+	}
+	return stat[start+1 : end]
+}
+
+// Print writes out the plan for whoever has to carry it out
+func (plan RestartPlan) Print(w io.Writer) {
+	if len(plan) == 0 {
+		fmt.Fprintln(w, "No processes are running outdated libraries.")
+		return
+	}
+
+	for _, group := range plan {
+		procs := make([]string, len(group.Processes))
+		for i, proc := range group.Processes {
+			procs[i] = strconv.Itoa(proc.Pid) + " " + proc.CommandName
+		}
+		fmt.Fprintf(w, "%s\n", group.Name)
+		fmt.Fprintf(w, "  processes: %s\n", strings.Join(procs, ", "))
+
+		fmt.Fprintf(w, "  outdated libraries:\n")
+		for _, lib := range group.Libraries {
+			if lib.PackageName != "" {
+				fmt.Fprintf(w, "    %s (%s %s)\n", lib.Path, lib.PackageName, lib.PackageVersion)
+			} else {
+				fmt.Fprintf(w, "    %s\n", lib.Path)
+			}
+		}
+
+		if group.Manual {
+			fmt.Fprintf(w, "  manual: not restarted automatically, restart by hand when it's safe to\n\n")
+		} else if group.Command != nil {
+			fmt.Fprintf(w, "  restart with: %s %s\n\n", group.Command.Name, strings.Join(group.Command.Args, " "))
+		} else {
+			fmt.Fprintf(w, "  restart by hand\n\n")
+		}
+	}
+
+	commands := plan.Commands()
+	fmt.Fprintf(w, "%d to restart, %d of which we know how to.\n", len(plan), len(commands))
+}
+
+// The restart commands, for the groups we know how to restart
+func (plan RestartPlan) Commands() UpgradeSequence {
+	commands := UpgradeSequence{}
+	for _, group := range plan {
+		if group.Command != nil {
+			commands = append(commands, *group.Command)
+		}
+	}
+	return commands
+}
+
+// Execute runs the restart commands, or with -dry-run only says it would
+func (plan RestartPlan) Execute() error {
+	return executeUpgradeSequence(plan.Commands())
+}
+
+type byLibraryPath []systemLibrary
+
+func (s byLibraryPath) Len() int           { return len(s) }
+func (s byLibraryPath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLibraryPath) Less(i, j int) bool { return s[i].Path < s[j].Path }
+
+type byGroupName []RestartGroup
+
+func (s byGroupName) Len() int           { return len(s) }
+func (s byGroupName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byGroupName) Less(i, j int) bool { return s[i].Name < s[j].Name }
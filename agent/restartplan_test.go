@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/appcanary/agent/conf"
+	"github.com/appcanary/testify/assert"
+)
+
+func TestPlanRestarts(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	dir, _ := ioutil.TempDir("", "canaryrestart")
+	defer os.RemoveAll(dir)
+	procRoot = dir
+	defer func() { procRoot = "/proc" }()
+
+	write := func(path string, contents string) {
+		path = filepath.Join(dir, path)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, []byte(contents), 0644)
+	}
+
+	// started by hand from a login session
+	write("15/stat", "15 (bash) S 1 15 15 0 -1\n")
+	write("20/stat", "20 (my worker) S 15 15 15 0 -1\n")
+
+	state := &systemState{
+		libraries: processLibraryMap{
+			"/lib/libssl.so.1.1": {Path: "/lib/libssl.so.1.1", PackageName: "libssl1.1", PackageVersion: "1.1.1f-1"},
+			"/lib/libz.so.1":     {Path: "/lib/libz.so.1", PackageName: "zlib1g", PackageVersion: "1.2.11"},
+		},
+		processes: systemProcesses{
+			{Pid: 10, CommandName: "ruby", Unit: "puma.service", Outdated: true, ProcessLibraries: []processLibrary{
+				{libraryPath: "/lib/libssl.so.1.1", Outdated: true},
+				{libraryPath: "/lib/libz.so.1", Outdated: false},
+			}},
+			{Pid: 11, CommandName: "ruby", Unit: "puma.service", Outdated: true, ProcessLibraries: []processLibrary{
+				{libraryPath: "/lib/libssl.so.1.1", Outdated: true},
+			}},
+			{Pid: 20, CommandName: "my worker", Unit: "session-2.scope", Outdated: true, ProcessLibraries: []processLibrary{
+				{libraryPath: "/lib/libz.so.1", Outdated: true},
+			}},
+			{Pid: 30, CommandName: "sshd", Outdated: false},
+		},
+	}
+
+	plan := planRestarts(state)
+	assert.Equal(2, len(plan))
+
+	assert.Equal("process 15 (bash)", plan[0].Name)
+	assert.Nil(plan[0].Command)
+	assert.Equal(1, len(plan[0].Processes))
+	assert.Equal("zlib1g", plan[0].Libraries[0].PackageName)
+
+	assert.Equal("puma.service", plan[1].Name)
+	assert.Equal(&UpgradeCommand{"systemctl", []string{"restart", "puma.service"}}, plan[1].Command)
+	assert.Equal(2, len(plan[1].Processes))
+	assert.Equal(1, len(plan[1].Libraries))
+	assert.Equal("libssl1.1", plan[1].Libraries[0].PackageName)
+
+	assert.Equal(UpgradeSequence{*plan[1].Command}, plan.Commands())
+
+	var out bytes.Buffer
+	plan.Print(&out)
+	assert.Contains(out.String(), "/lib/libssl.so.1.1 (libssl1.1 1.1.1f-1)")
+	assert.Contains(out.String(), "restart with: systemctl restart puma.service")
+	assert.Contains(out.String(), "restart by hand")
+
+	out.Reset()
+	planRestarts(&systemState{}).Print(&out)
+	assert.Equal("No processes are running outdated libraries.\n", out.String())
+}
+
+func TestPlanRestartExclusions(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	dir, _ := ioutil.TempDir("", "canaryrestart")
+	defer os.RemoveAll(dir)
+	procRoot = dir
+	defer func() { procRoot = "/proc" }()
+
+	// we're running as a service of our own
+	cgroup := filepath.Join(dir, strconv.Itoa(os.Getpid()), "cgroup")
+	os.MkdirAll(filepath.Dir(cgroup), 0755)
+	ioutil.WriteFile(cgroup, []byte("0::/system.slice/appcanary.service\n"), 0644)
+
+	outdated := func(pid int, name string, unit string) watchedProcess {
+		return watchedProcess{Pid: pid, CommandName: name, Unit: unit, Outdated: true}
+	}
+	state := &systemState{
+		libraries: processLibraryMap{},
+		processes: systemProcesses{
+			outdated(10, "nginx", "nginx.service"),
+			outdated(20, "appcanary", "appcanary.service"),
+			outdated(30, "systemd", "user@1000.service"),
+			outdated(40, "agetty", "getty@tty1.service"),
+			outdated(50, "systemd-journald", "systemd-journald.service"),
+		},
+	}
+
+	plan := planRestarts(state)
+	assert.Equal(5, len(plan))
+	assert.Equal(UpgradeSequence{{"systemctl", []string{"restart", "nginx.service"}}}, plan.Commands())
+
+	for _, group := range plan {
+		assert.Equal(group.Name != "nginx.service", group.Manual, group.Name)
+	}
+
+	var out bytes.Buffer
+	plan.Print(&out)
+	assert.Contains(out.String(), "appcanary.service\n")
+	assert.Contains(out.String(), "manual: not restarted automatically")
+	assert.NotContains(out.String(), "systemctl restart user@1000.service")
+	assert.Contains(out.String(), "5 to restart, 1 of which we know how to.")
+}
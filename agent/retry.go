@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/appcanary/agent/conf"
+	"github.com/cenkalti/backoff"
+)
+
+// Responses worth trying again unless configured otherwise: the API's busy,
+// or something in front of it is having trouble.
+var defaultRetryStatuses = []int{
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// RetryPolicy is how hard a client tries to get a request through. Requests
+// that don't get a response at all are always retried, those that do only if
+// it's one of Statuses; either way, only for up to MaxElapsed.
+type RetryPolicy struct {
+	MaxElapsed time.Duration
+	Statuses   map[int]bool
+}
+
+func NewRetryPolicy(config *conf.Conf) RetryPolicy {
+	env := conf.FetchEnv()
+
+	policy := RetryPolicy{MaxElapsed: env.RetryDuration, Statuses: map[int]bool{}}
+	if config.RetryFor > 0 {
+		policy.MaxElapsed = time.Duration(config.RetryFor) * time.Second
+	}
+
+	statuses := defaultRetryStatuses
+	if len(config.RetryStatuses) > 0 {
+		statuses = config.RetryStatuses
+	}
+	for _, status := range statuses {
+		policy.Statuses[status] = true
+	}
+	return policy
+}
+
+func (policy RetryPolicy) backOff() *retryAfterBackOff {
+	exp := backoff.NewExponentialBackOff()
+	exp.MaxElapsedTime = policy.MaxElapsed
+	return &retryAfterBackOff{ExponentialBackOff: exp}
+}
+
+// When the API says how long to wait (with Retry-After) we wait that long,
+// unless it's longer than we'd keep trying anyway.
+type retryAfterBackOff struct {
+	*backoff.ExponentialBackOff
+	retryAfter time.Duration
+}
+
+func (b *retryAfterBackOff) NextBackOff() time.Duration {
+	next := b.ExponentialBackOff.NextBackOff()
+	retryAfter := b.retryAfter
+	b.retryAfter = 0
+
+	if next == backoff.Stop || retryAfter <= next {
+		return next
+	}
+	if b.GetElapsedTime()+retryAfter > b.MaxElapsedTime {
+		return backoff.Stop
+	}
+	return retryAfter
+}
@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/appcanary/agent/conf"
+	"github.com/appcanary/testify/assert"
+)
+
+func testClientSettings(ctx context.Context, timeout time.Duration, maxElapsed time.Duration, statuses ...int) ClientSettings {
+	policy := RetryPolicy{MaxElapsed: maxElapsed, Statuses: map[int]bool{}}
+	for _, status := range statuses {
+		policy.Statuses[status] = true
+	}
+	return ClientSettings{HTTP: &http.Client{Timeout: timeout}, Retry: policy, Context: ctx}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+	env := conf.FetchEnv()
+
+	var lock sync.Mutex
+	attempts := []time.Time{}
+	bodies := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var file struct{ Contents string }
+		json.Unmarshal(requestBody(r), &file)
+		decoded, _ := base64.StdEncoding.DecodeString(file.Contents)
+
+		lock.Lock()
+		attempts = append(attempts, time.Now())
+		bodies = append(bodies, string(decoded))
+		tries := len(attempts)
+		lock.Unlock()
+
+		if tries < 3 {
+			w.Header().Set("Retry-After", "1")
+			tsrespond(w, http.StatusServiceUnavailable, "")
+			return
+		}
+		tsrespond(w, 200, "OK")
+	}))
+	defer ts.Close()
+	env.BaseUrl = ts.URL
+
+	// every attempt gets all of the body, and waits as long as the API says
+	client := NewClient("key", &Server{UUID: "uuid"},
+		testClientSettings(context.Background(), time.Second, 10*time.Second, http.StatusServiceUnavailable))
+	assert.Nil(client.SendFile("/var/lib/dpkg/status", "ubuntu", strings.NewReader("Package: bash\n")))
+	assert.Equal([]string{"Package: bash\n", "Package: bash\n", "Package: bash\n"}, bodies)
+	assert.True(attempts[1].Sub(attempts[0]) >= time.Second)
+	assert.True(attempts[2].Sub(attempts[1]) >= time.Second)
+
+	// what's not in the policy isn't retried
+	attempts = []time.Time{}
+	client = NewClient("key", &Server{UUID: "uuid"},
+		testClientSettings(context.Background(), time.Second, 10*time.Second, http.StatusBadGateway))
+	err := client.SendFile("/var/lib/dpkg/status", "ubuntu", strings.NewReader("Package: bash\n"))
+	assert.True(errors.Is(err, ErrServer))
+	assert.Equal(1, len(attempts))
+
+	// and when the API wants us to wait longer than we'd keep trying, we
+	// don't bother
+	attempts = []time.Time{}
+	client = NewClient("key", &Server{UUID: "uuid"},
+		testClientSettings(context.Background(), time.Second, 500*time.Millisecond, http.StatusServiceUnavailable))
+	err = client.SendFile("/var/lib/dpkg/status", "ubuntu", strings.NewReader("Package: bash\n"))
+	assert.True(errors.Is(err, ErrServer))
+	assert.Equal(1, len(attempts))
+}
+
+func TestRetryTimeouts(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+	env := conf.FetchEnv()
+
+	release := make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+	env.BaseUrl = ts.URL
+
+	// attempts that take too long are given up on, and so eventually is the
+	// request
+	client := NewClient("key", &Server{UUID: "uuid"},
+		testClientSettings(context.Background(), 50*time.Millisecond, 300*time.Millisecond))
+	start := time.Now()
+	assert.NotNil(client.SendProcessState("*", []byte("{}")))
+	assert.True(time.Since(start) < 5*time.Second)
+
+	// as is one whose context got cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	client = NewClient("key", &Server{UUID: "uuid"},
+		testClientSettings(ctx, time.Minute, time.Hour))
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	start = time.Now()
+	err := client.SendProcessState("*", []byte("{}"))
+	assert.True(errors.Is(err, context.Canceled))
+	assert.True(time.Since(start) < 5*time.Second)
+}
@@ -4,6 +4,7 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"sync"
 
 	"github.com/appcanary/agent/agent/detect"
 	"github.com/appcanary/agent/conf"
@@ -20,6 +21,11 @@ type Server struct {
 	Tags     []string `json:"tags,omitempty"`
 }
 
+// The agent's own server gets registered again (see reregister) while the
+// watchers are busy shipping as it, so its uuid is only got at through uuid()
+// and setUUID().
+var serverLock sync.Mutex
+
 // Creates a new server and syncs conf if needed
 func NewServer(agentConf *conf.Conf, serverConf *conf.ServerConf) *Server {
 	log := conf.FetchLog()
@@ -88,8 +94,62 @@ func NewServer(agentConf *conf.Conf, serverConf *conf.ServerConf) *Server {
 	}
 }
 
+// Images get reported as servers of their own, named after the image
+// reference and tagged with it, so their packages show up alongside those of
+// the hosts they'll end up running on.
+func NewImageServer(agentConf *conf.Conf, ref string, distro string, release string) *Server {
+	return newVirtualServer(agentConf, "image:"+ref, ref, ref, distro, release, []string{"image:" + ref})
+}
+
+// Containers get reported as servers of their own too, tagged with their id
+// and image (if we know it).
+func NewContainerServer(agentConf *conf.Conf, c container, distro string, release string) *Server {
+	tags := []string{"container:" + c.ID}
+	if c.Image != "" {
+		tags = append(tags, "image:"+c.Image)
+	}
+
+	name := c.Name
+	if name == "" {
+		name = c.shortID()
+	}
+
+	return newVirtualServer(agentConf, c.identity(), name, c.shortID(), distro, release, tags)
+}
+
+func newVirtualServer(agentConf *conf.Conf, identity string, name string, hostname string, distro string, release string, tags []string) *Server {
+	if distro == "" {
+		distro = "unknown"
+	}
+	if release == "" {
+		release = "unknown"
+	}
+
+	return &Server{
+		Name:     name,
+		Hostname: hostname,
+		Uname:    "unknown",
+		UUID:     agentConf.IdentityUUID(identity),
+		Distro:   distro,
+		Release:  release,
+		Tags:     append(append([]string{}, agentConf.Tags...), tags...),
+	}
+}
+
+func (server *Server) uuid() string {
+	serverLock.Lock()
+	defer serverLock.Unlock()
+	return server.UUID
+}
+
+func (server *Server) setUUID(uuid string) {
+	serverLock.Lock()
+	defer serverLock.Unlock()
+	server.UUID = uuid
+}
+
 func (server *Server) IsNew() bool {
-	return server.UUID == ""
+	return server.uuid() == ""
 }
 
 func (server *Server) IsUbuntu() bool {
@@ -0,0 +1,210 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/appcanary/agent/conf"
+)
+
+// What can end up in the spool
+const (
+	spoolFile         = "file"
+	spoolProcessState = "process_state"
+	spoolHeartbeat    = "heartbeat"
+)
+
+// Something we couldn't deliver, kept until we can
+type spoolEntry struct {
+	Type     string
+	Key      string // what it's from: a file's path, a process watcher's match
+	Kind     string // for files
+	Checksum string // ditto
+	Body     []byte
+	Queued   time.Time
+
+	name string // in the spool dir
+}
+
+// The spool keeps what we failed to send on disk, so neither giving up on the
+// API nor restarting loses it. Only the newest entry from any one watcher is
+// kept, since it supersedes whatever came before, and the oldest entries go
+// first when the spool gets too big.
+type spool struct {
+	sync.Mutex
+	dir     string
+	maxSize int64
+}
+
+func newSpool(dir string, maxSize int64) *spool {
+	return &spool{dir: dir, maxSize: maxSize}
+}
+
+// The agent's spool lives next to the var file
+func agentSpool(config *conf.Conf) *spool {
+	size := config.SpoolSize
+	if size <= 0 {
+		size = conf.DEFAULT_SPOOL_SIZE
+	}
+	return newSpool(conf.VarPath("spool"), int64(size)*1024*1024)
+}
+
+// Entries from the same watcher share a suffix, the order they were queued in
+// is the order their names sort in.
+func spoolSuffix(entryType string, key string) string {
+	sum := sha256.Sum256([]byte(entryType + "\x00" + key))
+	return "-" + hex.EncodeToString(sum[:8]) + ".json"
+}
+
+func (s *spool) put(entry *spoolEntry) error {
+	s.Lock()
+	defer s.Unlock()
+
+	entry.Queued = time.Now()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > s.maxSize {
+		return fmt.Errorf("%s is too big to spool (%d bytes)", entry.Key, len(data))
+	}
+
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+
+	suffix := spoolSuffix(entry.Type, entry.Key)
+	name := fmt.Sprintf("%020d%s", entry.Queued.UnixNano(), suffix)
+
+	// write and rename, so a crash can't leave half an entry
+	file := filepath.Join(s.dir, name)
+	if err := ioutil.WriteFile(file+".tmp", data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		return err
+	}
+
+	for _, old := range s.names() {
+		if old != name && strings.HasSuffix(old, suffix) {
+			os.Remove(filepath.Join(s.dir, old))
+		}
+	}
+
+	s.trim()
+	return nil
+}
+
+// drop forgets whatever's queued from a watcher, for when it got something
+// newer through
+func (s *spool) drop(entryType string, key string) {
+	s.Lock()
+	defer s.Unlock()
+
+	suffix := spoolSuffix(entryType, key)
+	for _, name := range s.names() {
+		if strings.HasSuffix(name, suffix) {
+			os.Remove(filepath.Join(s.dir, name))
+		}
+	}
+}
+
+// entries lists what's queued, oldest first. Anything unreadable is of no use
+// to anyone and gets thrown out.
+func (s *spool) entries() []*spoolEntry {
+	log := conf.FetchLog()
+
+	s.Lock()
+	defer s.Unlock()
+
+	entries := []*spoolEntry{}
+	for _, name := range s.names() {
+		file := filepath.Join(s.dir, name)
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+
+		var entry spoolEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			log.Infof("Discarding unreadable spool entry %s: %s", name, err)
+			os.Remove(file)
+			continue
+		}
+		entry.name = name
+		entries = append(entries, &entry)
+	}
+	return entries
+}
+
+// queued tells whether an entry is still waiting to be delivered, rather than
+// dropped or replaced since we read it
+func (s *spool) queued(entry *spoolEntry) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	_, err := os.Stat(filepath.Join(s.dir, entry.name))
+	return err == nil
+}
+
+// done removes an entry once it's been delivered, unless it's already been
+// replaced by a newer one
+func (s *spool) done(entry *spoolEntry) {
+	s.Lock()
+	defer s.Unlock()
+	os.Remove(filepath.Join(s.dir, entry.name))
+}
+
+// replay delivers what's queued, in order, stopping at the first failure so
+// nothing overtakes what came before it.
+func (s *spool) replay(deliver func(*spoolEntry) error) error {
+	for _, entry := range s.entries() {
+		if err := deliver(entry); err != nil {
+			return err
+		}
+		s.done(entry)
+	}
+	return nil
+}
+
+// trim throws out the oldest entries until the spool fits
+func (s *spool) trim() {
+	log := conf.FetchLog()
+
+	names := s.names()
+	sizes := make([]int64, len(names))
+	var total int64
+	for i, name := range names {
+		if info, err := os.Stat(filepath.Join(s.dir, name)); err == nil {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+
+	for i := 0; total > s.maxSize && i < len(names); i++ {
+		log.Infof("Spool is full, discarding %s", names[i])
+		os.Remove(filepath.Join(s.dir, names[i]))
+		total -= sizes[i]
+	}
+}
+
+func (s *spool) names() []string {
+	files, _ := ioutil.ReadDir(s.dir)
+	names := []string{}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".json") {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,182 @@
+package agent
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/appcanary/agent/conf"
+	"github.com/appcanary/testify/assert"
+)
+
+func TestSpool(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	dir, _ := ioutil.TempDir("", "canaryspool")
+	defer os.RemoveAll(dir)
+	s := newSpool(filepath.Join(dir, "spool"), 1024)
+
+	// only the newest from any one watcher is kept
+	assert.Nil(s.put(&spoolEntry{Type: spoolFile, Key: "/var/lib/dpkg/status", Body: []byte("old")}))
+	assert.Nil(s.put(&spoolEntry{Type: spoolProcessState, Key: "*", Body: []byte("{}")}))
+	assert.Nil(s.put(&spoolEntry{Type: spoolFile, Key: "/var/lib/dpkg/status", Body: []byte("new")}))
+
+	entries := s.entries()
+	assert.Equal(2, len(entries))
+	assert.Equal("*", entries[0].Key)
+	assert.Equal("new", string(entries[1].Body))
+
+	// which is what goes out, in order, until something fails
+	delivered := []string{}
+	err := s.replay(func(entry *spoolEntry) error {
+		if entry.Type == spoolFile {
+			return errors.New("API Error: 503")
+		}
+		delivered = append(delivered, entry.Key)
+		return nil
+	})
+	assert.NotNil(err)
+	assert.Equal([]string{"*"}, delivered)
+	assert.Equal(1, len(s.entries()))
+
+	// what got through some other way needn't be delivered again
+	s.drop(spoolFile, "/var/lib/dpkg/status")
+	assert.Equal(0, len(s.entries()))
+
+	// the oldest go when it's full, and what could never fit is refused
+	for _, key := range []string{"a", "b", "c", "d"} {
+		assert.Nil(s.put(&spoolEntry{Type: spoolFile, Key: key, Body: make([]byte, 200)}))
+	}
+	entries = s.entries()
+	assert.True(len(entries) < 4)
+	assert.Equal("d", entries[len(entries)-1].Key)
+	assert.NotNil(s.put(&spoolEntry{Type: spoolFile, Key: "huge", Body: make([]byte, 2048)}))
+
+	// and anything unreadable is thrown out
+	ioutil.WriteFile(filepath.Join(dir, "spool", "00000000000000000001-garbage.json"), []byte("{"), 0600)
+	assert.Equal(len(entries), len(s.entries()))
+}
+
+func TestAgentSpoolsFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	conf.InitEnv("test")
+	config, err := conf.NewConfFromEnv()
+	assert.Nil(err)
+
+	varDir := tempVarDir(assert)
+	defer os.RemoveAll(varDir)
+
+	statusPath := filepath.Join(varDir, "status")
+	ioutil.WriteFile(statusPath, []byte("Package: bash\nVersion: 4.3-7\n"), 0644)
+	config.Watchers = []conf.WatcherConf{}
+
+	client := &MockClient{}
+	client.On("SendFile").Return(errors.New("API Error: 502")).Once()
+	client.On("SendFile").Return(nil)
+	client.On("Heartbeat").Return(errors.New("API Error: 502")).Once()
+	client.On("Heartbeat").Return(nil)
+
+	agent := NewAgent("test", config, client)
+	watcher := NewFileWatcher(statusPath, testCallbackNOP).(TextWatcher)
+
+	// the API's down
+	agent.OnChange(watcher)
+	assert.NotNil(agent.Heartbeat())
+	assert.Equal("", config.ShippedChecksum(statusPath))
+
+	// and what didn't make it survives a restart
+	agent = NewAgent("test", config, client)
+	entries := agent.spool.entries()
+	assert.Equal(2, len(entries))
+	assert.Equal(spoolFile, entries[0].Type)
+	assert.Equal(spoolHeartbeat, entries[1].Type)
+
+	// until it's back up
+	assert.Nil(agent.ReplaySpool())
+	client.AssertNumberOfCalls(t, "SendFile", 2)
+	client.AssertNumberOfCalls(t, "Heartbeat", 2)
+	assert.NotEqual("", config.ShippedChecksum(statusPath))
+	assert.Equal(0, len(agent.spool.entries()))
+
+	// the package database we replayed is the baseline for the next diff
+	snapshot, err := loadSnapshot(statusPath)
+	assert.Nil(err)
+	assert.Equal(config.ShippedChecksum(statusPath), snapshot.Checksum)
+}
+
+func TestAgentSkipsSupersededSpool(t *testing.T) {
+	assert := assert.New(t)
+
+	conf.InitEnv("test")
+	config, err := conf.NewConfFromEnv()
+	assert.Nil(err)
+
+	varDir := tempVarDir(assert)
+	defer os.RemoveAll(varDir)
+
+	statusPath := filepath.Join(varDir, "status")
+	ioutil.WriteFile(statusPath, []byte("Package: bash\nVersion: 4.3-7\n"), 0644)
+	config.Watchers = []conf.WatcherConf{}
+
+	client := &MockClient{}
+	client.On("SendFile").Return(errors.New("API Error: 502")).Once()
+	client.On("SendFile").Return(nil)
+
+	agent := NewAgent("test", config, client)
+	watcher := NewFileWatcher(statusPath, testCallbackNOP).(TextWatcher)
+	agent.OnChange(watcher)
+	entries := agent.spool.entries()
+	assert.Equal(1, len(entries))
+
+	// the API's back, and the watcher got a newer version through while
+	// we were about to replay the old one
+	ioutil.WriteFile(statusPath, []byte("Package: bash\nVersion: 4.3-8\n"), 0644)
+	agent.OnChange(watcher)
+	shipped := config.ShippedChecksum(statusPath)
+	client.AssertNumberOfCalls(t, "SendFile", 2)
+
+	assert.Nil(agent.deliverSpooled(entries[0]))
+	client.AssertNumberOfCalls(t, "SendFile", 2)
+	assert.Equal(shipped, config.ShippedChecksum(statusPath))
+
+	// the same goes if it's still in the spool, but older than what got
+	// shipped
+	agent.spool.put(entries[0])
+	config.RecordShipped(statusPath, shipped)
+	entries = agent.spool.entries()
+	assert.Equal(1, len(entries))
+	assert.Nil(agent.deliverSpooled(entries[0]))
+	client.AssertNumberOfCalls(t, "SendFile", 2)
+	assert.Equal(shipped, config.ShippedChecksum(statusPath))
+
+	// a replay waits for a ship that's under way, and what that got through
+	// isn't overwritten once it's done
+	agent.spool.put(entries[0])
+	entries = agent.spool.entries()
+	unlock := agent.lockShipping(spoolFile, statusPath)
+	delivered := make(chan error)
+	go func() { delivered <- agent.deliverSpooled(entries[0]) }()
+	select {
+	case <-delivered:
+		t.Error("replayed while a ship was under way")
+	case <-time.After(50 * time.Millisecond):
+	}
+	agent.spool.drop(spoolFile, statusPath)
+	unlock()
+	assert.Nil(<-delivered)
+	client.AssertNumberOfCalls(t, "SendFile", 2)
+
+	// and the same goes for process maps
+	client.On("SendProcessState").Return(nil)
+	agent.spoolFailure(&spoolEntry{Type: spoolProcessState, Key: "*", Body: []byte("{}")})
+	entries = agent.spool.entries()
+	assert.Equal(1, len(entries))
+	agent.spool.drop(spoolProcessState, "*")
+	assert.Nil(agent.deliverSpooled(entries[0]))
+	client.AssertNumberOfCalls(t, "SendProcessState", 0)
+}
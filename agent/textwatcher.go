@@ -1,23 +1,26 @@
 package agent
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
-	"os/exec"
-	"path/filepath"
-	"strings"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/appcanary/agent/conf"
-
-	"hash/crc32"
 )
 
+var errEmptyOutput = errors.New("the command printed nothing")
+
 type TextWatcher interface {
 	Start()
 	Stop()
 	Contents() ([]byte, error)
+	Open() (io.ReadSeekCloser, error)
 	Path() string
 	Kind() string
 	MarshalJSON() ([]byte, error)
@@ -31,30 +34,30 @@ type textWatcher struct {
 	UpdatedAt    time.Time
 	BeingWatched bool
 	OnChange     ChangeHandler
-	Checksum     uint32
-	CmdName      string
-	CmdArgs      []string
+	Checksum     string
+	crc          uint32 // what the heartbeat reports, see MarshalJSON
+	LastError    string
+	command      *command
+	commandErr   error
 	contents     func() ([]byte, error)
+	open         func() (io.ReadSeekCloser, error)
+	output       []byte // what the command printed last
 	pollSleep    time.Duration
+	pollJitter   time.Duration
+	notifies     bool
+	stop         chan bool
 }
 
-// File watchers track changes in the contents of a file
-func NewFileWatcher(path string, callback ChangeHandler) Watcher {
-	// TODO the kind attribute we receive in this payload is kind of useless. If
-	// the agent just looks at the file name in order to set the kind, we can do
-	// that just fine in the server also. It'd make more sense to set kind to be
-	// the kind of watcher.
+// File watchers track changes in the contents of a file. The kind of file is
+// worked out from its name or contents, unless the (optional) settings say
+// otherwise.
+func NewFileWatcher(path string, callback ChangeHandler, settings ...conf.WatcherConf) Watcher {
 	env := conf.FetchEnv()
-	var kind string
-	filename := filepath.Base(path)
-	switch filename {
-	case "Gemfile.lock":
-		kind = "gemfile"
-	case "available":
-		//todo support debian
-		kind = "ubuntu"
-	case "status":
-		kind = "ubuntu"
+	setting := watcherSettings(settings)
+
+	kind := setting.Kind
+	if kind == "" {
+		kind = KindByName(path)
 	}
 
 	watcher := &textWatcher{
@@ -62,50 +65,65 @@ func NewFileWatcher(path string, callback ChangeHandler) Watcher {
 		OnChange:  callback,
 		kind:      kind,
 		UpdatedAt: time.Now(),
-		pollSleep: env.PollSleep,
+		notifies:  true,
 	}
+	watcher.pollSleep, watcher.pollJitter = pollTimes(setting, env.PollSleep)
 	watcher.contents = watcher.FileContents
+	watcher.open = watcher.OpenFile
 
 	// Do a scan off the bat so we get a checksum, and PUT the file
 	watcher.scan()
 	return watcher
 }
 
-// Process watchers track changes in the output of a command
-func NewCommandOutputWatcher(process string, callback ChangeHandler) Watcher {
+// Process watchers track changes in the output of a command. How the command
+// gets run (args, timeout, environment, user...) is up to the optional
+// settings.
+func NewCommandOutputWatcher(process string, callback ChangeHandler, settings ...conf.WatcherConf) Watcher {
 	env := conf.FetchEnv()
-	splat := strings.Split(process, " ")
-	name := splat[0]
-	args := splat[1:]
+	setting := watcherSettings(settings)
+
+	kind := setting.Kind
+	if kind == "" {
+		kind = "centos"
+	}
 
 	watcher := &textWatcher{
 		path:      process,
 		OnChange:  callback,
-		kind:      "centos",
+		kind:      kind,
 		UpdatedAt: time.Now(),
-		pollSleep: env.PollSleep,
-		CmdName:   name,
-		CmdArgs:   args,
 	}
+	watcher.pollSleep, watcher.pollJitter = pollTimes(setting, env.PollSleep)
+	watcher.command, watcher.commandErr = newCommand(process, setting)
 	watcher.contents = watcher.ProcessContents
+	watcher.open = watcher.OpenOutput
 
 	watcher.scan()
 	return watcher
 }
 
+// The API knows contents by their crc; the sha256 we tell changes apart by
+// stays between us and the var file. Errors only go along when there are any.
 func (tw *textWatcher) MarshalJSON() ([]byte, error) {
 	tw.Lock()
 	defer tw.Unlock()
-	ret, err := json.Marshal(map[string]interface{}{
-		"path":          tw.Path(),
-		"kind":          tw.Kind(),
+	fields := map[string]interface{}{
+		"path":          tw.path,
+		"kind":          tw.kind,
 		"updated-at":    tw.UpdatedAt,
 		"being-watched": tw.BeingWatched,
-		"crc":           tw.Checksum})
+		"crc":           tw.crc}
+	if tw.LastError != "" {
+		fields["error"] = tw.LastError
+	}
+	ret, err := json.Marshal(fields)
 	return ret, err
 }
 
 func (wt *textWatcher) Kind() string {
+	wt.Lock()
+	defer wt.Unlock()
 	return wt.kind
 }
 
@@ -122,18 +140,44 @@ func (wt *textWatcher) KeepPolling() bool {
 func (wt *textWatcher) Start() {
 	// log.Debug("Listening to: %s", wt.Path())
 	wt.Lock()
+	if wt.keepPolling {
+		wt.Unlock()
+		return
+	}
 	wt.keepPolling = true
+	wt.stop = make(chan bool)
+	stop := wt.stop
 	wt.Unlock()
-	go wt.listen()
+	go wt.listen(wt.newNotifier(), stop)
 }
 
 func (wt *textWatcher) Stop() {
 	// log.Debug("No longer listening to: %s", wt.Path())
 	wt.Lock()
+	if wt.keepPolling {
+		close(wt.stop)
+	}
 	wt.keepPolling = false
 	wt.Unlock()
 }
 
+// File watchers get woken up by the kernel whenever the file changes; if that
+// can't be arranged (or for command watchers) we just poll.
+func (wt *textWatcher) newNotifier() *fileNotifier {
+	if !wt.notifies {
+		return nil
+	}
+
+	notifier, err := newFileNotifier(wt.Path())
+	if err != nil {
+		log := conf.FetchLog()
+		log.Infof("Can't get change notifications for %s, polling instead: %s", wt.Path(), err)
+		return nil
+	}
+
+	return notifier
+}
+
 func (wt *textWatcher) GetBeingWatched() bool {
 	wt.Lock()
 	defer wt.Unlock()
@@ -147,13 +191,14 @@ func (wt *textWatcher) SetBeingWatched(bw bool) {
 }
 
 // since on init the checksum never match, we always trigger an OnChange when we
-// boot up
+// boot up; it's up to the agent to tell whether it already shipped the contents
+// before a restart
 func (wt *textWatcher) scan() {
 	// log.Debug("wt: Check for %s", wt.Path())
-	currentCheck := wt.currentChecksum()
+	contents, err := wt.Contents()
+	wt.setLastError(err)
 
-	if currentCheck == 0 {
-		// log.Debug("wt: checksum fail.")
+	if err != nil {
 		// there was some error reading the file.
 		// try again later?
 		wt.SetBeingWatched(false)
@@ -161,26 +206,78 @@ func (wt *textWatcher) scan() {
 	}
 
 	wt.SetBeingWatched(true)
+	currentCheck := checksum(contents)
 
 	if wt.Checksum != currentCheck {
+		wt.detectKind(contents)
+
+		wt.Lock()
+		wt.crc = crc32.ChecksumIEEE(contents)
+		wt.Unlock()
+
 		go wt.OnChange(wt)
 		wt.Checksum = currentCheck
 	}
 }
 
-func (wt *textWatcher) currentChecksum() uint32 {
-	file, err := wt.Contents()
+// Errors get reported in the heartbeat, and logged when they first show up
+// rather than on every scan.
+func (wt *textWatcher) setLastError(err error) {
+	log := conf.FetchLog()
+
+	msg := ""
 	if err != nil {
-		return 0
+		msg = err.Error()
+	}
+
+	wt.Lock()
+	changed := msg != wt.LastError
+	wt.LastError = msg
+	wt.Unlock()
+
+	if changed && err != nil {
+		log.Infof("Can't read %s: %s", wt.Path(), msg)
 	}
+}
+
+// A file whose name gave nothing away gets sniffed once we can read it
+func (wt *textWatcher) detectKind(contents []byte) {
+	wt.Lock()
+	defer wt.Unlock()
 
-	return crc32.ChecksumIEEE(file)
+	if wt.kind == "" {
+		wt.kind = DetectKind(wt.path, contents)
+	}
 }
 
-func (wt *textWatcher) listen() {
+// listen scans whenever we're notified of a change, and every poll
+// regardless, in case a notification was missed or couldn't be set up.
+func (wt *textWatcher) listen(notifier *fileNotifier, stop chan bool) {
+	var changed chan bool
+	if notifier != nil {
+		changed = notifier.C
+		defer notifier.Close()
+	}
+
 	for wt.KeepPolling() {
 		wt.scan()
-		time.Sleep(wt.pollSleep)
+
+		select {
+		case <-stop:
+			return
+		case <-changed:
+			// writes tend to come in bursts; give the writer a moment to
+			// finish and fold whatever else arrived into this one scan
+			time.Sleep(conf.NOTIFY_SETTLE)
+			select {
+			case <-changed:
+			default:
+			}
+		case <-time.After(nextPoll(wt.pollSleep, wt.pollJitter)):
+			if notifier != nil {
+				notifier.rewatch()
+			}
+		}
 	}
 }
 
@@ -188,15 +285,60 @@ func (wt *textWatcher) Contents() ([]byte, error) {
 	return wt.contents()
 }
 
+// Open is for reading the contents as they get sent, rather than all at once
+func (wt *textWatcher) Open() (io.ReadSeekCloser, error) {
+	return wt.open()
+}
+
 func (wt *textWatcher) FileContents() ([]byte, error) {
 	// log.Debug("####### file contents for %s!", wt.Path())
 	return ioutil.ReadFile(wt.Path())
 }
 
+func (wt *textWatcher) OpenFile() (io.ReadSeekCloser, error) {
+	return os.Open(wt.Path())
+}
+
 func (wt *textWatcher) ProcessContents() ([]byte, error) {
 	// log.Debug("####### process contents!")
-	cmd := exec.Command(wt.CmdName, wt.CmdArgs...)
-	out, err := cmd.Output()
+	if wt.commandErr != nil {
+		return nil, wt.commandErr
+	}
+	output, err := wt.command.Output()
+	if err != nil {
+		return nil, err
+	}
+	if len(output) == 0 {
+		// as ever, there's nothing to watch until it prints something
+		return nil, errEmptyOutput
+	}
+
+	wt.Lock()
+	wt.output = output
+	wt.Unlock()
+	return output, nil
+}
+
+// Command output doesn't stream, so what goes out is what the command printed
+// last rather than running it all over again
+func (wt *textWatcher) OpenOutput() (io.ReadSeekCloser, error) {
+	wt.Lock()
+	output := wt.output
+	wt.Unlock()
+
+	if output == nil {
+		var err error
+		if output, err = wt.ProcessContents(); err != nil {
+			return nil, err
+		}
+	}
+	return outputReader{bytes.NewReader(output)}, nil
+}
+
+type outputReader struct {
+	*bytes.Reader
+}
 
-	return out, err
+func (outputReader) Close() error {
+	return nil
 }
@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/appcanary/agent/conf"
+)
+
+// NewHTTPClient sets up how we reach the API: through a proxy (or whatever
+// HTTPS_PROXY says, if none's configured), trusting an extra CA bundle,
+// presenting a client certificate, and only accepting the API's certificate
+// if it's one of the pinned ones. Each attempt at a request gets up to the
+// request timeout.
+func NewHTTPClient(config *conf.Conf) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+
+	if config.CABundle != "" {
+		pool, err := caBundlePool(config.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.ClientCert != "" || config.ClientKey != "" {
+		if config.ClientCert == "" || config.ClientKey == "" {
+			return nil, errors.New("client_cert and client_key have to be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("can't load client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(config.PinnedKeys) > 0 {
+		pins := map[string]bool{}
+		for _, pin := range config.PinnedKeys {
+			pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+			if decoded, err := base64.StdEncoding.DecodeString(pin); err != nil || len(decoded) != sha256.Size {
+				return nil, fmt.Errorf("%q isn't a base64 encoded sha256 pin", pin)
+			}
+			pins[pin] = true
+		}
+		tlsConfig.VerifyPeerCertificate = verifyPins(pins)
+	}
+
+	proxy, err := proxyFunc(config.Proxy, config.NoProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	timeout := conf.DEFAULT_REQUEST_TIMEOUT
+	if config.RequestTimeout > 0 {
+		timeout = time.Duration(config.RequestTimeout) * time.Second
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// The system's CAs plus those in the bundle, for gateways that intercept TLS
+func caBundlePool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read CA bundle: %s", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", path)
+	}
+	return pool, nil
+}
+
+// Pins are the base64 encoded sha256 of a certificate's public key (as in
+// HPKP), and any certificate in the verified chain may match one, so pinning
+// the CA survives the API's certificate being renewed.
+func verifyPins(pins map[string]bool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				if pins[publicKeyPin(cert)] {
+					return nil
+				}
+			}
+		}
+		return errors.New("the API's certificate doesn't match any pinned key")
+	}
+}
+
+func publicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// proxyFunc picks the proxy for a request: the configured one, or else the
+// environment's, unless the host's in noProxy.
+func proxyFunc(proxy string, noProxy string) (func(*http.Request) (*url.URL, error), error) {
+	fallback := http.ProxyFromEnvironment
+
+	if proxy != "" {
+		if !strings.Contains(proxy, "://") {
+			proxy = "http://" + proxy
+		}
+		proxyURL, err := url.Parse(proxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("can't parse proxy %q", proxy)
+		}
+		// any credentials in the url go out as Proxy-Authorization
+		fallback = http.ProxyURL(proxyURL)
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL, noProxy) {
+			return nil, nil
+		}
+		return fallback(req)
+	}, nil
+}
+
+// bypassProxy tells whether a url's host is one of noProxy's comma separated
+// hosts, domains (which match their subdomains too), IPs or CIDR ranges, any
+// of which may have a port. "*" matches everything.
+func bypassProxy(u *url.URL, noProxy string) bool {
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	ip := net.ParseIP(host)
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			entry = h
+		}
+		entry = strings.Trim(entry, "[]")
+
+		if entryIP := net.ParseIP(entry); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		domain := strings.TrimPrefix(entry, "*")
+		domain = strings.TrimPrefix(domain, ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Without a way to reach the API there's nothing for the agent to do
+func agentClientSettings(ctx context.Context, config *conf.Conf) ClientSettings {
+	settings, err := NewClientSettings(ctx, config)
+	if err != nil {
+		conf.FetchLog().Fatalf("Please double check your network settings: %s", err)
+	}
+	return settings
+}
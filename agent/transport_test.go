@@ -0,0 +1,172 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/appcanary/agent/conf"
+	"github.com/appcanary/testify/assert"
+)
+
+func writePEM(assert *assert.Assertions, path string, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	assert.Nil(ioutil.WriteFile(path, data, 0600))
+}
+
+// a self signed certificate and its key, as files in dir
+func testClientCert(assert *assert.Assertions, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "agent"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(err)
+
+	certPath, keyPath := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	writePEM(assert, certPath, "CERTIFICATE", der)
+	writePEM(assert, keyPath, "EC PRIVATE KEY", keyDer)
+	return certPath, keyPath
+}
+
+func TestHTTPClientTLS(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	dir, _ := ioutil.TempDir("", "canarytls")
+	defer os.RemoveAll(dir)
+
+	var clientCerts int
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientCerts = len(r.TLS.PeerCertificates)
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	bundle := filepath.Join(dir, "bundle.pem")
+	writePEM(assert, bundle, "CERTIFICATE", ts.Certificate().Raw)
+
+	// the test server's certificate isn't one anybody trusts
+	client, err := NewHTTPClient(conf.NewConf())
+	assert.Nil(err)
+	_, err = client.Get(ts.URL)
+	assert.NotNil(err)
+
+	// unless it's in the bundle
+	config := conf.NewConf()
+	config.CABundle = bundle
+	client, err = NewHTTPClient(config)
+	assert.Nil(err)
+	res, err := client.Get(ts.URL)
+	assert.Nil(err)
+	res.Body.Close()
+	assert.Equal(0, clientCerts)
+
+	// we present our certificate if we have one
+	config.ClientCert, config.ClientKey = testClientCert(assert, dir)
+	client, err = NewHTTPClient(config)
+	assert.Nil(err)
+	res, err = client.Get(ts.URL)
+	assert.Nil(err)
+	res.Body.Close()
+	assert.Equal(1, clientCerts)
+
+	// and only talk to servers whose keys are pinned
+	config.PinnedKeys = []string{publicKeyPin(ts.Certificate())}
+	client, err = NewHTTPClient(config)
+	assert.Nil(err)
+	res, err = client.Get(ts.URL)
+	assert.Nil(err)
+	res.Body.Close()
+
+	config.PinnedKeys = []string{"sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}
+	client, err = NewHTTPClient(config)
+	assert.Nil(err)
+	_, err = client.Get(ts.URL)
+	assert.NotNil(err)
+
+	// settings that make no sense are refused up front
+	for _, broken := range []func(*conf.Conf){
+		func(c *conf.Conf) { c.PinnedKeys = []string{"not a pin"} },
+		func(c *conf.Conf) { c.ClientKey = "" },
+		func(c *conf.Conf) { c.CABundle = filepath.Join(dir, "client.key") },
+		func(c *conf.Conf) { c.Proxy = "http://" },
+	} {
+		config := conf.NewConf()
+		config.CABundle, config.ClientCert, config.ClientKey = bundle, filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+		broken(config)
+		_, err := NewHTTPClient(config)
+		assert.NotNil(err)
+	}
+}
+
+func TestHTTPClientProxy(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	var proxied *http.Request
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r
+	}))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	proxyURL.User = url.UserPassword("agent", "secret")
+
+	config := conf.NewConf()
+	config.Proxy = proxyURL.String()
+	config.NoProxy = "localhost, .internal.example.com,10.0.0.0/8"
+	client, err := NewHTTPClient(config)
+	assert.Nil(err)
+
+	res, err := client.Get("http://api.example.com/v3/heartbeat")
+	assert.Nil(err)
+	res.Body.Close()
+	assert.NotNil(proxied)
+	assert.Equal("api.example.com", proxied.Host)
+	assert.Equal("Basic YWdlbnQ6c2VjcmV0", proxied.Header.Get("Proxy-Authorization"))
+
+	// what's in no_proxy is reached directly
+	proxies, _ := proxyFunc(config.Proxy, config.NoProxy)
+	for rawurl, direct := range map[string]bool{
+		"https://api.example.com":                false,
+		"https://localhost:8443":                 true,
+		"https://api.internal.example.com":       true,
+		"https://internal.example.com":           true,
+		"https://notinternal.example.com":        false,
+		"http://10.1.2.3/v3":                     true,
+		"http://11.1.2.3/v3":                     false,
+		"https://canary.internal.example.com:99": true,
+	} {
+		req, _ := http.NewRequest("GET", rawurl, nil)
+		u, err := proxies(req)
+		assert.Nil(err)
+		assert.Equal(direct, u == nil, rawurl)
+	}
+
+	assert.True(bypassProxy(&url.URL{Scheme: "https", Host: "api.example.com"}, "*"))
+	assert.True(bypassProxy(&url.URL{Scheme: "https", Host: "api.example.com"}, "api.example.com:443"))
+	assert.False(bypassProxy(&url.URL{Scheme: "https", Host: "api.example.com"}, "api.example.com:80"))
+}
@@ -60,7 +60,7 @@ func executeUpgradeSequence(commands UpgradeSequence) error {
 	log := conf.FetchLog()
 
 	if env.DryRun {
-		log.Info("Running upgrade in dry-run mode...")
+		log.Info("Running in dry-run mode...")
 	}
 
 	for _, command := range commands {
@@ -0,0 +1,271 @@
+package agent
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/appcanary/agent/conf"
+)
+
+// How a file's contents go out: base64 encoded in JSON, as the API's always
+// taken them, or as they are in a multipart/form-data upload, which saves
+// base64's third on top.
+const (
+	UploadJson = "json"
+	UploadRaw  = "raw"
+)
+
+// The content coding uploads get compressed with, once the API says it takes it
+const uploadCoding = "gzip"
+
+var errNotRewindable = errors.New("the file can't be read again to send it again")
+
+// How a client sends files until the API tells it otherwise, either by what it
+// lists in Accept-Encoding (RFC 7694) or by turning an upload down with a 415.
+type uploadEncoding struct {
+	format string
+	coding string // "" for none
+}
+
+func (enc uploadEncoding) String() string {
+	if enc.coding == "" {
+		return "uncompressed " + enc.format
+	}
+	return enc.coding + " compressed " + enc.format
+}
+
+// accepting is how to send uploads to an API that lists codings in
+// Accept-Encoding: compressed if it's one of them (and not q=0), otherwise
+// not. An empty list means it takes no coding at all.
+func (enc uploadEncoding) accepting(codings []string) uploadEncoding {
+	enc.coding = ""
+	for _, value := range codings {
+		for _, coding := range strings.Split(value, ",") {
+			params := strings.Split(coding, ";")
+			if !strings.EqualFold(strings.TrimSpace(params[0]), uploadCoding) {
+				continue
+			}
+			enc.coding = uploadCoding
+			for _, param := range params[1:] {
+				if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") {
+					if weight, err := strconv.ParseFloat(q[2:], 64); err == nil && weight == 0 {
+						enc.coding = ""
+					}
+				}
+			}
+		}
+	}
+	return enc
+}
+
+// rejected is how to send an upload the API turned down with a 415 and no
+// Accept-Encoding to go by: as JSON if it was raw, otherwise uncompressed.
+func (enc uploadEncoding) rejected() uploadEncoding {
+	if enc.format == UploadRaw {
+		enc.format = UploadJson
+	} else {
+		enc.coding = ""
+	}
+	return enc
+}
+
+// negotiate goes by whatever codings the API says it accepts in a response
+func (c *CanaryClient) negotiate(res *http.Response) {
+	codings, ok := res.Header[http.CanonicalHeaderKey("Accept-Encoding")]
+	if !ok {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.uploads = c.uploads.accepting(codings)
+}
+
+// uploadFile streams a file's contents to the API, read as they're sent.
+// Every attempt reads them from the start, so unless contents is an io.Seeker
+// only one gets made.
+func (c *CanaryClient) uploadFile(uri string, path string, kind string, contents io.Reader) error {
+	log := conf.FetchLog()
+
+	var body *streamedBody
+	read := false
+	defer func() {
+		if body != nil {
+			body.stop(io.ErrClosedPipe)
+		}
+	}()
+
+	boundary := multipart.NewWriter(nil).Boundary()
+	tried := map[uploadEncoding]bool{}
+
+	for {
+		c.Lock()
+		enc := c.uploads
+		c.Unlock()
+		tried[enc] = true
+
+		contentType := "application/json"
+		if enc.format == UploadRaw {
+			contentType = "multipart/form-data; boundary=" + boundary
+		}
+
+		_, err := c.sendBody("PUT", uri, func() (io.Reader, error) {
+			if body != nil {
+				// the last attempt's done reading, whether or not it got to
+				// the end
+				body.stop(io.ErrClosedPipe)
+			}
+			if read {
+				if err := rewind(contents); err != nil {
+					return nil, err
+				}
+			}
+			read = true
+
+			body = streamBody(func(w io.Writer) error {
+				if enc.format == UploadRaw {
+					return writeFileForm(w, boundary, path, kind, contents)
+				}
+				return writeFileJson(w, path, kind, contents)
+			}, enc.coding)
+			return body, nil
+		}, contentType, enc.coding)
+
+		var apiErr *ApiError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnsupportedMediaType {
+			return err
+		}
+
+		c.Lock()
+		if c.uploads == enc {
+			// the API didn't say what it takes instead
+			c.uploads = enc.rejected()
+		}
+		next := c.uploads
+		c.Unlock()
+
+		if tried[next] {
+			return err
+		}
+		log.Infof("The API doesn't take %s uploads, sending them %s", enc, next)
+	}
+}
+
+func rewind(contents io.Reader) error {
+	seeker, ok := contents.(io.Seeker)
+	if !ok {
+		return errNotRewindable
+	}
+	_, err := seeker.Seek(0, io.SeekStart)
+	return err
+}
+
+// A request body that's written as it's read, by a goroutine of its own
+type streamedBody struct {
+	*io.PipeReader
+	done chan bool
+}
+
+// stop has the writer give up, if it hasn't finished, and waits for it to
+// return, so whatever it was reading from can be read again (or closed).
+func (body *streamedBody) stop(err error) {
+	body.CloseWithError(err)
+	<-body.done
+}
+
+// streamBody runs write in the background, its output compressed as it goes,
+// for a request to read as it's sent. Nothing gets buffered beyond what gzip
+// and the pipe need, however big the body.
+func streamBody(write func(io.Writer) error, coding string) *streamedBody {
+	reader, writer := io.Pipe()
+	body := &streamedBody{PipeReader: reader, done: make(chan bool)}
+
+	go func() {
+		defer close(body.done)
+
+		var err error
+		if coding == uploadCoding {
+			gz := gzip.NewWriter(writer)
+			err = write(gz)
+			if closeErr := gz.Close(); err == nil {
+				err = closeErr
+			}
+		} else {
+			err = write(writer)
+		}
+		// if the request gave up reading, this is where we find out
+		writer.CloseWithError(err)
+	}()
+
+	return body
+}
+
+// writeFileJson writes a file upload as the API expects it: its contents
+// base64 encoded, along with their checksum, worked out along the way.
+func writeFileJson(w io.Writer, path string, kind string, contents io.Reader) error {
+	pathJson, err := json.Marshal(path)
+	if err != nil {
+		return err
+	}
+	kindJson, err := json.Marshal(kind)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(w, `{"name":"","path":%s,"kind":%s,"contents":"`, pathJson, kindJson); err != nil {
+		return err
+	}
+
+	crc := crc32.NewIEEE()
+	b64enc := base64.NewEncoder(base64.StdEncoding, w)
+	if _, err := io.Copy(io.MultiWriter(b64enc, crc), contents); err != nil {
+		return err
+	}
+	if err := b64enc.Close(); err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, `","crc":%d}`, crc.Sum32())
+	return err
+}
+
+// writeFileForm writes the same fields as writeFileJson as a multipart form,
+// the contents as a file of their own. The checksum comes after them, so it
+// can be worked out along the way too.
+func writeFileForm(w io.Writer, boundary string, path string, kind string, contents io.Reader) error {
+	form := multipart.NewWriter(w)
+	if err := form.SetBoundary(boundary); err != nil {
+		return err
+	}
+
+	fields := [][2]string{{"name", ""}, {"path", path}, {"kind", kind}}
+	for _, field := range fields {
+		if err := form.WriteField(field[0], field[1]); err != nil {
+			return err
+		}
+	}
+
+	part, err := form.CreateFormFile("contents", filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	crc := crc32.NewIEEE()
+	if _, err := io.Copy(io.MultiWriter(part, crc), contents); err != nil {
+		return err
+	}
+
+	if err := form.WriteField("crc", strconv.FormatUint(uint64(crc.Sum32()), 10)); err != nil {
+		return err
+	}
+	return form.Close()
+}
@@ -1,5 +1,17 @@
 package agent
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/appcanary/agent/conf"
+)
+
 type ChangeHandler func(Watcher)
 
 type Watcher interface {
@@ -8,3 +20,79 @@ type Watcher interface {
 }
 
 type Watchers []Watcher
+
+// Watcher constructors take their settings as an optional trailing argument;
+// without one, everything is left at its default.
+func watcherSettings(settings []conf.WatcherConf) conf.WatcherConf {
+	if len(settings) > 0 {
+		return settings[0]
+	}
+	return conf.WatcherConf{}
+}
+
+// How long a watcher sleeps between polls, and by how much more at most. The
+// settings are in seconds; anything left unset falls back to the defaults.
+func pollTimes(setting conf.WatcherConf, defaultSleep time.Duration) (sleep time.Duration, jitter time.Duration) {
+	env := conf.FetchEnv()
+
+	sleep = defaultSleep
+	if setting.PollInterval > 0 {
+		sleep = time.Duration(setting.PollInterval) * time.Second
+	}
+
+	jitter = env.PollJitter
+	if setting.Jitter > 0 {
+		jitter = time.Duration(setting.Jitter) * time.Second
+	}
+
+	return
+}
+
+var jitterRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// nextPoll adds a random amount of up to jitter to sleep, so that a fleet of
+// agents started at the same time doesn't keep polling in lockstep.
+func nextPoll(sleep time.Duration, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return sleep
+	}
+
+	jitterRand.Lock()
+	defer jitterRand.Unlock()
+	return sleep + time.Duration(jitterRand.Int63n(int64(jitter)))
+}
+
+// How watchers tell whether contents changed
+func checksum(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:])
+}
+
+// checksumReader works out the checksum of what's read through it since it was
+// last rewound, the same as checksum would
+type checksumReader struct {
+	io.ReadSeeker
+	hash hash.Hash
+}
+
+func newChecksumReader(reader io.ReadSeeker) *checksumReader {
+	return &checksumReader{ReadSeeker: reader, hash: sha256.New()}
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	r.hash.Write(p[:n])
+	return n, err
+}
+
+func (r *checksumReader) Seek(offset int64, whence int) (int64, error) {
+	r.hash.Reset()
+	return r.ReadSeeker.Seek(offset, whence)
+}
+
+func (r *checksumReader) sum() string {
+	return hex.EncodeToString(r.hash.Sum(nil))
+}
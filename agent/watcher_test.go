@@ -1,8 +1,12 @@
 package agent
 
 import (
+	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -48,11 +52,20 @@ func TestWatchFile(t *testing.T) {
 		assert.True(false)
 	}
 
+	// the heartbeat reports the contents by their crc, as it always has
+	var heartbeat map[string]interface{}
+	hbJson, err := wfile.MarshalJSON()
+	assert.Nil(err)
+	assert.Nil(json.Unmarshal(hbJson, &heartbeat))
+	assert.Equal(float64(crc32.ChecksumIEEE([]byte(file_content))), heartbeat["crc"])
+	assert.NotContains(heartbeat, "sha256")
+	assert.NotContains(heartbeat, "error")
+
 	// solid. on boot it worked. But what
 	// if we changed the file contents?
 
 	newContents := []byte("HelloWorld\n")
-	err := ioutil.WriteFile(tf.Name(), newContents, 0777)
+	err = ioutil.WriteFile(tf.Name(), newContents, 0777)
 	assert.Nil(err)
 
 	// let's wait again just in case.
@@ -67,6 +80,44 @@ func TestWatchFile(t *testing.T) {
 	wfile.Stop()
 }
 
+// with polling effectively turned off, a change should
+// still get picked up via inotify
+func TestWatchFileNotification(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	tf, _ := ioutil.TempFile("", "gems.lock")
+	tf.Write([]byte("tst1"))
+	tf.Close()
+	defer os.Remove(tf.Name())
+
+	timer := time.Tick(5 * time.Second)
+	cbInvoked := make(chan bool, 10)
+	testcb := func(nop Watcher) {
+		cbInvoked <- true
+	}
+
+	wfile := NewFileWatcher(tf.Name(), testcb).(*textWatcher)
+	wfile.pollSleep = time.Hour
+	wfile.Start()
+	defer wfile.Stop()
+	<-cbInvoked
+
+	// replace the file the way a deploy would
+	replacement := tf.Name() + ".new"
+	err := ioutil.WriteFile(replacement, []byte("tst2"), 0644)
+	assert.Nil(err)
+	assert.Nil(os.Rename(replacement, tf.Name()))
+
+	select {
+	case invoked := <-cbInvoked:
+		assert.True(invoked)
+
+	case _ = <-timer:
+		assert.True(false)
+	}
+}
+
 func TestWatchProcess(t *testing.T) {
 	assert := assert.New(t)
 	conf.InitEnv("test")
@@ -110,6 +161,18 @@ func TestWatchProcess(t *testing.T) {
 	wfile.Stop()
 }
 
+func TestWatchProcessFailure(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	wcmd := NewCommandOutputWatcher("false", testCallbackNOP).(*textWatcher)
+	assert.False(wcmd.GetBeingWatched())
+
+	json, err := wcmd.MarshalJSON()
+	assert.Nil(err)
+	assert.True(strings.Contains(string(json), `"error":"false: exit status 1"`))
+}
+
 func TestWatchFileFailure(t *testing.T) {
 	assert := assert.New(t)
 	conf.InitEnv("test")
@@ -279,3 +342,113 @@ func TestWatchFileHookLoop(t *testing.T) {
 }
 
 // TODO: create version of the above test where we compare files that are identical in size, and were touched within one second
+
+func TestPollTimes(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	sleep, jitter := pollTimes(conf.WatcherConf{}, time.Minute)
+	assert.Equal(time.Minute, sleep)
+	assert.Equal(time.Duration(0), jitter)
+
+	sleep, jitter = pollTimes(conf.WatcherConf{PollInterval: 30, Jitter: 10}, time.Minute)
+	assert.Equal(30*time.Second, sleep)
+	assert.Equal(10*time.Second, jitter)
+
+	assert.Equal(time.Minute, nextPoll(time.Minute, 0))
+	for i := 0; i < 100; i++ {
+		next := nextPoll(time.Minute, time.Second)
+		assert.True(next >= time.Minute && next < time.Minute+time.Second)
+	}
+}
+
+// every file watcher shares the one inotify instance, and only hears about
+// its own file
+func TestWatchFileNotificationsShared(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	dir, _ := ioutil.TempDir("", "canarynotify")
+	defer os.RemoveAll(dir)
+
+	first, err := newFileNotifier(filepath.Join(dir, "Gemfile.lock"))
+	assert.Nil(err)
+	second, err := newFileNotifier(filepath.Join(dir, "yarn.lock"))
+	assert.Nil(err)
+	assert.True(first.hub == second.hub)
+
+	ioutil.WriteFile(filepath.Join(dir, "yarn.lock"), []byte("lock"), 0644)
+	select {
+	case <-second.C:
+	case <-time.After(5 * time.Second):
+		assert.Fail("no notification for yarn.lock")
+	}
+	select {
+	case <-first.C:
+		assert.Fail("notified about yarn.lock for Gemfile.lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// polling doesn't have a watch that's fine dropped and added again,
+	// which others would miss whatever happens in between
+	hubLock.Lock()
+	watched := first.hub.watched[dir]
+	hubLock.Unlock()
+	first.rewatch()
+	hubLock.Lock()
+	assert.True(watched == first.hub.watched[dir])
+	hubLock.Unlock()
+
+	// but one that's on a file since replaced is
+	replacement := filepath.Join(dir, "yarn.lock.new")
+	ioutil.WriteFile(replacement, []byte("new lock"), 0644)
+	os.Rename(replacement, filepath.Join(dir, "yarn.lock"))
+	select {
+	case <-second.C:
+	case <-time.After(5 * time.Second):
+		assert.Fail("no notification for yarn.lock getting replaced")
+	}
+	second.rewatch()
+	info, _ := os.Stat(filepath.Join(dir, "yarn.lock"))
+	hubLock.Lock()
+	assert.True(os.SameFile(info, second.hub.watched[filepath.Join(dir, "yarn.lock")]))
+	hubLock.Unlock()
+
+	// closing one leaves the other's watches (on the same directory) alone
+	first.Close()
+	os.Remove(filepath.Join(dir, "yarn.lock"))
+	select {
+	case <-second.C:
+	case <-time.After(5 * time.Second):
+		assert.Fail("no notification for yarn.lock after closing the other")
+	}
+
+	second.Close()
+	hubLock.Lock()
+	assert.Nil(second.hub.watching[dir])
+	assert.Nil(second.hub.watching[filepath.Join(dir, "yarn.lock")])
+	hubLock.Unlock()
+}
+
+// a command that prints nothing isn't watched, same as one that fails
+func TestWatchProcessEmptyOutput(t *testing.T) {
+	assert := assert.New(t)
+	conf.InitEnv("test")
+
+	cbInvoked := make(chan bool, 1)
+	testcb := func(nop Watcher) {
+		cbInvoked <- true
+	}
+
+	wt := NewCommandOutputWatcher("true", testcb).(*textWatcher)
+	_, err := wt.Contents()
+	assert.Equal(errEmptyOutput, err)
+	assert.False(wt.GetBeingWatched())
+	assert.Equal(errEmptyOutput.Error(), wt.LastError)
+
+	select {
+	case <-cbInvoked:
+		assert.Fail("empty output got shipped")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -4,14 +4,28 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/appcanary/agent/agent/detect"
 )
 
 type ServerConf struct {
-	UUID string `toml:"uuid" yaml:"uuid"`
+	UUID       string                 `toml:"uuid" yaml:"uuid"`
+	Shipped    map[string]ShippedFile `toml:"-" yaml:"shipped,omitempty"`
+	Identities map[string]string      `toml:"-" yaml:"identities,omitempty"` // images and containers => uuid
 }
 
+// What we last successfully sent for a watcher, so we don't send it all over
+// again every time we restart.
+type ShippedFile struct {
+	Checksum  string    `yaml:"checksum"`
+	ShippedAt time.Time `yaml:"shipped_at"`
+}
+
+// watchers ship (and so save) from their own goroutines
+var serverConfLock sync.Mutex
+
 type Conf struct {
 	detect.LinuxOSInfo `yaml:",inline"`
 	ApiKey             string        `yaml:"api_key,omitempty" toml:"api_key"`
@@ -19,20 +33,155 @@ type Conf struct {
 	ServerName         string        `yaml:"server_name,omitempty" toml:"server_name"`
 	Watchers           []WatcherConf `yaml:"watchers" toml:"files"`
 	StartupDelay       int           `yaml:"startup_delay,omitempty" toml:"startup_delay"`
+	SpoolSize          int           `yaml:"spool_size,omitempty" toml:"-"` // in megabytes
 	ServerConf         *ServerConf   `yaml:"-" toml:"-"`
 	Tags               []string      `yaml:"tags,omitempty"` // no toml support for this
+
+	// for reaching the API; pinned keys are base64 encoded sha256 hashes of
+	// public keys in its certificate chain
+	Proxy      string   `yaml:"proxy,omitempty" toml:"-"`
+	NoProxy    string   `yaml:"no_proxy,omitempty" toml:"-"`
+	CABundle   string   `yaml:"ca_bundle,omitempty" toml:"-"`
+	ClientCert string   `yaml:"client_cert,omitempty" toml:"-"`
+	ClientKey  string   `yaml:"client_key,omitempty" toml:"-"`
+	PinnedKeys []string `yaml:"pinned_keys,omitempty" toml:"-"`
+
+	// how long (in seconds) a request to the API may take, how long we keep
+	// retrying it, and which responses are worth retrying
+	RequestTimeout int   `yaml:"request_timeout,omitempty" toml:"-"`
+	RetryFor       int   `yaml:"retry_for,omitempty" toml:"-"`
+	RetryStatuses  []int `yaml:"retry_statuses,omitempty" toml:"-"`
+
+	// how files go out to begin with: "json" (base64 encoded) or "raw"; it's
+	// up to the API what they go out as after that
+	UploadFormat string `yaml:"upload_format,omitempty" toml:"-"`
 }
 
 type WatcherConf struct {
-	Path    string `yaml:"path,omitempty" toml:"path"`
-	Process string `yaml:"process,omitempty" toml:"inspect_process"`
-	Command string `yaml:"command,omitempty" toml:"process"`
+	Path       string `yaml:"path,omitempty" toml:"path"`
+	Process    string `yaml:"process,omitempty" toml:"inspect_process"`
+	Command    string `yaml:"command,omitempty" toml:"process"`
+	Discover   string `yaml:"discover,omitempty" toml:"-"`
+	Image      string `yaml:"image,omitempty" toml:"-"`
+	Containers string `yaml:"containers,omitempty" toml:"-"`
+	Kernel     bool   `yaml:"kernel,omitempty" toml:"-"`
+	Kind       string `yaml:"kind,omitempty" toml:"-"`
+
+	// in seconds
+	PollInterval int `yaml:"poll_interval,omitempty" toml:"-"`
+	Jitter       int `yaml:"jitter,omitempty" toml:"-"`
+
+	// for processes, to narrow down the ones process matches; exe, cmdline
+	// and cgroup are regexps, unit a pattern as in filepath.Match, user the
+	// name or uid they run as
+	Exe     string `yaml:"exe,omitempty" toml:"-"`
+	Cmdline string `yaml:"cmdline,omitempty" toml:"-"`
+	User    string `yaml:"user,omitempty" toml:"-"`
+	Ppid    int    `yaml:"ppid,omitempty" toml:"-"`
+	Unit    string `yaml:"unit,omitempty" toml:"-"`
+	Cgroup  string `yaml:"cgroup,omitempty" toml:"-"`
+
+	// how much CPU time (in seconds) a process scan may take, and how often
+	// (also in seconds) the whole process map gets shipped
+	CPUBudget        int `yaml:"cpu_budget,omitempty" toml:"-"`
+	SnapshotInterval int `yaml:"snapshot_interval,omitempty" toml:"-"`
+
+	// for discovery
+	Depth   int      `yaml:"depth,omitempty" toml:"-"`
+	Exclude []string `yaml:"exclude,omitempty" toml:"-"`
+
+	// for commands
+	Args    []string          `yaml:"args,omitempty" toml:"-"`
+	Timeout int               `yaml:"timeout,omitempty" toml:"-"` // seconds
+	Env     map[string]string `yaml:"env,omitempty" toml:"-"`
+	Dir     string            `yaml:"dir,omitempty" toml:"-"`
+	RunAs   string            `yaml:"run_as,omitempty" toml:"-"`
+
+	// for images
+	Ref string `yaml:"ref,omitempty" toml:"-"`
+
+	// for containers
+	Paths []string `yaml:"paths,omitempty" toml:"-"`
 }
 
 func NewConf() *Conf {
 	return &Conf{ServerConf: &ServerConf{}}
 }
 
+// The checksum of what we last shipped for path, or "" if we never did
+func (c *Conf) ShippedChecksum(path string) string {
+	serverConfLock.Lock()
+	defer serverConfLock.Unlock()
+	return c.ServerConf.Shipped[path].Checksum
+}
+
+// When we last shipped path, or the zero time if we never did
+func (c *Conf) ShippedAt(path string) time.Time {
+	serverConfLock.Lock()
+	defer serverConfLock.Unlock()
+	return c.ServerConf.Shipped[path].ShippedAt
+}
+
+// Remember (in the var file) that we shipped path with the given checksum
+func (c *Conf) RecordShipped(path string, checksum string) {
+	serverConfLock.Lock()
+	defer serverConfLock.Unlock()
+
+	if c.ServerConf.Shipped == nil {
+		c.ServerConf.Shipped = map[string]ShippedFile{}
+	}
+	c.ServerConf.Shipped[path] = ShippedFile{Checksum: checksum, ShippedAt: time.Now()}
+	saveServerConfLocked(c, env.VarFile)
+}
+
+// The uuid we're registered as, or "" if we aren't yet
+func (c *Conf) ServerUUID() string {
+	serverConfLock.Lock()
+	defer serverConfLock.Unlock()
+	return c.ServerConf.UUID
+}
+
+// Remember (in the var file) that we're registered as uuid now, and forget
+// everything we shipped, as we shipped it as some other server
+func (c *Conf) RegisteredAs(uuid string) {
+	serverConfLock.Lock()
+	defer serverConfLock.Unlock()
+
+	c.ServerConf.UUID = uuid
+	c.ServerConf.Shipped = nil
+	saveServerConfLocked(c, env.VarFile)
+}
+
+// The uuid an image or container (e.g. "image:nginx:1.25") got registered
+// as, or "" if it never was
+func (c *Conf) IdentityUUID(identity string) string {
+	serverConfLock.Lock()
+	defer serverConfLock.Unlock()
+	return c.ServerConf.Identities[identity]
+}
+
+// Remember (in the var file) the uuid an image or container got registered as
+func (c *Conf) RecordIdentity(identity string, uuid string) {
+	serverConfLock.Lock()
+	defer serverConfLock.Unlock()
+
+	if c.ServerConf.Identities == nil {
+		c.ServerConf.Identities = map[string]string{}
+	}
+	c.ServerConf.Identities[identity] = uuid
+	saveServerConfLocked(c, env.VarFile)
+}
+
+// Forget the uuid an image or container got registered as, e.g. because it
+// was deleted
+func (c *Conf) ForgetIdentity(identity string) {
+	serverConfLock.Lock()
+	defer serverConfLock.Unlock()
+
+	delete(c.ServerConf.Identities, identity)
+	saveServerConfLocked(c, env.VarFile)
+}
+
 func (c *Conf) OSInfo() *detect.LinuxOSInfo {
 	if c.Distro != "" && c.Release != "" {
 		return &c.LinuxOSInfo
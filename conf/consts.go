@@ -31,6 +31,12 @@ const (
 	DEFAULT_SYNC_ALL_DURATION = 24 * time.Hour
 	DEV_SYNC_ALL_DURATION     = 30 * time.Second
 
+	// how often we try to deliver what we failed to send before, and how
+	// much of it we keep around (in megabytes)
+	DEFAULT_SPOOL_DURATION = 5 * time.Minute
+	DEV_SPOOL_DURATION     = 10 * time.Second
+	DEFAULT_SPOOL_SIZE     = 64
+
 	DEFAULT_LOG_FILE = "/var/log/appcanary.log"
 )
 
@@ -41,15 +47,52 @@ const (
 	API_SERVERS   = API_VERSION + "servers"
 )
 
+// api requests: how long one attempt may take, and how long we keep trying
+const (
+	DEFAULT_REQUEST_TIMEOUT = 1 * time.Minute
+	DEFAULT_RETRY_DURATION  = 15 * time.Minute
+	DEV_RETRY_DURATION      = 10 * time.Second
+)
+
 // file polling
 const (
-	DEFAULT_POLL_SLEEP = 5 * time.Minute
+	DEFAULT_POLL_SLEEP         = 5 * time.Minute
+	DEFAULT_POLL_JITTER        = 30 * time.Second
+	DEFAULT_PROCESS_POLL_SLEEP = 30 * time.Minute
+	DEFAULT_PROCESS_CPU_BUDGET = 1 * time.Minute
+
+	// how often process watchers ship the whole process map, rather than
+	// what changed
+	DEFAULT_PROCESS_SNAPSHOT_INTERVAL = 24 * time.Hour
+
 	// test env.PollSleep is 1second
 	// test poll sleep is double to give the fs time to flush
 	DEV_POLL_SLEEP  = time.Second
 	TEST_POLL_SLEEP = (time.Second + (150 * time.Millisecond)) * 2
+
+	// how long we wait after a change notification before reading the file
+	NOTIFY_SETTLE = 100 * time.Millisecond
 )
 
+// command watchers
+const (
+	DEFAULT_COMMAND_TIMEOUT = 5 * time.Minute
+)
+
+// kernel watchers: how long needs-restarting may take (it waits on yum's
+// lock), and how long what it says holds
+const (
+	NEEDS_RESTARTING_TIMEOUT = 1 * time.Minute
+	NEEDS_RESTARTING_TTL     = DEFAULT_POLL_SLEEP
+)
+
+// lockfile discovery
+const (
+	DEFAULT_DISCOVER_DEPTH = 6
+)
+
+var DEFAULT_DISCOVER_EXCLUDE = []string{".git", "node_modules", "vendor"}
+
 // trolol
 const (
 	DEV_LOGO = `
@@ -15,6 +15,7 @@ type Env struct {
 	Prod              bool
 	DryRun            bool
 	FailOnConflict    bool
+	Execute           bool
 	Logo              string
 	BaseUrl           string
 	ConfFile          string
@@ -23,13 +24,18 @@ type Env struct {
 	LogFileHandle     *os.File
 	HeartbeatDuration time.Duration
 	SyncAllDuration   time.Duration
+	SpoolDuration     time.Duration
+	RetryDuration     time.Duration
 	PollSleep         time.Duration
+	PollJitter        time.Duration
+	ProcessPollSleep  time.Duration
 }
 
 var env = &Env{
 	Prod:              true,
 	DryRun:            false,
 	FailOnConflict:    false,
+	Execute:           false,
 	Logo:              PROD_LOGO,
 	BaseUrl:           PROD_URL,
 	ConfFile:          DEFAULT_CONF_FILE,
@@ -37,7 +43,11 @@ var env = &Env{
 	LogFile:           DEFAULT_LOG_FILE,
 	HeartbeatDuration: DEFAULT_HEARTBEAT_DURATION,
 	SyncAllDuration:   DEFAULT_SYNC_ALL_DURATION,
-	PollSleep:         DEFAULT_POLL_SLEEP}
+	SpoolDuration:     DEFAULT_SPOOL_DURATION,
+	RetryDuration:     DEFAULT_RETRY_DURATION,
+	PollSleep:         DEFAULT_POLL_SLEEP,
+	PollJitter:        DEFAULT_POLL_JITTER,
+	ProcessPollSleep:  DEFAULT_PROCESS_POLL_SLEEP}
 
 func FetchEnv() *Env {
 	return env
@@ -82,8 +92,12 @@ func InitEnv(envStr string) {
 
 		env.HeartbeatDuration = DEV_HEARTBEAT_DURATION
 		env.SyncAllDuration = DEV_SYNC_ALL_DURATION
+		env.SpoolDuration = DEV_SPOOL_DURATION
+		env.RetryDuration = DEV_RETRY_DURATION
 
 		env.PollSleep = DEV_POLL_SLEEP
+		env.PollJitter = 0
+		env.ProcessPollSleep = DEV_POLL_SLEEP
 
 	}
 }
@@ -121,6 +135,11 @@ func InitLogging() {
 	}
 }
 
+// Where we keep state of our own, next to the var file
+func VarPath(name string) string {
+	return filepath.Join(filepath.Dir(env.VarFile), name)
+}
+
 func ApiHeartbeatPath(ident string) string {
 	return ApiPath(API_HEARTBEAT) + "/" + ident
 }
@@ -137,6 +156,14 @@ func ApiServerProcsPath(ident string) string {
 	return ApiServerPath(ident) + "/processes"
 }
 
+func ApiServerProcEventsPath(ident string) string {
+	return ApiServerProcsPath(ident) + "/events"
+}
+
+func ApiServerDiffPath(ident string) string {
+	return ApiServerPath(ident) + "/diff"
+}
+
 func ApiPath(resource string) string {
 	return env.BaseUrl + resource
 }
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 
 	yaml "gopkg.in/yaml.v2"
 )
@@ -11,13 +13,48 @@ import (
 func save(fileName string, data []byte) {
 	log := FetchLog()
 
-	err := ioutil.WriteFile(fileName, data, 0644)
+	err := writeFile(fileName, data, 0644)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+// writeFile writes to a temporary file next to fileName and renames it into
+// place, so whoever reads fileName (us, after a crash) gets either what was
+// there or all of data, never half of it.
+func writeFile(fileName string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(fileName), "."+filepath.Base(fileName)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // unless it got renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
+
+// The lock's held until it's written, so what ends up in the file is the
+// latest of what got saved rather than whichever save finished last
 func saveServerConf(c *Conf, varFile string) {
+	serverConfLock.Lock()
+	defer serverConfLock.Unlock()
+	saveServerConfLocked(c, varFile)
+}
+
+func saveServerConfLocked(c *Conf, varFile string) {
 	log := FetchLog()
 
 	yml, err := yaml.Marshal(c.ServerConf)
@@ -1,10 +1,15 @@
 package conf
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/stateio/testify/assert"
+	yaml "gopkg.in/yaml.v2"
 )
 
 func TestYamlConf(t *testing.T) {
@@ -20,7 +25,7 @@ func TestYamlConf(t *testing.T) {
 	assert.Equal("testDistro", conf.Distro)
 	assert.Equal("testRelease", conf.Release)
 
-	assert.Equal(3, len(conf.Watchers), "number of watchers")
+	assert.Equal(4, len(conf.Watchers), "number of watchers")
 
 	dpkg := conf.Watchers[0]
 	assert.Equal("/var/lib/dpkg/available", dpkg.Path, "file path")
@@ -31,6 +36,11 @@ func TestYamlConf(t *testing.T) {
 	cmd := conf.Watchers[2]
 	assert.Equal("fakecmdhere", cmd.Command, "command path")
 
+	discover := conf.Watchers[3]
+	assert.Equal("/srv", discover.Discover, "discover root")
+	assert.Equal(3, discover.Depth, "discover depth")
+	assert.Equal([]string{"releases"}, discover.Exclude, "discover exclude")
+
 	assert.Equal("123456", conf.ServerConf.UUID)
 }
 
@@ -93,3 +103,40 @@ func TestTomlYamlConversion(t *testing.T) {
 
 	assert.Equal("123456", conf.ServerConf.UUID)
 }
+
+func TestSaveServerConf(t *testing.T) {
+	assert := assert.New(t)
+	InitEnv("test")
+
+	dir, _ := ioutil.TempDir("", "canaryconf")
+	defer os.RemoveAll(dir)
+	oldVarFile := env.VarFile
+	env.VarFile = filepath.Join(dir, "server.yml")
+	defer func() { env.VarFile = oldVarFile }()
+
+	conf := NewConf()
+	conf.ServerConf.UUID = "123456"
+
+	// watchers ship from their own goroutines; every save has all of what
+	// was shipped up to it, and the file's never half written
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conf.RecordShipped(fmt.Sprintf("/app%d/Gemfile.lock", i), "checksum")
+		}(i)
+	}
+	wg.Wait()
+
+	data, err := ioutil.ReadFile(env.VarFile)
+	assert.Nil(err)
+	var saved ServerConf
+	assert.Nil(yaml.Unmarshal(data, &saved))
+	assert.Equal("123456", saved.UUID)
+	assert.Equal(20, len(saved.Shipped))
+
+	// and nothing's left lying around
+	entries, _ := ioutil.ReadDir(dir)
+	assert.Equal(1, len(entries))
+}
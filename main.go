@@ -23,6 +23,8 @@ const (
 	PerformDetectOS
 	PerformProcessInspection
 	PerformProcessInspectionJsonDump
+	PerformImageInspection
+	PerformRestartPlan
 )
 
 func usage() {
@@ -33,6 +35,8 @@ func usage() {
 		"\t[none]\t\t\tStart the agent\n"+
 		"\tupgrade\t\t\tUpgrade system packages to nearest safe version (Ubuntu only)\n"+
 		"\tinspect-processes\tSend your process library information to Appcanary\n"+
+		"\tinspect-image IMAGE [REF]\tSend the packages in a container image (docker save tarball or OCI layout) to Appcanary\n"+
+		"\trestart-plan\t\tList the services running outdated libraries, and how to restart them\n"+
 		"\tdetect-os\t\tDetect current operating system\n")
 }
 
@@ -49,6 +53,8 @@ func parseFlags(argRange int, env *conf.Env) {
 	// -version is handled in parseArguments, but is set here for the usage print out
 	defaultFlags.BoolVar(&displayVersionFlagged, "version", false, "Display version information")
 
+	defaultFlags.BoolVar(&env.Execute, "execute", false, "Have restart-plan run the restart commands rather than just print them (see also -dry-run)")
+
 	defaultFlags.BoolVar(&env.FailOnConflict, "fail-on-conflict", false, "Should upgrade encounter a conflict with configuration files, abort (default: old configuration files are kept, or updated if not modified)")
 
 	if !env.Prod {
@@ -58,6 +64,17 @@ func parseFlags(argRange int, env *conf.Env) {
 	defaultFlags.Parse(os.Args[argRange:])
 }
 
+// positionalArgs is what's left once the flags are parsed, flags being allowed
+// after arguments as well as before them (flag stops at the first argument)
+func positionalArgs() []string {
+	args := []string{}
+	for rest := defaultFlags.Args(); len(rest) > 0; rest = defaultFlags.Args() {
+		args = append(args, rest[0])
+		defaultFlags.Parse(rest[1:])
+	}
+	return args
+}
+
 func parseArguments(env *conf.Env) CommandToPerform {
 	var performCmd CommandToPerform
 
@@ -78,6 +95,10 @@ func parseArguments(env *conf.Env) CommandToPerform {
 		performCmd = PerformProcessInspection
 	case "inspect-processes-json":
 		performCmd = PerformProcessInspectionJsonDump
+	case "inspect-image":
+		performCmd = PerformImageInspection
+	case "restart-plan":
+		performCmd = PerformRestartPlan
 	case "-version":
 		performCmd = PerformDisplayVersion
 	case "--version":
@@ -106,7 +127,7 @@ func runDetectOS() {
 	os.Exit(0)
 }
 
-func initialize(env *conf.Env) *agent.Agent {
+func loadConf(env *conf.Env) *conf.Conf {
 	// let's get started eh
 	// start the logger
 	conf.InitLogging()
@@ -114,7 +135,7 @@ func initialize(env *conf.Env) *agent.Agent {
 
 	fmt.Println(env.Logo)
 
-	// slurp env, instantiate agent
+	// slurp env
 	config, err := conf.NewConfFromEnv()
 	if err != nil {
 		log.Fatal(err)
@@ -124,6 +145,15 @@ func initialize(env *conf.Env) *agent.Agent {
 		log.Fatal("There's no API key set. Get yours from https://appcanary.com/settings and set it in /etc/appcanary/agent.yml")
 	}
 
+	return config
+}
+
+// One-shot commands give up when the API turns us away for good; the daemon
+// waits until it'll talk to us again.
+func initialize(env *conf.Env, oneShot bool) *agent.Agent {
+	config := loadConf(env)
+	log := conf.FetchLog()
+
 	// If the config sets a startup delay, we wait to boot up here
 	if config.StartupDelay != 0 {
 		delay := time.Duration(config.StartupDelay) * time.Second
@@ -140,10 +170,15 @@ func initialize(env *conf.Env) *agent.Agent {
 		log.Debug("Found no server config. Let's register!")
 
 		for err := a.RegisterServer(); err != nil; {
-			// we don't need to wait here because of the backoff
-			// exponential decay library; by the time we hit this
-			// point we've been trying for about, what, an hour?
+			if oneShot && agent.NeedsAttention(err) {
+				log.Fatalf("Can't register server: %s", err)
+			}
+
+			// we don't need to wait here otherwise because of the
+			// backoff exponential decay library; by the time we hit
+			// this point we've been trying for about, what, an hour?
 			log.Infof("Register server error: %s", err)
+			a.WaitForApi()
 			err = a.RegisterServer()
 		}
 
@@ -157,7 +192,9 @@ func initialize(env *conf.Env) *agent.Agent {
 
 func runProcessInspection(a *agent.Agent) {
 	log := conf.FetchLog()
-	agent.ShipProcessMap(a)
+	if err := agent.ShipProcessMap(a); err != nil {
+		log.Fatalf("Can't ship process map: %s", err)
+	}
 	log.Info("Process inspection sent. Check https://appcanary.com")
 	os.Exit(0)
 }
@@ -167,6 +204,45 @@ func runProcessInspectionDump() {
 	os.Exit(0)
 }
 
+// Images get registered as servers of their own, so this doesn't need (or
+// register) the host it's run on.
+func runImageInspection(env *conf.Env, args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		usage()
+		os.Exit(1)
+	}
+
+	config := loadConf(env)
+	log := conf.FetchLog()
+
+	ref := ""
+	if len(args) == 2 {
+		ref = args[1]
+	}
+
+	a := agent.NewAgent(CanaryVersion, config)
+	if err := a.ShipImage(args[0], ref); err != nil {
+		log.Fatalf("Can't ship image: %s", err)
+	}
+
+	log.Info("Image inspection sent. Check https://appcanary.com")
+	os.Exit(0)
+}
+
+func runRestartPlan(env *conf.Env) {
+	log := conf.FetchLog()
+
+	plan := agent.BuildRestartPlan()
+	plan.Print(os.Stdout)
+
+	if env.Execute {
+		if err := plan.Execute(); err != nil {
+			log.Fatalf("Restart failed: %s", err)
+		}
+	}
+	os.Exit(0)
+}
+
 func runUpgrade(a *agent.Agent) {
 	log := conf.FetchLog()
 	log.Info("Running upgrade...")
@@ -193,6 +269,19 @@ func runAgentLoop(env *conf.Env, a *agent.Agent) {
 		}
 	}()
 
+	// deliver whatever didn't make it the first time round
+	go func() {
+		tick := time.Tick(env.SpoolDuration)
+
+		for {
+			<-tick
+			err := a.ReplaySpool()
+			if err != nil {
+				log.Infof("Spool error: %s", err)
+			}
+		}
+	}()
+
 	go func() {
 		tick := time.Tick(env.SyncAllDuration)
 
@@ -233,7 +322,7 @@ func main() {
 
 	case PerformProcessInspection:
 		checkYourPrivilege()
-		a := initialize(env)
+		a := initialize(env, true)
 		runProcessInspection(a)
 
 	case PerformProcessInspectionJsonDump:
@@ -241,12 +330,20 @@ func main() {
 		conf.InitLogging()
 		runProcessInspectionDump()
 
+	case PerformRestartPlan:
+		checkYourPrivilege()
+		conf.InitLogging()
+		runRestartPlan(env)
+
+	case PerformImageInspection:
+		runImageInspection(env, positionalArgs())
+
 	case PerformUpgrade:
-		a := initialize(env)
+		a := initialize(env, true)
 		runUpgrade(a)
 
 	case PerformAgentLoop:
-		a := initialize(env)
+		a := initialize(env, false)
 		runAgentLoop(env, a)
 	}
 